@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// alertTimeout bounds the time spent delivering a webhook alert.
+const alertTimeout = 5 * time.Second
+
+// recordFailure counts a failed message towards the alert threshold and
+// fires the alert webhook when the threshold is reached. At most one alert
+// is sent per alert window.
+func recordFailure(ctx context.Context, reason string) {
+	if *alertWebhook == "" {
+		return
+	}
+	count, err := countEvent("failures", *alertWindow)
+	if err != nil {
+		warnf(ctx, "unable to record failure for alerting: %s", err)
+		return
+	}
+	if count < *alertThreshold {
+		return
+	}
+	if ok, err := once("alert-sent", *alertWindow); err != nil || !ok {
+		return
+	}
+	alert(ctx, fmt.Sprintf("Postforward on %s: %d messages failed in the last %s. Latest error: %s",
+		getHostname(ctx), count, *alertWindow, reason))
+}
+
+// alert posts text to the alert webhook using a Slack-compatible payload.
+func alert(ctx context.Context, text string) {
+	payload, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		warnf(ctx, "unable to encode alert: %s", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, alertTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, *alertWebhook, bytes.NewReader(payload))
+	if err != nil {
+		warnf(ctx, "unable to send alert: %s", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		warnf(ctx, "unable to send alert: %s", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		warnf(ctx, "unable to send alert: webhook returned %s", resp.Status)
+	}
+}
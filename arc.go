@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ARC header fields (RFC 8617), in the order they make up an ARC set.
+const (
+	arcAuthResults = "ARC-Authentication-Results"
+	arcMessageSig  = "ARC-Message-Signature"
+	arcSeal        = "ARC-Seal"
+)
+
+// arcMaxInstance is the highest instance number an ARC chain can reach.
+const arcMaxInstance = 50
+
+// arcSet holds the header fields with the same instance number.
+type arcSet struct {
+	authResults, messageSig, seal []byte
+}
+
+// arcChain returns the ARC sets found in the header fields, indexed by
+// instance number minus one. An error is returned when the chain is
+// malformed, such as with missing or duplicate fields.
+func arcChain(fields [][]byte) ([]arcSet, error) {
+	sets := map[int]*arcSet{}
+	highest := 0
+	for _, field := range fields {
+		var slot *[]byte
+		name := headerName(field)
+		value := fieldValue(field)
+		switch {
+		case strings.EqualFold(name, arcAuthResults):
+			// Only the instance tag of the results has tag syntax.
+			value, _, _ = strings.Cut(value, ";")
+		case strings.EqualFold(name, arcMessageSig), strings.EqualFold(name, arcSeal):
+		default:
+			continue
+		}
+		tags, err := parseTags(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s header: %s", name, err)
+		}
+		i, err := strconv.Atoi(tags["i"])
+		if err != nil || i < 1 || i > arcMaxInstance {
+			return nil, fmt.Errorf("invalid instance in %s header", name)
+		}
+		if sets[i] == nil {
+			sets[i] = &arcSet{}
+		}
+		switch {
+		case strings.EqualFold(name, arcAuthResults):
+			slot = &sets[i].authResults
+		case strings.EqualFold(name, arcMessageSig):
+			slot = &sets[i].messageSig
+		default:
+			slot = &sets[i].seal
+		}
+		if *slot != nil {
+			return nil, fmt.Errorf("duplicate %s header for instance %d", name, i)
+		}
+		*slot = field
+		highest = max(highest, i)
+	}
+
+	chain := make([]arcSet, highest)
+	for i := range chain {
+		set := sets[i+1]
+		if set == nil || set.authResults == nil || set.messageSig == nil || set.seal == nil {
+			return nil, fmt.Errorf("incomplete ARC set for instance %d", i+1)
+		}
+		chain[i] = *set
+	}
+	return chain, nil
+}
+
+// validateARC validates the ARC chain of a received message with the given
+// header fields and body hashes, returning the chain validation status: none
+// when there is no chain, pass or fail.
+func validateARC(ctx context.Context, fields [][]byte, chain []arcSet, bodyHashes map[string][]byte) (string, error) {
+	if len(chain) == 0 {
+		return "none", nil
+	}
+	for i, set := range chain {
+		tags, err := parseTags(fieldValue(set.seal))
+		if err != nil {
+			return "fail", fmt.Errorf("invalid seal %d: %s", i+1, err)
+		}
+		want := "pass"
+		if i == 0 {
+			want = "none"
+		}
+		if tags["cv"] != want {
+			return "fail", fmt.Errorf("seal %d has cv=%s", i+1, tags["cv"])
+		}
+	}
+
+	// Only the most recent message signature has to be valid, the message
+	// is expected to have been changed since the older ones were added.
+	last := chain[len(chain)-1]
+	tags, err := parseTags(fieldValue(last.messageSig))
+	if err != nil {
+		return "fail", fmt.Errorf("invalid message signature %d: %s", len(chain), err)
+	}
+	if result, err := verifySignature(ctx, fields, last.messageSig, tags, bodyHashes); result != "pass" {
+		return arcResult(result), fmt.Errorf("message signature %d: %s", len(chain), err)
+	}
+
+	for i := range chain {
+		tags, _ := parseTags(fieldValue(chain[i].seal))
+		if result, err := verifySeal(ctx, chain[:i+1], tags); result != "pass" {
+			return arcResult(result), fmt.Errorf("seal %d: %s", i+1, err)
+		}
+	}
+	return "pass", nil
+}
+
+// arcResult maps the result of a signature verification to a chain
+// validation status. Failures to look up a key don't break the chain for
+// good, but can't be told apart here.
+func arcResult(result string) string {
+	if result == "pass" {
+		return "pass"
+	}
+	return "fail"
+}
+
+// verifySeal verifies the seal of the last of the given ARC sets, with the
+// given tags, which signs all of them.
+func verifySeal(ctx context.Context, chain []arcSet, tags map[string]string) (string, error) {
+	for _, tag := range []string{"a", "b", "d", "s"} {
+		if tags[tag] == "" {
+			return "permerror", fmt.Errorf("missing %s= tag", tag)
+		}
+	}
+	key, err := lookupDKIMKey(ctx, tags["s"], tags["d"], tags["a"])
+	if err != nil {
+		return dkimError(err)
+	}
+	b, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return "permerror", errors.New("invalid signature encoding")
+	}
+	h := sealHash(chain[:len(chain)-1])
+	last := chain[len(chain)-1]
+	h.Write(relaxedHeader(last.authResults))
+	h.Write([]byte("\r\n"))
+	h.Write(relaxedHeader(last.messageSig))
+	h.Write([]byte("\r\n"))
+	name, value, _ := strings.Cut(string(last.seal), ":")
+	h.Write(relaxedHeader([]byte(name + ":" + signatureTag.ReplaceAllString(value, "$1"))))
+	if !verifyHash(key, h.Sum(nil), b) {
+		return "fail", errors.New("signature verification failed")
+	}
+	return "pass", nil
+}
+
+// sealHash returns a hash of the complete ARC sets in relaxed canonical
+// form, as signed by the seal of the next set.
+func sealHash(chain []arcSet) hash.Hash {
+	h := sha256.New()
+	for _, set := range chain {
+		for _, field := range [][]byte{set.authResults, set.messageSig, set.seal} {
+			h.Write(relaxedHeader(field))
+			h.Write([]byte("\r\n"))
+		}
+	}
+	return h
+}
+
+// failed reports whether the chain was already found to be invalid by the
+// sealer of its last set, in which case it must not be extended.
+func (set arcSet) failed() bool {
+	tags, err := parseTags(fieldValue(set.seal))
+	return err != nil || tags["cv"] == "fail"
+}
+
+// seal returns the header fields of a new ARC set for the message with the
+// given outgoing header section and body hash, recording the results of
+// authenticating it as servID. The chain validation status cv results from
+// validating the received chain, which the new set extends.
+func (s dkimSigner) seal(header []byte, chain []arcSet, cv, servID string, results []authResult, bodyHash []byte, now time.Time) ([]byte, error) {
+	fields := splitHeaderFields(header)
+	if len(fields) == 0 {
+		return nil, errors.New("message has no header")
+	}
+	instance := len(chain) + 1
+	if instance > arcMaxInstance {
+		return nil, errors.New("ARC chain is too long")
+	}
+	eol := lineEnding(fields)
+
+	aar := []byte(fmt.Sprintf("%s: i=%d; %s", arcAuthResults, instance, formatAuthResults(servID, results, eol)))
+	aar = append(aar, eol...)
+
+	h, names, err := hashSignedHeaders(fields)
+	if err != nil {
+		return nil, err
+	}
+	value := fmt.Sprintf("i=%d; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		instance, s.algorithm(), s.domain, s.selector, now.Unix(), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash))
+	ams, err := s.signField(arcMessageSig, value, h, eol)
+	if err != nil {
+		return nil, err
+	}
+
+	h = sealHash(chain)
+	h.Write(relaxedHeader(aar))
+	h.Write([]byte("\r\n"))
+	h.Write(relaxedHeader(ams))
+	h.Write([]byte("\r\n"))
+	value = fmt.Sprintf("i=%d; a=%s; t=%d; cv=%s; d=%s; s=%s; b=",
+		instance, s.algorithm(), now.Unix(), cv, s.domain, s.selector)
+	as, err := s.signField(arcSeal, value, h, eol)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(as, ams...), aar...), nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+)
+
+// Forwarding modes of --mode.
+const (
+	// modeResend forwards the message itself, with its envelope and a few
+	// headers rewritten.
+	modeResend = "resend"
+	// modeAttach forwards a new message from the forwarding address, with
+	// the original message attached unchanged.
+	modeAttach = "attach"
+)
+
+// attachMessage returns a reader yielding a new message from the forwarding
+// address from to recipients, with the original message read from original
+// attached as a message/rfc822 part. header is the header of the original
+// message. The informational text part is read from --attach-text-file, or
+// summarizes the original message when it isn't given.
+func attachMessage(ctx context.Context, header mail.Header, original io.Reader, from string, recipients []string) (io.Reader, error) {
+	msg := messageFrom(ctx)
+	text := []byte("Forwarded message\n\n")
+	for _, name := range []string{"From", "To", "Cc", "Subject", "Date"} {
+		if v := strings.TrimSpace(header.Get(name)); v != "" {
+			text = append(text, name+": "+decodeHeader(v)+"\n"...)
+		}
+	}
+	if *attachTextFile != "" {
+		var err error
+		if text, err = os.ReadFile(*attachTextFile); err != nil {
+			return nil, err
+		}
+	}
+	eol := guessLineEnding(msg.header[:bytes.IndexByte(msg.header, '\n')+1])
+	text = bytes.ReplaceAll(bytes.ReplaceAll(text, []byte("\r\n"), []byte("\n")), []byte("\n"), eol)
+	if !bytes.HasSuffix(text, eol) {
+		text = append(text, eol...)
+	}
+	// The queue ID is unique, so it can't appear in the original message.
+	boundary := "postforward-" + msg.queueID
+
+	var b bytes.Buffer
+	line := func(format string, a ...interface{}) {
+		fmt.Fprintf(&b, format, a...)
+		b.Write(eol)
+	}
+	line("From: %s", from)
+	line("To: %s", strings.Join(recipients, ", "))
+	line("Subject: %s%s", *attachSubjectPrefix, strings.TrimSpace(header.Get("Subject")))
+	line("Date: %s", clk.Now().Format(time.RFC1123Z))
+	line("Message-ID: <%s.forward@%s>", msg.queueID, getHostname(ctx))
+	if id := strings.TrimSpace(header.Get("Message-ID")); id != "" {
+		line("References: %s", id)
+	}
+	line("MIME-Version: 1.0")
+	line("Content-Type: %s", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": boundary}))
+	line("Content-Transfer-Encoding: 8bit")
+	line("")
+	line("--%s", boundary)
+	line("Content-Type: text/plain; charset=utf-8")
+	line("Content-Transfer-Encoding: 8bit")
+	line("")
+	b.Write(text)
+	line("--%s", boundary)
+	line("Content-Type: message/rfc822")
+	line("Content-Disposition: inline")
+	line("Content-Transfer-Encoding: 8bit")
+	line("")
+
+	closing := &bytes.Buffer{}
+	closing.Write(eol)
+	fmt.Fprintf(closing, "--%s--", boundary)
+	closing.Write(eol)
+	return io.MultiReader(&b, original, closing), nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// dnsResolver performs the DNS lookups needed to authenticate messages.
+type dnsResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// resolver is used for all DNS lookups.
+var resolver dnsResolver = net.DefaultResolver
+
+// lookupTXT returns the TXT records at name. A non-existent name is not an
+// error and yields no records, so errors are always temporary.
+func lookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, err := resolver.LookupTXT(ctx, name)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return records, err
+}
+
+// isNotFound reports whether err is a DNS error for a name or record which
+// doesn't exist.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// authResult is the outcome of a single authentication method, as reported
+// in an Authentication-Results header (RFC 8601).
+type authResult struct {
+	method string
+	result string
+	// reason is an optional comment explaining the result.
+	reason string
+	// props lists the properties identifying what was authenticated, e.g.
+	// smtp.mailfrom=example.com.
+	props []string
+	// domain is the authenticated domain, used for DMARC alignment.
+	domain string
+}
+
+func (r authResult) String() string {
+	s := r.method + "=" + r.result
+	if r.reason != "" {
+		s += " (" + r.reason + ")"
+	}
+	for _, p := range r.props {
+		s += " " + p
+	}
+	return s
+}
+
+// authResultsHeader is the header field the results of authenticating the
+// received message are added in.
+const authResultsHeader = "Authentication-Results"
+
+// formatAuthResults returns the value of an Authentication-Results header
+// listing the given results, one per line.
+func formatAuthResults(servID string, results []authResult, lineEnding []byte) string {
+	if len(results) == 0 {
+		return servID + "; none"
+	}
+	parts := []string{servID}
+	for _, r := range results {
+		parts = append(parts, r.String())
+	}
+	return strings.Join(parts, ";"+string(lineEnding)+"\t")
+}
+
+// authenticate evaluates SPF, DKIM, DMARC and ARC for the received message
+// with the given header section, as verified at time now. clientIP is the
+// address of the client which handed the message to the first trusted host,
+// sender the envelope sender. bodyHashes holds the hash of the body for each
+// canonicalization algorithm.
+func authenticate(ctx context.Context, rawHeader []byte, header mail.Header, bodyHashes map[string][]byte, clientIP net.IP, sender string, now time.Time) []authResult {
+	fields := splitHeaderFields(rawHeader)
+	spf := checkSPF(ctx, clientIP, "", sender)
+	dkim := verifyDKIM(ctx, fields, bodyHashes, now)
+	dmarc := checkDMARC(ctx, header, spf, dkim)
+	arc := authResult{method: "arc"}
+	chain, err := arcChain(fields)
+	if err == nil {
+		arc.result, err = validateARC(ctx, fields, chain, bodyHashes)
+	} else {
+		arc.result = "fail"
+	}
+	if err != nil {
+		arc.reason = err.Error()
+	}
+	return append(append([]authResult{spf}, dkim...), dmarc, arc)
+}
+
+// resultOf returns the result of the first of the results for method.
+func resultOf(results []authResult, method string) string {
+	for _, r := range results {
+		if r.method == method {
+			return r.result
+		}
+	}
+	return "none"
+}
+
+// authResultsField returns the Authentication-Results header field for the
+// given results, using the given line ending.
+func authResultsField(servID string, results []authResult, lineEnding []byte) []byte {
+	field := authResultsHeader + ": " + formatAuthResults(servID, results, lineEnding)
+	return append([]byte(field), lineEnding...)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BATV parameters. Tags expire after batvMaxAge days, like those of Exim's
+// prvs expansion.
+const (
+	batvMaxAge = 7
+	// Days are counted modulo batvDays, so they fit in three digits.
+	batvDays = 1000
+	// batvKey is the key number of the tags postforward signs.
+	batvKey = '0'
+)
+
+// Reasons for rejecting prvs tags.
+var (
+	errBATVInvalid = errors.New("not a prvs address")
+	errBATVHash    = errors.New("invalid hash")
+	errBATVExpired = errors.New("expired")
+)
+
+// batvSigner signs and verifies envelope senders using the prvs scheme of
+// Bounce Address Tag Validation (draft-levine-smtp-batv): the local part of
+// prvs=KDDDSSSSSS=user@example.org holds the key number K, the day DDD the
+// tag expires, and SSSSSS, the start of an HMAC-SHA1 of them together with
+// the original address.
+type batvSigner struct {
+	secret []byte
+}
+
+// sign returns addr tagged at time now.
+func (b batvSigner) sign(addr string, now time.Time) string {
+	local, domain := splitAddress(addr)
+	day := fmt.Sprintf("%c%03d", batvKey, (batvDay(now)+batvMaxAge)%batvDays)
+	return "prvs=" + day + b.hash(day, addr) + "=" + local + "@" + domain
+}
+
+// verify returns the original address the prvs address addr stands for,
+// checking its hash and that its tag didn't expire at time now.
+func (b batvSigner) verify(addr string, now time.Time) (string, error) {
+	orig, tag, ok := splitPRVS(addr)
+	if !ok {
+		return "", errBATVInvalid
+	}
+	day, hash := tag[:4], tag[4:]
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(hash)), []byte(b.hash(day, orig))) != 1 {
+		return "", errBATVHash
+	}
+	expires, _ := strconv.Atoi(day[1:])
+	if (expires-batvDay(now)%batvDays+batvDays)%batvDays > batvMaxAge {
+		return "", errBATVExpired
+	}
+	return orig, nil
+}
+
+// hash returns the hash of a tag for the key number and expiry day, and
+// orig. The address is lowercased, as some mail systems lowercase bounce
+// addresses.
+func (b batvSigner) hash(day, orig string) string {
+	mac := hmac.New(sha1.New, b.secret)
+	mac.Write([]byte(day + strings.ToLower(orig)))
+	return hex.EncodeToString(mac.Sum(nil)[:3])
+}
+
+// batvDay returns the number of days since the Unix epoch at time now.
+func batvDay(now time.Time) int {
+	return int(now.Unix() / int64(24*time.Hour/time.Second))
+}
+
+// splitPRVS splits the prvs address addr into the original address and the
+// tag, reporting whether addr is one.
+func splitPRVS(addr string) (string, string, bool) {
+	local, domain := splitAddress(addr)
+	if len(local) < len("prvs=KDDDSSSSSS=") || !strings.EqualFold(local[:5], "prvs=") || local[15] != '=' {
+		return "", "", false
+	}
+	tag := local[5:15]
+	for _, c := range tag[:4] {
+		if c < '0' || c > '9' {
+			return "", "", false
+		}
+	}
+	if _, err := hex.DecodeString(tag[4:]); err != nil {
+		return "", "", false
+	}
+	return local[16:] + "@" + domain, tag, true
+}
+
+// batvDomain reports whether the envelope sender addr is in one of the
+// --batv-domains, whose senders are tagged.
+func batvDomain(addr string) bool {
+	_, domain := splitAddress(addr)
+	for _, d := range splitAddressList(*batvDomains) {
+		if strings.EqualFold(domain, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadBATVSigner returns the signer using the secret of --batv-secret-file.
+func loadBATVSigner() (batvSigner, error) {
+	secret, err := readSRSSecret(*batvSecretFile)
+	if err != nil {
+		return batvSigner{}, temporaryError("Unable to read BATV secret: %w", err)
+	}
+	return batvSigner{secret: secret}, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBATV checks that signed addresses verify until they expire, and that
+// tampered and untagged addresses are rejected.
+func TestBATV(t *testing.T) {
+	b := batvSigner{secret: []byte("test secret")}
+	now := time.Date(2026, time.March, 1, 12, 0, 0, 0, time.UTC)
+	signed := b.sign("user@example.org", now)
+	tag := signed[len("prvs=") : len("prvs=")+10]
+	tests := []struct {
+		name string
+		addr string
+		days int
+		err  error
+	}{
+		{"fresh", signed, 0, nil},
+		{"uppercase", strings.ToUpper(signed[:len("prvs=")+10]) + signed[len("prvs=")+10:], 0, nil},
+		{"oldest", signed, batvMaxAge, nil},
+		{"expired", signed, batvMaxAge + 1, errBATVExpired},
+		{"other address", strings.Replace(signed, "=user@", "=other@", 1), 0, errBATVHash},
+		{"other day", strings.Replace(signed, tag[:4], "0000", 1), 0, errBATVHash},
+		{"untagged", "user@example.org", 0, errBATVInvalid},
+		{"short tag", "prvs=0123abc=user@example.org", 0, errBATVInvalid},
+		{"non-hex hash", "prvs=0123zzzzzz=user@example.org", 0, errBATVInvalid},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			orig, err := b.verify(test.addr, now.Add(time.Duration(test.days)*24*time.Hour))
+			if err != test.err {
+				t.Fatalf("verify(%q) returned %v, expected %v", test.addr, err, test.err)
+			}
+			if err == nil && orig != "user@example.org" {
+				t.Errorf("verify(%q) yields %q", test.addr, orig)
+			}
+		})
+	}
+}
+
+// TestBATVDayWrap checks that addresses signed shortly before the day
+// counter wraps around verify after it did.
+func TestBATVDayWrap(t *testing.T) {
+	b := batvSigner{secret: []byte("test secret")}
+	day := 24 * time.Hour
+	wrap := time.Unix(0, 0).Add(batvDays * day)
+	for now := wrap.Add(-2 * batvMaxAge * day); now.Before(wrap.Add(2 * batvMaxAge * day)); now = now.Add(day) {
+		signed := b.sign("user@example.org", now)
+		if _, err := b.verify(signed, now.Add(batvMaxAge*day)); err != nil {
+			t.Errorf("verify(%q) signed at %s: %s", signed, now.Format(time.DateOnly), err)
+		}
+	}
+}
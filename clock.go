@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// clock tells the time used for timestamps, SRS addresses and state kept
+// across invocations.
+type clock interface {
+	Now() time.Time
+}
+
+// idGenerator assigns queue IDs to messages arriving at time t.
+type idGenerator interface {
+	NewID(t time.Time) string
+}
+
+// systemClock tells the actual time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// ulidGenerator generates unique, time ordered queue IDs.
+type ulidGenerator struct{}
+
+func (ulidGenerator) NewID(t time.Time) string {
+	return newQueueID(t)
+}
+
+// fixedClock always tells the same time.
+type fixedClock struct {
+	t time.Time
+}
+
+func (c fixedClock) Now() time.Time {
+	return c.t
+}
+
+// sequentialIDs generates queue IDs by counting, starting at zero.
+type sequentialIDs struct {
+	n atomic.Int64
+}
+
+func (s *sequentialIDs) NewID(time.Time) string {
+	return fmt.Sprintf("%026d", s.n.Add(1)-1)
+}
+
+// clk and ids are used throughout instead of time.Now and newQueueID, so
+// they can be replaced in --deterministic mode.
+var (
+	clk clock       = systemClock{}
+	ids idGenerator = ulidGenerator{}
+)
+
+// Values used in --deterministic mode, which makes the output for a given
+// message and configuration reproducible.
+const deterministicHostname = "postforward.test"
+
+var deterministicTime = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sources a setting's effective value may come from.
+const (
+	sourceDefault = "default"
+	sourceFlag    = "command line"
+	sourceFile    = "config file"
+	sourceEnv     = "environment"
+)
+
+// envPrefix is the prefix of the environment variables settings may be given
+// in, such as POSTFORWARD_SRS_DOMAIN for --srs-domain.
+const envPrefix = "POSTFORWARD_"
+
+// envSettings records the settings which were taken from the environment.
+var envSettings = map[string]bool{}
+
+// envName returns the environment variable holding the setting with the
+// given name.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadEnvironment applies the settings given in the environment, unless they
+// were given on the command line. As they're marked as set, they take
+// precedence over the --config file. Repeatable settings take one value per
+// line.
+func loadEnvironment() error {
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value := os.Getenv(envName(f.Name))
+		if value == "" || given[f.Name] || err != nil {
+			return
+		}
+		values := []string{value}
+		if _, ok := f.Value.(*listFlag); ok {
+			values = splitLines([]byte(value))
+		}
+		for _, v := range values {
+			if e := flag.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("invalid value for %s: %s", envName(f.Name), e)
+				return
+			}
+		}
+		envSettings[f.Name] = true
+	})
+	return err
+}
+
+// isSecret reports whether the setting with the given name holds a secret
+// value which must not be displayed. Settings naming a file which holds a
+// secret are not secret themselves.
+func isSecret(name string) bool {
+	if strings.HasSuffix(name, "-file") {
+		return false
+	}
+	return strings.Contains(name, "secret") || strings.Contains(name, "password")
+}
+
+// redactURLs returns value, a URL or a comma-separated list of them, with
+// the passwords of URLs such as redis://:password@host masked. Values which
+// aren't URLs are returned unchanged.
+func redactURLs(value string) string {
+	items := strings.Split(value, ",")
+	for i, item := range items {
+		spec := strings.TrimSpace(item)
+		if !strings.Contains(spec, "://") {
+			continue
+		}
+		start := strings.Index(spec, "://") + len("://")
+		u, err := parseServerURL(spec)
+		switch {
+		case err == nil:
+			spec = u.Redacted()
+		case strings.LastIndex(spec, "@") >= start:
+			// Mask the whole user info of URLs which can't be parsed.
+			spec = spec[:start] + "********" + spec[strings.LastIndex(spec, "@"):]
+		}
+		items[i] = item[:len(item)-len(strings.TrimLeft(item, " "))] + spec
+	}
+	return strings.Join(items, ",")
+}
+
+// dumpConfig writes the effective value of every setting to w, annotated with
+// the source of the value, followed by the forwarding rules. Secret values
+// and the passwords of URLs are masked.
+func dumpConfig(w io.Writer) {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	flag.VisitAll(func(f *flag.Flag) {
+		source := sourceDefault
+		switch {
+		case envSettings[f.Name]:
+			source = sourceEnv
+		case fileSettings[f.Name]:
+			source = sourceFile
+		case set[f.Name]:
+			source = sourceFlag
+		}
+		value := f.Value.String()
+		if isSecret(f.Name) && value != "" {
+			value = "********"
+		}
+		value = redactURLs(value)
+		fmt.Fprintf(w, "%s = %q # %s\n", f.Name, value, source)
+	})
+	for _, r := range rules {
+		fmt.Fprintf(w, "\n[%s.%q]\n", r.kind, r.match)
+		if r.noSRS {
+			fmt.Fprintf(w, "srs = false\n")
+		}
+		if r.sender != "" {
+			fmt.Fprintf(w, "sender = %q\n", r.sender)
+		}
+		if len(r.bcc) > 0 {
+			fmt.Fprintf(w, "bcc = %s\n", quoteList(r.bcc))
+		}
+		if len(r.headers) > 0 {
+			fmt.Fprintf(w, "add-header = %s\n", quoteList(r.headers))
+		}
+		if r.splitTo != "" {
+			fmt.Fprintf(w, "split-to = %q\nsplit-percent = %d\n", r.splitTo, r.splitPercent)
+		}
+		if !r.expires.IsZero() {
+			fmt.Fprintf(w, "expires = %s\n", r.expires.Format(time.RFC3339))
+		}
+		if r.expiredMessage != "" {
+			fmt.Fprintf(w, "expired-message = %q\n", r.expiredMessage)
+		}
+	}
+}
+
+// quoteList formats values as an array of strings.
+func quoteList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = strconv.Quote(v)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// listFlag is a flag which may be given multiple times, collecting all
+// values.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// newListFlag defines a listFlag with the given name and usage.
+func newListFlag(name, usage string) *listFlag {
+	l := &listFlag{}
+	flag.Var(l, name, usage)
+	return l
+}
+
+// Kinds of forwarding rules, named after the table headers selecting them.
+const (
+	ruleRecipient = "recipient"
+	ruleDomain    = "domain"
+)
+
+// forwardRule changes how mail is forwarded to the recipients it matches,
+// either a single address or all addresses in a domain.
+type forwardRule struct {
+	kind, match string
+	// noSRS disables rewriting the envelope sender.
+	noSRS bool
+	// sender replaces the envelope sender, without SRS rewriting.
+	sender string
+	// bcc lists additional envelope recipients.
+	bcc []string
+	// headers lists header fields to add.
+	headers []string
+	// splitPercent is the share of messages forwarded to splitTo instead.
+	splitPercent int
+	splitTo      string
+	// expires is when forwarding to the recipient stops, after which
+	// messages are bounced with expiredMessage unless other recipients
+	// remain.
+	expires        time.Time
+	expiredMessage string
+}
+
+// defaultExpiredMessage is the diagnostic of messages bounced by an expired
+// rule without an expired-message.
+const defaultExpiredMessage = "This address no longer forwards mail"
+
+// expiryLayouts are the accepted formats of rule expiry times. Dates are in
+// local time.
+var expiryLayouts = []string{"2006-01-02", "2006-01-02T15:04", "2006-01-02T15:04:05", time.RFC3339}
+
+// rules holds the forwarding rules of the --config file.
+var rules []*forwardRule
+
+// fileSettings records the settings which were taken from the --config file.
+var fileSettings = map[string]bool{}
+
+// ruleFor returns the rule applying to the recipient addr, or nil when there
+// is none. Rules for an address take precedence over rules for its domain.
+func ruleFor(addr string) *forwardRule {
+	_, domain := splitAddress(addr)
+	var match *forwardRule
+	for _, r := range rules {
+		switch {
+		case r.kind == ruleRecipient && strings.EqualFold(r.match, addr):
+			return r
+		case r.kind == ruleDomain && strings.EqualFold(r.match, domain) && match == nil:
+			match = r
+		}
+	}
+	return match
+}
+
+// parseExpiry parses the expiry time of a rule, in one of expiryLayouts.
+func parseExpiry(s string) (time.Time, error) {
+	var err error
+	for _, layout := range expiryLayouts {
+		var t time.Time
+		if t, err = time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// activeRecipients returns the recipients whose rule hasn't expired at time
+// now. When there are none, the rule of the last expired recipient is
+// returned as well.
+func activeRecipients(ctx context.Context, recipients []string, now time.Time) (active []string, expired *forwardRule) {
+	for _, r := range recipients {
+		rule := ruleFor(r)
+		if rule != nil && !rule.expires.IsZero() && !now.Before(rule.expires) {
+			infof(ctx, "not forwarding to %s, its rule expired on %s", r, rule.expires.Format(time.RFC3339))
+			expired = rule
+			continue
+		}
+		active = append(active, r)
+	}
+	if len(active) > 0 {
+		expired = nil
+	}
+	return active, expired
+}
+
+// splitRecipients replaces the recipients whose rule splits traffic with the
+// alternate destination of the rule, for the given share of messages. Which
+// messages are split is decided by a hash of key, so retries and copies of a
+// message are forwarded to the same destination.
+func splitRecipients(ctx context.Context, recipients []string, key string) []string {
+	sum := sha256.Sum256([]byte(key))
+	bucket := int(binary.BigEndian.Uint64(sum[:8]) % 100)
+	split := make([]string, len(recipients))
+	for i, r := range recipients {
+		split[i] = r
+		if rule := ruleFor(r); rule != nil && rule.splitTo != "" && bucket < rule.splitPercent {
+			infof(ctx, "forwarding to %s instead of %s (split-percent %d)", rule.splitTo, r, rule.splitPercent)
+			split[i] = rule.splitTo
+		}
+	}
+	return split
+}
+
+// submission is a single submission of the forwarded message, to the
+// recipients matching the same rule.
+type submission struct {
+	rule       *forwardRule
+	returnPath string
+	recipients []string
+}
+
+// groupRecipients splits recipients into submissions by the rule they match,
+// in the order the rules are first matched. The Bcc recipients of a rule are
+// added to its submission.
+func groupRecipients(recipients []string) []*submission {
+	var submissions []*submission
+	byRule := map[*forwardRule]*submission{}
+	for _, r := range recipients {
+		rule := ruleFor(r)
+		sub := byRule[rule]
+		if sub == nil {
+			sub = &submission{rule: rule}
+			byRule[rule] = sub
+			submissions = append(submissions, sub)
+		}
+		sub.recipients = append(sub.recipients, r)
+	}
+	for _, sub := range submissions {
+		if sub.rule != nil {
+			sub.recipients = append(sub.recipients, sub.rule.bcc...)
+		}
+	}
+	return submissions
+}
+
+// addArchive adds the archive address to submissions, so it receives one copy
+// of every message. It's added to the submission of the recipients without a
+// rule, or to a new one, and like Bcc recipients only to the envelope.
+func addArchive(submissions []*submission, archive string) []*submission {
+	for _, sub := range submissions {
+		for _, r := range sub.recipients {
+			if strings.EqualFold(r, archive) {
+				return submissions
+			}
+		}
+	}
+	for _, sub := range submissions {
+		if sub.rule == nil {
+			sub.recipients = append(sub.recipients, archive)
+			return submissions
+		}
+	}
+	return append(submissions, &submission{recipients: []string{archive}})
+}
+
+// loadConfig reads the configuration file at path. Settings named after
+// command line flags take effect unless the flag was given on the command
+// line. Tables such as [recipient."user@example.com"] and
+// [domain."example.com"] define forwarding rules.
+//
+// The file uses a subset of TOML: key = value pairs, with values being
+// strings, booleans, integers or arrays of strings, and # comments.
+func loadConfig(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	var rule *forwardRule
+	seen := map[string]bool{}
+	linenum := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		linenum++
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if rule, err = parseRuleHeader(line); err != nil {
+				return fmt.Errorf("%s:%d: %s", path, linenum, err)
+			}
+			key := rule.kind + " " + strings.ToLower(rule.match)
+			if seen[key] {
+				return fmt.Errorf("%s:%d: duplicate rule for %s %s", path, linenum, rule.kind, rule.match)
+			}
+			seen[key] = true
+			rules = append(rules, rule)
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected format: key = value", path, linenum)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		// Arrays may span multiple lines.
+		start := linenum
+		for strings.HasPrefix(value, "[") && !strings.HasSuffix(value, "]") && scanner.Scan() {
+			linenum++
+			value += " " + strings.TrimSpace(stripComment(scanner.Text()))
+		}
+		values, isArray, err := parseConfigValue(value)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid value for %s: %s", path, start, key, err)
+		}
+		if rule != nil {
+			err = rule.set(key, values, isArray)
+		} else {
+			err = applySetting(key, values, given)
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, start, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if (r.splitTo == "") != (r.splitPercent == 0) {
+			return fmt.Errorf("%s: rule for %s %s needs both split-to and split-percent", path, r.kind, r.match)
+		}
+	}
+	return nil
+}
+
+// stripComment removes a # comment from line, unless it's part of a string.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == '"' && c == '\\':
+			// The escaped character can't end the string.
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseRuleHeader parses a table header selecting the recipients a rule
+// applies to, e.g. [domain."example.com"].
+func parseRuleHeader(line string) (*forwardRule, error) {
+	if !strings.HasSuffix(line, "]") {
+		return nil, errors.New("unterminated table header")
+	}
+	kind, match, ok := strings.Cut(strings.TrimSpace(line[1:len(line)-1]), ".")
+	if !ok {
+		return nil, fmt.Errorf("invalid table %s, expected [recipient.\"address\"] or [domain.\"domain\"]", line)
+	}
+	kind = strings.TrimSpace(kind)
+	match, err := parseString(strings.TrimSpace(match))
+	if err != nil {
+		return nil, fmt.Errorf("invalid table %s: %s", line, err)
+	}
+	switch kind {
+	case ruleRecipient:
+		match, err = addressToASCII(match)
+	case ruleDomain:
+		match, err = domainToASCII(match)
+	default:
+		return nil, fmt.Errorf("unknown table %q, expected recipient or domain", kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %s", kind, match, err)
+	}
+	return &forwardRule{kind: kind, match: match}, nil
+}
+
+// parseConfigValue parses a value in a configuration file, returning its
+// elements if it's an array, or the value as a single element otherwise.
+// Booleans and integers are returned as written.
+func parseConfigValue(value string) (values []string, isArray bool, err error) {
+	if !strings.HasPrefix(value, "[") {
+		v, err := parseScalar(value)
+		return []string{v}, false, err
+	}
+	if !strings.HasSuffix(value, "]") {
+		return nil, true, errors.New("unterminated array")
+	}
+	rest := strings.TrimSpace(value[1 : len(value)-1])
+	for rest != "" {
+		n := stringLength(rest)
+		if n < 0 {
+			return nil, true, errors.New("arrays may only contain strings")
+		}
+		v, err := parseString(rest[:n])
+		if err != nil {
+			return nil, true, err
+		}
+		values = append(values, v)
+		rest = strings.TrimSpace(rest[n:])
+		if rest != "" {
+			if rest[0] != ',' {
+				return nil, true, errors.New("expected , between array elements")
+			}
+			rest = strings.TrimSpace(rest[1:])
+		}
+	}
+	return values, true, nil
+}
+
+// parseScalar parses a string, boolean or integer value.
+func parseScalar(value string) (string, error) {
+	if value == "" {
+		return "", errors.New("missing value")
+	}
+	if value[0] == '"' || value[0] == '\'' {
+		if n := stringLength(value); n != len(value) {
+			return "", errors.New("unexpected data after string")
+		}
+		return parseString(value)
+	}
+	if value == "true" || value == "false" {
+		return value, nil
+	}
+	if _, err := parseExpiry(value); err == nil {
+		return value, nil
+	}
+	if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return value, nil
+	}
+	return "", fmt.Errorf("%s is not a string, boolean, integer or date, strings must be quoted", value)
+}
+
+// stringLength returns the length of the quoted string s starts with, or -1
+// when s doesn't start with a complete string.
+func stringLength(s string) int {
+	if s == "" || (s[0] != '"' && s[0] != '\'') {
+		return -1
+	}
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && s[0] == '"':
+			i++
+		case s[i] == s[0]:
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// parseString parses a basic string, which supports backslash escapes, or a
+// literal 'string', which doesn't.
+func parseString(s string) (string, error) {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return s[1 : len(s)-1], nil
+	}
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return strconv.Unquote(s)
+	}
+	return "", errors.New("expected a quoted string")
+}
+
+// applySetting sets the flag named key to the given values, unless it was
+// given on the command line. Arrays set list flags once per element, other
+// flags take a comma-separated list.
+func applySetting(key string, values []string, given map[string]bool) error {
+	f := flag.Lookup(key)
+	if f == nil || key == "config" {
+		return fmt.Errorf("unknown setting %s", key)
+	}
+	if given[key] {
+		return nil
+	}
+	if _, ok := f.Value.(*listFlag); ok {
+		for _, v := range values {
+			if err := f.Value.Set(v); err != nil {
+				return fmt.Errorf("invalid value for %s: %s", key, err)
+			}
+		}
+	} else if err := f.Value.Set(strings.Join(values, ",")); err != nil {
+		return fmt.Errorf("invalid value for %s: %s", key, err)
+	}
+	fileSettings[key] = true
+	return nil
+}
+
+// set sets the rule setting named key to the given values.
+func (r *forwardRule) set(key string, values []string, isArray bool) error {
+	switch key {
+	case "srs":
+		if isArray || (values[0] != "true" && values[0] != "false") {
+			return errors.New("srs must be true or false")
+		}
+		r.noSRS = values[0] == "false"
+	case "sender":
+		if isArray {
+			return errors.New("sender must be a single address")
+		}
+		sender, err := addressToASCII(values[0])
+		if err != nil {
+			return fmt.Errorf("invalid sender %q: %s", values[0], err)
+		}
+		r.sender = sender
+	case "bcc":
+		for _, v := range values {
+			for _, addr := range splitAddressList(v) {
+				ascii, err := addressToASCII(addr)
+				if err != nil {
+					return fmt.Errorf("invalid bcc address %q: %s", addr, err)
+				}
+				r.bcc = append(r.bcc, ascii)
+			}
+		}
+	case "add-header":
+		for _, v := range values {
+			if headerName([]byte(v)) == "" {
+				return fmt.Errorf("invalid header %q, expected Name: value", v)
+			}
+			r.headers = append(r.headers, v)
+		}
+	case "split-to":
+		if isArray {
+			return errors.New("split-to must be a single address")
+		}
+		addr, err := addressToASCII(values[0])
+		if err != nil {
+			return fmt.Errorf("invalid split-to address %q: %s", values[0], err)
+		}
+		r.splitTo = addr
+	case "split-percent":
+		if isArray || len(values) != 1 {
+			return errors.New("split-percent must be an integer from 1 to 100")
+		}
+		n, err := strconv.Atoi(values[0])
+		if err != nil || n < 1 || n > 100 {
+			return errors.New("split-percent must be an integer from 1 to 100")
+		}
+		r.splitPercent = n
+	case "expires":
+		if isArray || len(values) != 1 {
+			return errors.New("expires must be a date, e.g. 2024-12-31, or a time, e.g. 2024-12-31T18:00")
+		}
+		t, err := parseExpiry(values[0])
+		if err != nil {
+			return errors.New("expires must be a date, e.g. 2024-12-31, or a time, e.g. 2024-12-31T18:00")
+		}
+		r.expires = t
+	case "expired-message":
+		if isArray || strings.TrimSpace(values[0]) == "" {
+			return errors.New("expired-message must be a non-empty string")
+		}
+		r.expiredMessage = strings.Join(strings.Fields(values[0]), " ")
+	default:
+		return fmt.Errorf("unknown rule setting %s", key)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// corpusSkipFlags lists the flags which are not passed on to corpus runs, in
+// order to keep them free of side effects.
+var corpusSkipFlags = map[string]bool{
+	"alert-webhook": true,
+	"deterministic": true,
+	"dry-run":       true,
+	"notify-admin":  true,
+	"srs-addr":      true,
+	"srs-proto":     true,
+	"srs-socket":    true,
+	"state-dir":     true,
+}
+
+// testCorpus implements the "test" subcommand. Every .eml file in the corpus
+// directory is forwarded in dry-run and deterministic mode, using the flags
+// given in front of the subcommand and the recipients given after it, plus
+// any arguments listed one per line in a matching .args file. SRS lookups
+// are answered by a mock server. The output is compared against the matching
+// .out file, or written to it with -update. It returns the exit status of
+// the subcommand.
+func testCorpus(args []string) int {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	dir := set.String("corpus", "", "directory containing the .eml and .out files")
+	update := set.Bool("update", false, "write the .out files instead of comparing against them")
+	if err := set.Parse(args); err != nil {
+		return 2
+	}
+	if *dir == "" {
+		fmt.Fprintln(os.Stderr, "test: --corpus is required")
+		return 2
+	}
+
+	messages, err := filepath.Glob(filepath.Join(*dir, "*.eml"))
+	if err != nil || len(messages) == 0 {
+		fmt.Fprintf(os.Stderr, "test: no .eml files found in %s\n", *dir)
+		return 2
+	}
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "test: %s\n", err)
+		return 2
+	}
+	srs, err := mockSRS()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "test: unable to start mock SRS server: %s\n", err)
+		return 2
+	}
+	defer srs.Close()
+
+	var common []string
+	flag.Visit(func(f *flag.Flag) {
+		if !corpusSkipFlags[f.Name] {
+			common = append(common, "--"+f.Name+"="+f.Value.String())
+		}
+	})
+	common = append(common, "--deterministic", "--dry-run", "--srs-addr="+srs.Addr().String())
+
+	passed, failed := 0, 0
+	for _, message := range messages {
+		name := strings.TrimSuffix(message, ".eml")
+		output, err := runCorpusMessage(self, message, common, set.Args())
+		if err != nil {
+			fmt.Printf("ERROR %s: %s\n", filepath.Base(message), err)
+			failed++
+			continue
+		}
+		if *update {
+			if err := os.WriteFile(name+".out", output, 0644); err != nil {
+				fmt.Printf("ERROR %s: %s\n", filepath.Base(message), err)
+				failed++
+				continue
+			}
+			fmt.Printf("WROTE %s\n", filepath.Base(name+".out"))
+			passed++
+			continue
+		}
+		expected, err := os.ReadFile(name + ".out")
+		if err != nil {
+			fmt.Printf("ERROR %s: %s\n", filepath.Base(message), err)
+			failed++
+			continue
+		}
+		if bytes.Equal(expected, output) {
+			fmt.Printf("PASS %s\n", filepath.Base(message))
+			passed++
+			continue
+		}
+		fmt.Printf("FAIL %s\n", filepath.Base(message))
+		for _, line := range diffLines(splitLines(expected), splitLines(output)) {
+			fmt.Printf("    %s\n", line)
+		}
+		failed++
+	}
+
+	fmt.Printf("%d passed, %d failed\n", passed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runCorpusMessage forwards a single corpus message and returns its output:
+// what was written to stdout, followed by stderr and the exit status when it
+// is not zero.
+func runCorpusMessage(self, message string, common, recipients []string) ([]byte, error) {
+	in, err := os.Open(message)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	args := append([]string{}, common...)
+	extra, err := os.ReadFile(strings.TrimSuffix(message, ".eml") + ".args")
+	if err == nil {
+		for _, arg := range splitLines(extra) {
+			if arg != "" {
+				args = append(args, arg)
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	args = append(args, recipients...)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(self, args...)
+	cmd.Stdin = in
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return nil, err
+	}
+
+	stdout.Write(stderr.Bytes())
+	if exitErr != nil {
+		fmt.Fprintf(&stdout, "Exit status %d\n", exitErr.ExitCode())
+	}
+	return stdout.Bytes(), nil
+}
+
+// mockSRS starts a TCP table server on a random local port which answers
+// lookups for user@domain with SRS0=test=00=domain=user@postforward.test.
+func mockSRS() (net.Listener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveMockSRS(conn)
+		}
+	}()
+	return l, nil
+}
+
+func serveMockSRS(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		key, ok := strings.CutPrefix(line, "get ")
+		user, domain := splitAddress(key)
+		if !ok || user == "" || domain == "" {
+			c.PrintfLine("500 not found")
+			continue
+		}
+		c.PrintfLine("200 SRS0=test=00=%s=%s@%s", domain, user, deterministicHostname)
+	}
+}
+
+// splitLines splits data into lines, without line endings.
+func splitLines(data []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+// diffLines returns the lines which differ between a and b, prefixed with
+// "-" when only present in a and "+" when only present in b.
+func diffLines(a, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "-"+a[i])
+			i++
+		default:
+			diff = append(diff, "+"+b[j])
+			j++
+		}
+	}
+	return diff
+}
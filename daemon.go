@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lmtpIdleTimeout bounds the time an LMTP client may stay idle between
+// commands, and between reads of message data.
+const lmtpIdleTimeout = 5 * time.Minute
+
+// lmtpDefaultSizeLimit bounds the size of messages accepted via LMTP, as they
+// are buffered in memory, when --max-size isn't given.
+const lmtpDefaultSizeLimit = 64 << 20
+
+// idleReader reads from r, which reads from conn, failing when conn stays idle
+// for longer than lmtpIdleTimeout.
+type idleReader struct {
+	conn net.Conn
+	r    io.Reader
+}
+
+func (i idleReader) Read(p []byte) (int, error) {
+	i.conn.SetReadDeadline(time.Now().Add(lmtpIdleTimeout))
+	return i.r.Read(p)
+}
+
+// serveDaemon accepts LMTP connections on the socket given in Postfix
+// notation (unix:/path or inet:host:port) until ctx is done. Every accepted
+// recipient is taken as the original recipient of the message, which is
+// forwarded to the given recipients and those resolved from the configured
+// maps. Connections are served concurrently, within the limits of the
+// priority lanes.
+func serveDaemon(ctx context.Context, spec string, recipients []string, lanes *laneSet) error {
+	return serveConnections(ctx, spec, "LMTP", func(conn net.Conn) {
+		serveLMTP(ctx, conn, recipients, lanes)
+	})
+}
+
+// serveConnections accepts connections of the given protocol on the socket
+// given in Postfix notation until ctx is done, serving each of them
+// concurrently with serve.
+func serveConnections(ctx context.Context, spec, protocol string, serve func(net.Conn)) error {
+	network, address, err := parseSocket(spec)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		// Remove the socket left behind by a previous instance.
+		if err := os.Remove(address); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		l.Close()
+	})
+	defer stop()
+
+	// Look up the hostname once, rather than for every message.
+	getHostname(ctx)
+	infof(ctx, "listening for %s connections on %s", protocol, spec)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(conn)
+		}()
+	}
+}
+
+// serveLMTP handles a single LMTP session. The connection is closed when ctx
+// is done, deferring messages in progress.
+func serveLMTP(ctx context.Context, conn net.Conn, recipients []string, lanes *laneSet) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	c := textproto.NewConn(conn)
+	host := getHostname(ctx)
+	sizeLimit := messageSizeLimit
+	if sizeLimit == 0 {
+		sizeLimit = lmtpDefaultSizeLimit
+	}
+	c.PrintfLine("220 %s LMTP Postforward", host)
+
+	var sender string
+	var rcpts []string
+	haveSender := false
+	for {
+		conn.SetReadDeadline(time.Now().Add(lmtpIdleTimeout))
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "LHLO":
+			c.PrintfLine("250-%s", host)
+			c.PrintfLine("250-PIPELINING")
+			c.PrintfLine("250-8BITMIME")
+			c.PrintfLine("250-SIZE %d", sizeLimit)
+			c.PrintfLine("250 ENHANCEDSTATUSCODES")
+		case "MAIL":
+			addr, ok := parsePath(arg, "FROM:")
+			if !ok {
+				c.PrintfLine("501 5.5.4 Syntax: MAIL FROM:<address>")
+				continue
+			}
+			sender, rcpts, haveSender = addr, nil, true
+			c.PrintfLine("250 2.1.0 Ok")
+		case "RCPT":
+			if !haveSender {
+				c.PrintfLine("503 5.5.1 Error: need MAIL command")
+				continue
+			}
+			addr, ok := parsePath(arg, "TO:")
+			if !ok || addr == "" {
+				c.PrintfLine("501 5.5.4 Syntax: RCPT TO:<address>")
+				continue
+			}
+			rcpts = append(rcpts, addr)
+			c.PrintfLine("250 2.1.5 Ok")
+		case "DATA":
+			if len(rcpts) == 0 {
+				c.PrintfLine("503 5.5.1 Error: need RCPT command")
+				continue
+			}
+			c.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			dot := idleReader{conn, c.DotReader()}
+			data, err := io.ReadAll(io.LimitReader(dot, sizeLimit+1))
+			if err != nil {
+				return
+			}
+			if int64(len(data)) > sizeLimit {
+				// The rest of the message is discarded rather than buffered.
+				if _, err := io.Copy(io.Discard, dot); err != nil {
+					return
+				}
+				for range rcpts {
+					c.PrintfLine("552 5.3.4 Message size exceeds fixed limit")
+				}
+				sender, rcpts, haveSender = "", nil, false
+				continue
+			}
+			lane := lanes.classify(sender, data)
+			release, err := lanes.acquire(ctx, lane)
+			if err != nil {
+				return
+			}
+			// LMTP requires a reply for every accepted recipient.
+			for _, rcpt := range rcpts {
+				c.PrintfLine("%s", forwardLMTP(ctx, sender, rcpt, data, recipients))
+			}
+			release()
+			sender, rcpts, haveSender = "", nil, false
+		case "RSET":
+			sender, rcpts, haveSender = "", nil, false
+			c.PrintfLine("250 2.0.0 Ok")
+		case "NOOP":
+			c.PrintfLine("250 2.0.0 Ok")
+		case "QUIT":
+			c.PrintfLine("221 2.0.0 Bye")
+			return
+		default:
+			c.PrintfLine("502 5.5.2 Error: command not recognized")
+		}
+	}
+}
+
+// forwardLMTP forwards a message received via LMTP, returning the reply for
+// the original recipient rcpt. The envelope sender is passed on as the
+// --rp-header header, as added by Postfix when delivering to pipe(8).
+func forwardLMTP(ctx context.Context, sender, rcpt string, data []byte, recipients []string) string {
+	msg := newMessageInfo()
+	ctx = withMessage(ctx, msg)
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	in := io.MultiReader(strings.NewReader(fmt.Sprintf("%s: <%s>\n", *rpHeader, sender)), bytes.NewReader(data))
+	err := forward(ctx, in, rcpt, recipients)
+	if err == nil {
+		return "250 2.0.0 Ok: forwarded as " + msg.queueID
+	}
+
+	code := exitCode(err)
+	reportFailure(ctx, err.Error(), code)
+	logf(ctx, err.Error())
+	return rejectReply(msg, rcpt, err)
+}
+
+// rejectReply returns the LMTP reply rejecting the message msg for rcpt
+// because of err, with the enhanced status code of err and the text of
+// --reply-template.
+func rejectReply(msg *messageInfo, rcpt string, err error) string {
+	status := enhancedStatus(err)
+	var reply int
+	switch {
+	case status == "5.3.4":
+		reply = 552
+	case status[0] == '4':
+		reply = 451
+	case strings.HasPrefix(status, "5.1.") || strings.HasPrefix(status, "5.2.") || status == "5.3.0":
+		reply = 550
+	default:
+		reply = 554
+	}
+	// The reply has to fit on a single line.
+	clean := func(s string) string {
+		return strings.Join(strings.Fields(s), " ")
+	}
+	text := strings.NewReplacer(
+		"{reason}", clean(err.Error()),
+		"{status}", status,
+		"{recipient}", clean(rcpt),
+		"{queue_id}", msg.queueID,
+	).Replace(*replyTemplate)
+	return fmt.Sprintf("%d %s %s", reply, status, clean(text))
+}
+
+// parsePath extracts the address from the argument of a MAIL or RCPT command,
+// such as FROM:<user@example.com> BODY=8BITMIME.
+func parsePath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	path := strings.TrimLeft(arg[len(prefix):], " ")
+	if !strings.HasPrefix(path, "<") {
+		return "", false
+	}
+	end := strings.Index(path, ">")
+	if end < 0 {
+		return "", false
+	}
+	return path[1:end], true
+}
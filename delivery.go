@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+)
+
+// TLS policies for SMTP and LMTP delivery, named after the Postfix
+// smtp_tls_security_level values they mimic.
+const (
+	// tlsNone never uses STARTTLS.
+	tlsNone = "none"
+	// tlsMay uses STARTTLS when offered, without verifying the server
+	// certificate.
+	tlsMay = "may"
+	// tlsVerify requires STARTTLS and a valid server certificate.
+	tlsVerify = "verify"
+)
+
+// smtpDelivery describes how messages are submitted when delivering via
+// SMTP or LMTP instead of the sendmail binary.
+type smtpDelivery struct {
+	lmtp     bool
+	addr     string
+	host     string
+	tls      string
+	username string
+	password string
+	// downgrade converts 8-bit messages to 7-bit for servers which don't
+	// offer 8BITMIME.
+	downgrade bool
+}
+
+// parseDelivery parses a delivery URL of the form smtp://[user@]host[:port]
+// or lmtp://[user@]host[:port]. The password for authentication is read
+// from passwordFile. With downgrade, 8-bit messages are converted to 7-bit
+// for servers which don't offer 8BITMIME.
+func parseDelivery(spec, tlsPolicy, passwordFile string, downgrade bool) (smtpDelivery, error) {
+	u, err := parseServerURL(spec)
+	if err != nil {
+		return smtpDelivery{}, err
+	}
+	d := smtpDelivery{host: u.Hostname(), tls: tlsPolicy, downgrade: downgrade}
+	port := u.Port()
+	switch u.Scheme {
+	case "smtp":
+		if port == "" {
+			port = "25"
+		}
+	case "lmtp":
+		d.lmtp = true
+		if port == "" {
+			port = "24"
+		}
+	default:
+		return smtpDelivery{}, fmt.Errorf("unsupported scheme %q, expected smtp or lmtp", u.Scheme)
+	}
+	if d.host == "" {
+		return smtpDelivery{}, errors.New("missing host")
+	}
+	d.addr = net.JoinHostPort(d.host, port)
+
+	switch tlsPolicy {
+	case tlsNone, tlsMay, tlsVerify:
+	default:
+		return smtpDelivery{}, fmt.Errorf("invalid TLS policy %q", tlsPolicy)
+	}
+
+	if u.User != nil {
+		if passwordFile == "" {
+			return smtpDelivery{}, errors.New("authentication requires a password file")
+		}
+		password, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return smtpDelivery{}, err
+		}
+		d.username = u.User.Username()
+		d.password = strings.TrimRight(string(password), "\r\n")
+	}
+	return d, nil
+}
+
+// deliver submits the message read from msg for the given sender and
+// recipients, greeting the server as helo. Rejected recipients abort the
+// submission before any data is sent. With LMTP, once the message was
+// delivered to at least one recipient, permanent failures for others return
+// a permanent error naming them, so the sender is told about those
+// recipients only. The submission is aborted when ctx is done.
+func (d smtpDelivery) deliver(ctx context.Context, helo, sender string, recipients []string, msg io.Reader) error {
+	c, ext, done, err := d.session(ctx, helo)
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err := smtpFault(ctx); err != nil {
+		return d.error(ctx, "MAIL FROM", err)
+	}
+
+	mailFrom := "MAIL FROM:<%s>"
+	if _, ok := ext["8BITMIME"]; ok {
+		mailFrom += " BODY=8BITMIME"
+	} else if d.downgrade && messageFrom(ctx).protection == "" {
+		// Forwarded messages were converted before they were signed, see
+		// offers8BITMIME. This converts copies and replies.
+		content, err := io.ReadAll(msg)
+		if err != nil {
+			return temporaryError("Error reading message: %w", err)
+		}
+		if converted, changed := downgrade8bit(content); changed {
+			infof(ctx, "%s does not offer 8BITMIME, converted the message to 7-bit", d.addr)
+			content = converted
+		}
+		msg = bytes.NewReader(content)
+	}
+	if err := command(c, 250, mailFrom, sender); err != nil {
+		return d.error(ctx, "MAIL FROM", err)
+	}
+	for _, rcpt := range recipients {
+		if err := command(c, 25, "RCPT TO:<%s>", rcpt); err != nil {
+			return d.error(ctx, "RCPT TO "+rcpt, err)
+		}
+	}
+	if err := command(c, 354, "DATA"); err != nil {
+		return d.error(ctx, "DATA", err)
+	}
+	w := c.DotWriter()
+	if _, err := io.Copy(w, msg); err != nil {
+		return temporaryError("Error sending message to %s: %w", d.addr, ctxErr(ctx, err))
+	}
+	if err := w.Close(); err != nil {
+		return temporaryError("Error sending message to %s: %w", d.addr, ctxErr(ctx, err))
+	}
+
+	if !d.lmtp {
+		if _, _, err := c.ReadResponse(250); err != nil {
+			return d.error(ctx, "End of data", err)
+		}
+	} else {
+		// LMTP servers reply once for every recipient.
+		var failed error
+		var rejected []string
+		delivered := 0
+		for _, rcpt := range recipients {
+			_, _, err := c.ReadResponse(250)
+			if err == nil {
+				delivered++
+				continue
+			}
+			err = d.error(ctx, "Delivery to "+rcpt, err)
+			if exitCode(err) != ExTempFail {
+				rejected = append(rejected, rcpt)
+			}
+			if exitCode(err) == ExTempFail || failed == nil {
+				failed = err
+			}
+		}
+		switch {
+		case failed == nil:
+		case delivered == 0 || exitCode(failed) == ExTempFail:
+			return failed
+		default:
+			command(c, 221, "QUIT")
+			return partialDeliveryError(failed, rejected)
+		}
+	}
+
+	command(c, 221, "QUIT")
+	return nil
+}
+
+// partialDeliveryError returns the permanent error failed, after a message
+// was delivered to some recipients but rejected for good by the others. The
+// message names the rejected recipients, so the bounce tells the sender
+// which of them didn't receive the message.
+func partialDeliveryError(failed error, rejected []string) error {
+	err := fmt.Errorf("Undeliverable to %s, delivered to the other recipients: %w", strings.Join(rejected, ", "), failed)
+	var e *processingError
+	if !errors.As(failed, &e) {
+		return &processingError{severity: permanent, code: ExUnavailable, err: err}
+	}
+	c := *e
+	c.err = err
+	return &c
+}
+
+// offers8BITMIME reports whether the server offers 8BITMIME, greeting it as
+// helo.
+func (d smtpDelivery) offers8BITMIME(ctx context.Context, helo string) (bool, error) {
+	c, ext, done, err := d.session(ctx, helo)
+	if err != nil {
+		return false, err
+	}
+	defer done()
+	command(c, 221, "QUIT")
+	_, ok := ext["8BITMIME"]
+	return ok, nil
+}
+
+// session connects to the server and greets it as helo, starting TLS and
+// authenticating as configured. It returns the connection, the extensions
+// offered by the server and a function closing the connection.
+func (d smtpDelivery) session(ctx context.Context, helo string) (*textproto.Conn, map[string]string, func(), error) {
+	conn, done, err := dialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, nil, nil, temporaryError("Unable to connect to %s: %w", d.addr, ctxErr(ctx, err))
+	}
+	c, ext, err := func() (*textproto.Conn, map[string]string, error) {
+		c := textproto.NewConn(conn)
+		if _, _, err := c.ReadResponse(220); err != nil {
+			return nil, nil, d.error(ctx, "Greeting", err)
+		}
+		ext, err := d.hello(c, helo)
+		if err != nil {
+			return nil, nil, d.error(ctx, "Hello", err)
+		}
+
+		secure := false
+		if _, ok := ext["STARTTLS"]; ok && d.tls != tlsNone {
+			if err := command(c, 220, "STARTTLS"); err != nil {
+				return nil, nil, d.error(ctx, "STARTTLS", err)
+			}
+			tlsConn := tls.Client(conn, &tls.Config{
+				ServerName:         stripZone(d.host),
+				InsecureSkipVerify: d.tls != tlsVerify,
+			})
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				return nil, nil, temporaryError("TLS handshake with %s failed: %w", d.addr, ctxErr(ctx, err))
+			}
+			c = textproto.NewConn(tlsConn)
+			if ext, err = d.hello(c, helo); err != nil {
+				return nil, nil, d.error(ctx, "Hello", err)
+			}
+			secure = true
+		} else if d.tls == tlsVerify {
+			return nil, nil, temporaryError("%s does not offer STARTTLS", d.addr)
+		}
+
+		if d.username != "" {
+			if !secure {
+				return nil, nil, temporaryError("Refusing to authenticate to %s without TLS", d.addr)
+			}
+			if !hasParam(ext["AUTH"], "PLAIN") {
+				return nil, nil, temporaryError("%s does not offer AUTH PLAIN", d.addr)
+			}
+			credentials := base64.StdEncoding.EncodeToString([]byte("\x00" + d.username + "\x00" + d.password))
+			if err := command(c, 235, "AUTH PLAIN %s", credentials); err != nil {
+				return nil, nil, d.error(ctx, "Authentication", err)
+			}
+		}
+		return c, ext, nil
+	}()
+	if err != nil {
+		done()
+		return nil, nil, nil, err
+	}
+	return c, ext, done, nil
+}
+
+// probe checks whether the server accepts mail from sender to rcpt, without
+// sending a message: the transaction is reset after the RCPT command.
+func (d smtpDelivery) probe(ctx context.Context, helo, sender, rcpt string) error {
+	c, _, done, err := d.session(ctx, helo)
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err := command(c, 250, "MAIL FROM:<%s>", sender); err != nil {
+		return d.error(ctx, "MAIL FROM", err)
+	}
+	if err := command(c, 25, "RCPT TO:<%s>", rcpt); err != nil {
+		return d.error(ctx, "RCPT TO "+rcpt, err)
+	}
+	command(c, 250, "RSET")
+	command(c, 221, "QUIT")
+	return nil
+}
+
+// hello greets the server, returning the offered extensions and their
+// parameters.
+func (d smtpDelivery) hello(c *textproto.Conn, helo string) (map[string]string, error) {
+	verb := "EHLO"
+	if d.lmtp {
+		verb = "LHLO"
+	}
+	id, err := c.Cmd("%s %s", verb, helo)
+	if err != nil {
+		return nil, err
+	}
+	c.StartResponse(id)
+	defer c.EndResponse(id)
+	_, msg, err := c.ReadResponse(250)
+	if err != nil {
+		return nil, err
+	}
+
+	ext := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(msg))
+	// The first line holds the server's greeting rather than an extension.
+	scanner.Scan()
+	for scanner.Scan() {
+		keyword, params, _ := strings.Cut(scanner.Text(), " ")
+		ext[strings.ToUpper(keyword)] = params
+	}
+	return ext, nil
+}
+
+// error turns a failed command into an error with a severity matching the
+// reply code.
+func (d smtpDelivery) error(ctx context.Context, step string, err error) error {
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		return replyError(fmt.Sprintf("%s rejected by %s", step, d.addr), reply)
+	}
+	return temporaryError("%s failed at %s: %w", step, d.addr, ctxErr(ctx, err))
+}
+
+// command sends a command and reads its reply, which must start with the
+// given code.
+func command(c *textproto.Conn, code int, format string, args ...interface{}) error {
+	id, err := c.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+	c.StartResponse(id)
+	defer c.EndResponse(id)
+	_, _, err = c.ReadResponse(code)
+	return err
+}
+
+// hasParam reports whether the space-separated list of extension parameters
+// contains param.
+func hasParam(params, param string) bool {
+	for _, p := range strings.Fields(params) {
+		if strings.EqualFold(p, param) {
+			return true
+		}
+	}
+	return false
+}
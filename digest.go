@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// digestHeader is the header field carrying the SHA-256 digest of the
+// forwarded body when --digest-header is enabled.
+const digestHeader = "X-Forward-Digest"
+
+// spoolBody copies the body to an anonymous temporary file, so it can be
+// read again once its digest is known. The file is unlinked right away and
+// disappears when it is closed or the process exits.
+func spoolBody(body io.Reader) (*os.File, error) {
+	f, err := os.CreateTemp("", "postforward-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// digestField returns the digest header field for the given SHA-256 sum,
+// using the same line ending as the first line of header.
+func digestField(sum []byte, header []byte) []byte {
+	lineEnding := guessLineEnding(header[:bytes.IndexByte(header, '\n')+1])
+	return append([]byte(fmt.Sprintf("%s: sha256=%x", digestHeader, sum)), lineEnding...)
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dkimSignedHeaders lists the header fields covered by DKIM signatures, when
+// present in the message.
+var dkimSignedHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// dkimFoldWidth is the length of the chunks the signature is split into, to
+// keep the DKIM-Signature header lines short.
+const dkimFoldWidth = 72
+
+// dkimSigner signs messages on behalf of the forwarding domain, using
+// relaxed/relaxed canonicalization.
+type dkimSigner struct {
+	domain   string
+	selector string
+	key      crypto.Signer
+}
+
+// loadDKIMSigner reads the PEM encoded private key at path, which may be an
+// RSA key in PKCS #1 form or an RSA or Ed25519 key in PKCS #8 form.
+func loadDKIMSigner(path, domain, selector string) (dkimSigner, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return dkimSigner{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return dkimSigner{}, fmt.Errorf("%s: no PEM encoded key found", path)
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return dkimSigner{}, fmt.Errorf("%s: unsupported key type %q", path, block.Type)
+	}
+	if err != nil {
+		return dkimSigner{}, fmt.Errorf("%s: %s", path, err)
+	}
+	s := dkimSigner{domain: domain, selector: selector}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s.key = k
+	case ed25519.PrivateKey:
+		s.key = k
+	default:
+		return dkimSigner{}, fmt.Errorf("%s: unsupported key algorithm", path)
+	}
+	return s, nil
+}
+
+// dkimKeyTable maps domains to the selectors and keys their mail is signed
+// with, as read from --dkim-key-table: a Postfix table source file with
+// values of the form "selector keyfile". Keys starting with a dot match
+// subdomains, which are signed on behalf of the parent domain.
+type dkimKeyTable struct {
+	path    string
+	entries table
+	// signers caches the keys loaded for the domains looked up.
+	signers map[string]*dkimSigner
+}
+
+// loadDKIMKeyTable reads the key table at path. The keys themselves are
+// only read once they're needed.
+func loadDKIMKeyTable(ctx context.Context, path string) (*dkimKeyTable, error) {
+	t, err := readTable(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range t {
+		if len(strings.Fields(value)) != 2 {
+			return nil, fmt.Errorf("%s: invalid entry for %s, expected: selector keyfile", path, key)
+		}
+	}
+	return &dkimKeyTable{path: path, entries: t, signers: map[string]*dkimSigner{}}, nil
+}
+
+// signer returns the signer for the first of domains the table has an
+// entry for, or nil if there is none.
+func (t *dkimKeyTable) signer(domains ...string) (*dkimSigner, error) {
+	for _, domain := range domains {
+		domain = strings.ToLower(domain)
+		if domain == "" {
+			continue
+		}
+		if s, ok := t.signers[domain]; ok {
+			return s, nil
+		}
+		signing, value := domain, t.entries[domain]
+		for parent := domain; value == "" && strings.Contains(parent, "."); {
+			parent = parent[strings.IndexByte(parent, '.')+1:]
+			signing, value = parent, t.entries["."+parent]
+		}
+		if value == "" {
+			continue
+		}
+		fields := strings.Fields(value)
+		s, err := loadDKIMSigner(fields[1], signing, fields[0])
+		if err != nil {
+			return nil, err
+		}
+		t.signers[domain] = &s
+		return &s, nil
+	}
+	return nil, nil
+}
+
+// algorithm returns the DKIM signing algorithm for the signer's key.
+func (s dkimSigner) algorithm() string {
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		return "ed25519-sha256"
+	}
+	return "rsa-sha256"
+}
+
+// sign returns the DKIM-Signature header field for the message with the
+// given header section and body hash, as computed by dkimBodyHash. The field
+// uses the same line ending as the first line of header.
+func (s dkimSigner) sign(header []byte, bodyHash []byte, now time.Time) ([]byte, error) {
+	fields := splitHeaderFields(header)
+	if len(fields) == 0 {
+		return nil, errors.New("message has no header")
+	}
+	h, names, err := hashSignedHeaders(fields)
+	if err != nil {
+		return nil, err
+	}
+	value := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		s.algorithm(), s.domain, s.selector, now.Unix(), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash))
+	return s.signField("DKIM-Signature", value, h, lineEnding(fields))
+}
+
+// hashSignedHeaders returns the hash of the dkimSignedHeaders present in
+// fields in relaxed canonical form, along with their names for the h= tag.
+func hashSignedHeaders(fields [][]byte) (hash.Hash, []string, error) {
+	// Like verifiers, pick the instances of repeated fields from the bottom
+	// up.
+	used := map[string]int{}
+	var names []string
+	h := sha256.New()
+	for _, name := range dkimSignedHeaders {
+		for {
+			field := lastHeaderField(fields, name, used[strings.ToLower(name)])
+			if field == nil {
+				break
+			}
+			used[strings.ToLower(name)]++
+			names = append(names, strings.ToLower(name))
+			h.Write(relaxedHeader(field))
+			h.Write([]byte("\r\n"))
+		}
+	}
+	if used["from"] == 0 {
+		return nil, nil, errors.New("message has no From header")
+	}
+	return h, names, nil
+}
+
+// signField completes h, which holds the canonicalized data signed so far,
+// with the signature field itself and returns the field with the signature
+// filled in. value must end with the empty b= tag.
+func (s dkimSigner) signField(name, value string, h hash.Hash, lineEnding []byte) ([]byte, error) {
+	h.Write(relaxedHeader([]byte(name + ": " + value)))
+
+	var sig []byte
+	var err error
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		sig, err = s.key.Sign(rand.Reader, h.Sum(nil), crypto.Hash(0))
+	} else {
+		sig, err = s.key.Sign(rand.Reader, h.Sum(nil), crypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	field := []byte(name + ": " + value)
+	b := base64.StdEncoding.EncodeToString(sig)
+	for len(b) > 0 {
+		n := min(len(b), dkimFoldWidth)
+		field = append(append(append(field, lineEnding...), '\t'), b[:n]...)
+		b = b[n:]
+	}
+	return append(field, lineEnding...), nil
+}
+
+// lineEnding returns the line ending used by the first of the header fields.
+func lineEnding(fields [][]byte) []byte {
+	return guessLineEnding(fields[0][:bytes.IndexByte(fields[0], '\n')+1])
+}
+
+// splitHeaderFields splits a header section into its fields, including
+// continuation lines and line endings. The section ends at the first empty
+// line.
+func splitHeaderFields(header []byte) [][]byte {
+	var fields [][]byte
+	for len(header) > 0 {
+		end := bytes.IndexByte(header, '\n') + 1
+		if end == 0 {
+			end = len(header)
+		}
+		line := header[:end]
+		header = header[end:]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			last := fields[len(fields)-1]
+			fields[len(fields)-1] = last[:len(last)+len(line)]
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+// lastHeaderField returns the named field, skipping the given number of
+// instances from the bottom of the header section, or nil if there is none.
+func lastHeaderField(fields [][]byte, name string, skip int) []byte {
+	for i := len(fields) - 1; i >= 0; i-- {
+		n, _, ok := bytes.Cut(fields[i], []byte(":"))
+		if !ok || !strings.EqualFold(strings.TrimRight(string(n), " \t"), name) {
+			continue
+		}
+		if skip == 0 {
+			return fields[i]
+		}
+		skip--
+	}
+	return nil
+}
+
+// relaxedHeader returns the header field in the relaxed canonical form of
+// RFC 6376, section 3.4.2, without the trailing CRLF.
+func relaxedHeader(field []byte) []byte {
+	name, value, _ := bytes.Cut(field, []byte(":"))
+	name = bytes.ToLower(bytes.TrimRight(name, " \t"))
+	value = bytes.ReplaceAll(value, []byte("\r"), nil)
+	value = bytes.ReplaceAll(value, []byte("\n"), nil)
+	value = bytes.Join(bytes.FieldsFunc(value, isWSP), []byte(" "))
+	return append(append(name, ':'), value...)
+}
+
+// isWSP reports whether r is whitespace as defined by RFC 5234.
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// Canonicalization algorithms of RFC 6376, section 3.4.
+const (
+	canonSimple  = "simple"
+	canonRelaxed = "relaxed"
+)
+
+// dkimBodyHash computes the hash of a message body in the simple or relaxed
+// canonical form of RFC 6376, section 3.4, as it is written. Lines may end in
+// LF or CRLF.
+type dkimBodyHash struct {
+	h       hash.Hash
+	relaxed bool
+	// line holds the incomplete last line written.
+	line []byte
+	// empty counts the empty lines not yet hashed, which are dropped when
+	// they end the body.
+	empty int
+	// hashed tells whether any line was hashed yet.
+	hashed bool
+}
+
+func newDKIMBodyHash(canonicalization string) *dkimBodyHash {
+	return &dkimBodyHash{h: sha256.New(), relaxed: canonicalization == canonRelaxed}
+}
+
+func (d *dkimBodyHash) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			d.line = append(d.line, p...)
+			break
+		}
+		d.line = append(d.line, p[:i]...)
+		p = p[i+1:]
+		d.writeLine()
+	}
+	return n, nil
+}
+
+// writeLine hashes the buffered line in canonical form.
+func (d *dkimBodyHash) writeLine() {
+	line := bytes.TrimSuffix(d.line, []byte("\r"))
+	if d.relaxed {
+		empty := len(bytes.TrimLeft(line, " \t")) == 0
+		indented := len(line) > 0 && isWSP(rune(line[0]))
+		line = bytes.Join(bytes.FieldsFunc(line, isWSP), []byte(" "))
+		// Whitespace within a line is only compressed, not removed.
+		if indented && !empty {
+			line = append([]byte(" "), line...)
+		}
+	}
+	d.line = d.line[:0]
+	if len(line) == 0 {
+		d.empty++
+		return
+	}
+	for ; d.empty > 0; d.empty-- {
+		d.h.Write([]byte("\r\n"))
+	}
+	d.h.Write(line)
+	d.h.Write([]byte("\r\n"))
+	d.hashed = true
+}
+
+// Sum returns the body hash, completing an unterminated last line.
+func (d *dkimBodyHash) Sum() []byte {
+	if len(d.line) > 0 {
+		d.writeLine()
+	}
+	if !d.hashed && !d.relaxed {
+		// The simple canonical form of an empty body is a single CRLF.
+		d.h.Write([]byte("\r\n"))
+		d.hashed = true
+	}
+	return d.h.Sum(nil)
+}
+
+// spoolHashedBody spools body like spoolBody, and returns its body hashes in
+// the relaxed and simple canonical forms, by canonicalization.
+func spoolHashedBody(body io.Reader) (*os.File, map[string][]byte, error) {
+	relaxed, simple := newDKIMBodyHash(canonRelaxed), newDKIMBodyHash(canonSimple)
+	spool, err := spoolBody(io.TeeReader(body, io.MultiWriter(relaxed, simple)))
+	if err != nil {
+		return nil, nil, err
+	}
+	return spool, map[string][]byte{canonRelaxed: relaxed.Sum(), canonSimple: simple.Sum()}, nil
+}
+
+// dkimVerifyLimit bounds the number of signatures verified per message.
+const dkimVerifyLimit = 10
+
+// verifyDKIM verifies the DKIM signatures of a message with the given header
+// fields, as of time now. bodyHashes holds the hash of the body for each
+// canonicalization algorithm.
+func verifyDKIM(ctx context.Context, fields [][]byte, bodyHashes map[string][]byte, now time.Time) []authResult {
+	var results []authResult
+	for _, field := range fields {
+		if !isHeader(field, []string{"DKIM-Signature"}) {
+			continue
+		}
+		if len(results) == dkimVerifyLimit {
+			break
+		}
+		r := authResult{method: "dkim"}
+		tags, err := parseTags(fieldValue(field))
+		if err == nil {
+			r.domain = tags["d"]
+			r.props = []string{"header.d=" + tags["d"], "header.s=" + tags["s"]}
+			err = checkDKIMTags(tags, now)
+		}
+		if err == nil {
+			r.result, err = verifySignature(ctx, fields, field, tags, bodyHashes)
+		} else {
+			r.result = "permerror"
+		}
+		if err != nil {
+			r.reason = err.Error()
+		}
+		results = append(results, r)
+	}
+	if len(results) == 0 {
+		results = append(results, authResult{method: "dkim", result: "none"})
+	}
+	return results
+}
+
+// checkDKIMTags validates the tags of a DKIM-Signature, which are not
+// shared with ARC-Message-Signature.
+func checkDKIMTags(tags map[string]string, now time.Time) error {
+	if tags["v"] != "1" {
+		return fmt.Errorf("unsupported version %q", tags["v"])
+	}
+	if !signsHeader(tags, "From") {
+		return errors.New("From header not signed")
+	}
+	if _, ok := tags["l"]; ok {
+		return errors.New("body length limits are not supported")
+	}
+	if x, ok := tags["x"]; ok {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid expiration %q", x)
+		}
+		if now.Unix() > expires {
+			return errors.New("signature expired")
+		}
+	}
+	return nil
+}
+
+// signsHeader reports whether the h= tag of a signature lists name.
+func signsHeader(tags map[string]string, name string) bool {
+	for _, n := range strings.Split(tags["h"], ":") {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifySignature verifies a DKIM-Signature or ARC-Message-Signature field
+// with the given tags against the header fields and body hashes of the
+// message. The result is pass, fail, temperror or permerror, with an error
+// explaining any failure.
+func verifySignature(ctx context.Context, fields [][]byte, sig []byte, tags map[string]string, bodyHashes map[string][]byte) (string, error) {
+	for _, tag := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if tags[tag] == "" {
+			return "permerror", fmt.Errorf("missing %s= tag", tag)
+		}
+	}
+	headerCanon, bodyCanon, _ := strings.Cut(tags["c"], "/")
+	if headerCanon == "" {
+		headerCanon = canonSimple
+	}
+	if bodyCanon == "" {
+		bodyCanon = canonSimple
+	}
+	bodyHash, ok := bodyHashes[bodyCanon]
+	if !ok || (headerCanon != canonSimple && headerCanon != canonRelaxed) {
+		return "permerror", fmt.Errorf("unsupported canonicalization %q", tags["c"])
+	}
+
+	key, err := lookupDKIMKey(ctx, tags["s"], tags["d"], tags["a"])
+	if err != nil {
+		return dkimError(err)
+	}
+	if bh, err := base64.StdEncoding.DecodeString(tags["bh"]); err != nil || !bytes.Equal(bh, bodyHash) {
+		return "fail", errors.New("body hash mismatch")
+	}
+
+	h := sha256.New()
+	used := map[string]int{}
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		// Fields listed more often than present are signed as empty.
+		if field := lastHeaderField(fields, name, used[name]); field != nil {
+			h.Write(canonicalHeader(field, headerCanon))
+			h.Write([]byte("\r\n"))
+		}
+		used[name]++
+	}
+	name, value, _ := bytes.Cut(sig, []byte(":"))
+	unsigned := append(append(append([]byte(nil), name...), ':'), signatureTag.ReplaceAll(value, []byte("$1"))...)
+	h.Write(canonicalHeader(unsigned, headerCanon))
+
+	b, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return "permerror", errors.New("invalid signature encoding")
+	}
+	if !verifyHash(key, h.Sum(nil), b) {
+		return "fail", errors.New("signature verification failed")
+	}
+	return "pass", nil
+}
+
+// signatureTag matches the b= tag of a signature field value, capturing
+// everything up to the tag value, which is excluded from the signed data.
+var signatureTag = regexp.MustCompile(`((?:^|;)[ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+
+// verifyHash verifies the signature sig of hash using key.
+func verifyHash(key crypto.PublicKey, hash, sig []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash, sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, hash, sig)
+	}
+	return false
+}
+
+// dkimTemporaryError marks key lookup failures which may go away later.
+type dkimTemporaryError struct {
+	err error
+}
+
+func (e dkimTemporaryError) Error() string {
+	return e.err.Error()
+}
+
+// dkimError returns the result for a failed key lookup.
+func dkimError(err error) (string, error) {
+	var temp dkimTemporaryError
+	if errors.As(err, &temp) {
+		return "temperror", err
+	}
+	return "permerror", err
+}
+
+// lookupDKIMKey looks up the public key for the given selector and domain,
+// which must be usable with the signing algorithm.
+func lookupDKIMKey(ctx context.Context, selector, domain, algorithm string) (crypto.PublicKey, error) {
+	name := selector + "._domainkey." + domain
+	records, err := lookupTXT(ctx, name)
+	if err != nil {
+		return nil, dkimTemporaryError{fmt.Errorf("looking up %s: %s", name, err)}
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no key found at %s", name)
+	}
+	tags, err := parseTags(records[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key record at %s: %s", name, err)
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, fmt.Errorf("invalid key record version at %s", name)
+	}
+	if tags["p"] == "" {
+		return nil, fmt.Errorf("key at %s was revoked", name)
+	}
+	data, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key at %s", name)
+	}
+
+	keyType := tags["k"]
+	if keyType == "" {
+		keyType = "rsa"
+	}
+	switch {
+	case keyType == "rsa" && algorithm == "rsa-sha256":
+		key, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			// Some records hold a bare PKCS #1 key.
+			key, err = x509.ParsePKCS1PublicKey(data)
+		}
+		if _, ok := key.(*rsa.PublicKey); err != nil || !ok {
+			return nil, fmt.Errorf("invalid RSA key at %s", name)
+		}
+		return key, nil
+	case keyType == "ed25519" && algorithm == "ed25519-sha256":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key at %s", name)
+		}
+		return ed25519.PublicKey(data), nil
+	}
+	return nil, fmt.Errorf("unsupported algorithm %s for %s key at %s", algorithm, keyType, name)
+}
+
+// parseTags parses a tag-list as used in DKIM signatures and key records,
+// such as "v=1; a=rsa-sha256". Whitespace within values is removed.
+func parseTags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, spec := range strings.Split(s, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(spec, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid tag %q", strings.TrimSpace(spec))
+		}
+		if _, dup := tags[name]; dup {
+			return nil, fmt.Errorf("duplicate tag %s", name)
+		}
+		tags[name] = strings.Join(strings.Fields(value), "")
+	}
+	return tags, nil
+}
+
+// fieldValue returns the value of a header field, without its name.
+func fieldValue(field []byte) string {
+	_, value, _ := bytes.Cut(field, []byte(":"))
+	return string(value)
+}
+
+// canonicalHeader returns the header field in the given canonical form,
+// without the trailing CRLF.
+func canonicalHeader(field []byte, canonicalization string) []byte {
+	if canonicalization == canonRelaxed {
+		return relaxedHeader(field)
+	}
+	// The simple form is the field as it was received, with CRLF line
+	// endings.
+	field = bytes.ReplaceAll(field, []byte("\r\n"), []byte("\n"))
+	field = bytes.ReplaceAll(field, []byte("\n"), []byte("\r\n"))
+	return bytes.TrimSuffix(field, []byte("\r\n"))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+// TestCanonicalHeader checks header canonicalization against the examples
+// of RFC 6376, section 3.4.5.
+func TestCanonicalHeader(t *testing.T) {
+	tests := []struct {
+		field, canonicalization, canonical string
+	}{
+		{"A: X\r\n", canonRelaxed, "a:X"},
+		{"B : Y\t\r\n\tZ  \r\n", canonRelaxed, "b:Y Z"},
+		{"B : Y\t\n\tZ  \n", canonRelaxed, "b:Y Z"},
+		{"Subject:\r\n", canonRelaxed, "subject:"},
+		{"A: X\r\n", canonSimple, "A: X"},
+		{"B : Y\t\n\tZ  \n", canonSimple, "B : Y\t\r\n\tZ  "},
+	}
+	for _, test := range tests {
+		if canonical := canonicalHeader([]byte(test.field), test.canonicalization); string(canonical) != test.canonical {
+			t.Errorf("%s canonical form of %q is %q, expected %q", test.canonicalization, test.field, canonical, test.canonical)
+		}
+	}
+}
+
+// TestDKIMBodyHash checks body canonicalization against the examples of RFC
+// 6376, section 3.4.5, however the body is split into writes.
+func TestDKIMBodyHash(t *testing.T) {
+	tests := []struct {
+		body, canonicalization, canonical string
+	}{
+		{" C \r\nD \t E\r\n\r\n\r\n", canonRelaxed, " C\r\nD E\r\n"},
+		{" C \r\nD \t E\r\n\r\n\r\n", canonSimple, " C \r\nD \t E\r\n"},
+		{" C \nD \t E\n\n\n", canonRelaxed, " C\r\nD E\r\n"},
+		{"no final newline", canonSimple, "no final newline\r\n"},
+		{"no final newline ", canonRelaxed, "no final newline\r\n"},
+		{"", canonSimple, "\r\n"},
+		{"", canonRelaxed, ""},
+		{"\r\n\r\n", canonSimple, "\r\n"},
+		{"\r\n\r\n", canonRelaxed, ""},
+	}
+	for _, test := range tests {
+		want := sha256.Sum256([]byte(test.canonical))
+		for _, chunk := range []int{1, 2, 3, len(test.body) + 1} {
+			h := newDKIMBodyHash(test.canonicalization)
+			for body := []byte(test.body); len(body) > 0; {
+				n := min(chunk, len(body))
+				h.Write(body[:n])
+				body = body[n:]
+			}
+			if sum := h.Sum(); !bytes.Equal(sum, want[:]) {
+				t.Errorf("%s body hash of %q in writes of %d bytes doesn't match that of %q", test.canonicalization, test.body, chunk, test.canonical)
+			}
+		}
+	}
+}
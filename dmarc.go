@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/mail"
+	"strings"
+)
+
+// dmarcPolicy is a DMARC policy record (RFC 7489).
+type dmarcPolicy struct {
+	// domain is the domain the record was found for.
+	domain string
+	tags   map[string]string
+}
+
+// checkDMARC evaluates the DMARC policy of the domain in the From header,
+// given the SPF and DKIM results for the message.
+func checkDMARC(ctx context.Context, header mail.Header, spf authResult, dkim []authResult) authResult {
+	r := authResult{method: "dmarc", result: "none"}
+	from, err := mail.ParseAddressList(header.Get("From"))
+	if err != nil || len(from) != 1 {
+		r.result = "permerror"
+		r.reason = "no single From address"
+		return r
+	}
+	_, domain := splitAddress(from[0].Address)
+	if ascii, err := domainToASCII(domain); err == nil {
+		domain = ascii
+	}
+	domain = strings.ToLower(domain)
+	r.props = []string{"header.from=" + domain}
+	r.domain = domain
+
+	policy, err := lookupDMARC(ctx, domain)
+	if err != nil {
+		r.result = "temperror"
+		r.reason = err.Error()
+		return r
+	}
+	if policy == nil {
+		r.reason = "no policy for " + domain
+		return r
+	}
+
+	p := policy.tags["p"]
+	if sp, ok := policy.tags["sp"]; ok && policy.domain != domain {
+		p = sp
+	}
+	r.reason = "p=" + p
+	r.result = "fail"
+	if spf.result == "pass" && aligned(spf.domain, domain, policy.tags["aspf"] == "s") {
+		r.result = "pass"
+	}
+	for _, d := range dkim {
+		if d.result == "pass" && aligned(d.domain, domain, policy.tags["adkim"] == "s") {
+			r.result = "pass"
+		}
+	}
+	return r
+}
+
+// lookupDMARC returns the DMARC policy for domain, falling back to the
+// policy of its organizational domain. It returns nil when there is none.
+func lookupDMARC(ctx context.Context, domain string) (*dmarcPolicy, error) {
+	candidates := []string{domain}
+	if org := orgDomain(domain); org != domain {
+		candidates = append(candidates, org)
+	}
+	for _, d := range candidates {
+		records, err := lookupTXT(ctx, "_dmarc."+d)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			tags, err := parseTags(record)
+			if err != nil || tags["v"] != "DMARC1" {
+				continue
+			}
+			return &dmarcPolicy{domain: d, tags: tags}, nil
+		}
+	}
+	return nil, nil
+}
+
+// aligned reports whether the authenticated domain is aligned with the From
+// domain, either exactly (strict) or by organizational domain (relaxed).
+func aligned(authenticated, from string, strict bool) bool {
+	authenticated = strings.ToLower(authenticated)
+	if ascii, err := domainToASCII(authenticated); err == nil {
+		authenticated = ascii
+	}
+	if strict {
+		return authenticated == from
+	}
+	return orgDomain(authenticated) == orgDomain(from)
+}
+
+// secondLevelSuffixes lists labels commonly used as second level public
+// suffixes under country code top level domains, as in co.uk or com.au.
+var secondLevelSuffixes = map[string]bool{
+	"ac": true, "co": true, "com": true, "edu": true, "gov": true,
+	"ne": true, "net": true, "or": true, "org": true,
+}
+
+// orgDomain approximates the organizational domain of domain without a
+// public suffix list: the last two labels, or three when the domain is
+// below a second level suffix such as co.uk.
+func orgDomain(domain string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(domain), "."), ".")
+	n := 2
+	if len(labels) > 2 && len(labels[len(labels)-1]) == 2 && secondLevelSuffixes[labels[len(labels)-2]] {
+		n = 3
+	}
+	if len(labels) <= n {
+		return strings.Join(labels, ".")
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+)
+
+// base64LineLength is the length of base64 encoded lines, as required by
+// RFC 2045.
+const base64LineLength = 76
+
+// downgrade8bit converts the message in content to 7-bit, for servers which
+// don't offer 8BITMIME (RFC 6152). 8-bit text parts are re-encoded as
+// quoted-printable, other 8-bit parts as base64, and multipart and
+// message/rfc822 entities are converted part by part. Headers aren't
+// changed, apart from the Content-Transfer-Encoding of converted parts. It
+// reports whether the message was changed.
+func downgrade8bit(content []byte) ([]byte, bool) {
+	if !has8bit(content) {
+		return content, false
+	}
+	converted := downgradeEntity(content)
+	return converted, !bytes.Equal(converted, content)
+}
+
+// has8bit reports whether b holds bytes outside of the 7-bit range.
+func has8bit(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// downgradeEntity converts the MIME entity in content, consisting of a
+// header section and a body, to 7-bit.
+func downgradeEntity(content []byte) []byte {
+	if !has8bit(content) {
+		return content
+	}
+	header, body := splitEntity(content)
+	fields := splitHeaderFields(header)
+	eol := guessLineEnding(header)
+	mediaType, params, err := mime.ParseMediaType(lookupField(fields, "Content-Type"))
+	if err != nil {
+		// RFC 2045 defaults to plain text.
+		mediaType = "text/plain"
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+		return append(withTransferEncoding(fields, "7bit", eol, false), downgradeMultipart(body, params["boundary"])...)
+	case mediaType == "message/rfc822":
+		return append(withTransferEncoding(fields, "7bit", eol, false), downgradeEntity(body)...)
+	case !has8bit(body):
+		return content
+	case strings.HasPrefix(mediaType, "text/"):
+		return append(withTransferEncoding(fields, "quoted-printable", eol, true), encodeQuotedPrintable(body, eol)...)
+	default:
+		return append(withTransferEncoding(fields, "base64", eol, true), encodeBase64(body, eol)...)
+	}
+}
+
+// splitEntity splits content into the header section, including the empty
+// line ending it, and the body.
+func splitEntity(content []byte) (header, body []byte) {
+	for i := 0; i < len(content); {
+		end := bytes.IndexByte(content[i:], '\n')
+		if end < 0 {
+			break
+		}
+		line := content[i : i+end+1]
+		i += end + 1
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return content[:i], content[i:]
+		}
+	}
+	return content, nil
+}
+
+// downgradeMultipart converts the parts of the multipart body with the given
+// boundary to 7-bit. The preamble and epilogue are left as they are.
+func downgradeMultipart(body []byte, boundary string) []byte {
+	delimiter := []byte("--" + boundary)
+	var out []byte
+	// start is the offset of the current part, or -1 before the first
+	// delimiter.
+	start := -1
+	for i := 0; i < len(body); {
+		end := bytes.IndexByte(body[i:], '\n') + 1
+		if end == 0 {
+			end = len(body) - i
+		}
+		line := body[i : i+end]
+		rest := bytes.TrimRight(bytes.TrimPrefix(line, delimiter), " \t\r\n")
+		if bytes.HasPrefix(line, delimiter) && (len(rest) == 0 || string(rest) == "--") {
+			if start < 0 {
+				out = append(out, body[:i]...)
+			} else {
+				// The line ending in front of a delimiter belongs to the
+				// delimiter, not the part.
+				part := body[start:i]
+				content := bytes.TrimSuffix(bytes.TrimSuffix(part, []byte("\n")), []byte("\r"))
+				out = append(append(out, downgradeEntity(content)...), part[len(content):]...)
+			}
+			out = append(out, line...)
+			if len(rest) > 0 {
+				return append(out, body[i+end:]...)
+			}
+			start = i + end
+		}
+		i += end
+	}
+	if start < 0 {
+		return body
+	}
+	// The closing delimiter is missing.
+	return append(out, downgradeEntity(body[start:])...)
+}
+
+// lookupField returns the unfolded value of the first header field with
+// the given name.
+func lookupField(fields [][]byte, name string) string {
+	for _, field := range fields {
+		if strings.EqualFold(headerName(field), name) {
+			return strings.TrimSpace(strings.NewReplacer("\r\n", "", "\n", "").Replace(fieldValue(field)))
+		}
+	}
+	return ""
+}
+
+// withTransferEncoding returns the header section with the given fields and
+// the Content-Transfer-Encoding set to encoding, ending with an empty line.
+// Unless add is set, the encoding is only replaced, not added when missing.
+func withTransferEncoding(fields [][]byte, encoding string, eol []byte, add bool) []byte {
+	var header []byte
+	for _, field := range fields {
+		if strings.EqualFold(headerName(field), "Content-Transfer-Encoding") {
+			add = true
+			continue
+		}
+		header = append(header, field...)
+	}
+	if add {
+		header = append(append(header, "Content-Transfer-Encoding: "+encoding...), eol...)
+	}
+	return append(header, eol...)
+}
+
+// encodeQuotedPrintable encodes body as quoted-printable text, with eol as
+// line ending.
+func encodeQuotedPrintable(body []byte, eol []byte) []byte {
+	var b bytes.Buffer
+	w := quotedprintable.NewWriter(&b)
+	w.Write(body)
+	w.Close()
+	return bytes.ReplaceAll(b.Bytes(), []byte("\r\n"), eol)
+}
+
+// encodeBase64 encodes body as base64, in lines ending with eol.
+func encodeBase64(body []byte, eol []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(body)
+	var out []byte
+	for len(encoded) > base64LineLength {
+		out = append(append(out, encoded[:base64LineLength]...), eol...)
+		encoded = encoded[base64LineLength:]
+	}
+	return append(append(out, encoded...), eol...)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// Severities of processing errors, which tell Postfix whether to bounce the
+// message or to try again later.
+type severity int
+
+const (
+	temporary severity = iota
+	permanent
+)
+
+// processingError is an error which carries the severity of the failure.
+// A non-zero code overrides the exit status implied by the severity, a
+// non-empty status the enhanced status code (RFC 3463) implied by the exit
+// status in LMTP replies.
+type processingError struct {
+	severity severity
+	code     int
+	status   string
+	err      error
+}
+
+func (e *processingError) Error() string {
+	return e.err.Error()
+}
+
+func (e *processingError) Unwrap() error {
+	return e.err
+}
+
+// temporaryError returns an error formatted like fmt.Errorf, for failures
+// which may go away when the message is retried later.
+func temporaryError(format string, a ...interface{}) error {
+	return &processingError{severity: temporary, err: fmt.Errorf(format, a...)}
+}
+
+// permanentError returns an error formatted like fmt.Errorf, for failures
+// caused by the message itself, which will not go away on retries.
+func permanentError(format string, a ...interface{}) error {
+	return &processingError{severity: permanent, err: fmt.Errorf(format, a...)}
+}
+
+// loopError returns an error formatted like fmt.Errorf for a mail loop,
+// which is permanent and exits with EX_UNAVAILABLE, as Postfix does for
+// loops it detects itself.
+func loopError(format string, a ...interface{}) error {
+	return &processingError{severity: permanent, code: ExUnavailable, status: "5.4.6", err: fmt.Errorf(format, a...)}
+}
+
+// noUserError returns an error formatted like fmt.Errorf for a recipient which
+// doesn't accept mail anymore. It's permanent and exits with EX_NOUSER,
+// which Postfix reports as an unknown user.
+func noUserError(format string, a ...interface{}) error {
+	return &processingError{severity: permanent, code: ExNoUser, err: fmt.Errorf(format, a...)}
+}
+
+// replyError returns the error for a failed SMTP or LMTP reply, which is
+// temporary for 4xx replies. Permanent failures with an enhanced status code
+// of 5.1.x (bad destination address) exit with EX_NOUSER, other permanent
+// failures with EX_UNAVAILABLE.
+func replyError(prefix string, reply *textproto.Error) error {
+	err := fmt.Errorf("%s: %w", prefix, reply)
+	status, _, _ := strings.Cut(reply.Msg, " ")
+	if !enhancedStatusPattern.MatchString(status) || status[0] != byte('0'+reply.Code/100) {
+		status = ""
+	}
+	switch {
+	case reply.Code < 500:
+		return &processingError{severity: temporary, status: status, err: err}
+	case strings.HasPrefix(reply.Msg, "5.1."):
+		return &processingError{severity: permanent, code: ExNoUser, status: status, err: err}
+	default:
+		return &processingError{severity: permanent, code: ExUnavailable, status: status, err: err}
+	}
+}
+
+// enhancedStatusPattern matches enhanced status codes, as defined in RFC
+// 3463.
+var enhancedStatusPattern = regexp.MustCompile(`^[245]\.[0-9]{1,3}\.[0-9]{1,3}$`)
+
+// withStatus returns err with the enhanced status code status, which must
+// be of the class matching the severity of err, such as 5.7.1 for a
+// permanent error. Errors without a severity are considered temporary.
+func withStatus(status string, err error) error {
+	var e *processingError
+	if !errors.As(err, &e) {
+		return &processingError{severity: temporary, status: status, err: err}
+	}
+	c := *e
+	c.status = status
+	return &c
+}
+
+// enhancedStatus returns the enhanced status code for err, as given with
+// withStatus, or implied by its exit status.
+func enhancedStatus(err error) string {
+	if errors.Is(err, errMessageTooLarge) {
+		return "5.3.4"
+	}
+	var e *processingError
+	if errors.As(err, &e) && e.status != "" {
+		return e.status
+	}
+	switch exitCode(err) {
+	case ExTempFail:
+		return "4.3.0"
+	case ExNoUser:
+		return "5.1.1"
+	case ExUnavailable:
+		return "5.3.0"
+	default:
+		return "5.6.0"
+	}
+}
+
+// errMessageTooLarge is returned when reading a message exceeding
+// --max-size.
+var errMessageTooLarge = errors.New("message size exceeds --max-size")
+
+// exitCode returns the exit status for err. Errors without a severity are
+// considered temporary. Messages exceeding --max-size are bounced, whichever
+// error the failure to read them was wrapped in.
+func exitCode(err error) int {
+	if errors.Is(err, errMessageTooLarge) {
+		return ExDataErr
+	}
+	var e *processingError
+	if !errors.As(err, &e) || e.severity == temporary {
+		return ExTempFail
+	}
+	if e.code != 0 {
+		return e.code
+	}
+	return ExDataErr
+}
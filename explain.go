@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// explainMessage implements the "explain" subcommand, which shows how the
+// message read from standard input would be handled, using the flags given
+// in front of the subcommand and the recipients given after it. The message
+// is processed as with --dry-run, but instead of the forwarded message, every
+// rule consulted, lookup performed and the final decision are printed. It
+// returns the exit status of the subcommand: 0 when the message was
+// explained, whatever the decision, and 2 on usage errors.
+func explainMessage(args []string) int {
+	set := flag.NewFlagSet("explain", flag.ContinueOnError)
+	if err := set.Parse(args); err != nil {
+		return 2
+	}
+	if err := configure(); err != nil {
+		fmt.Fprintf(os.Stderr, "explain: %s\n", err)
+		return 2
+	}
+	// Explaining a message has no side effects: nothing is delivered,
+	// alerted or counted.
+	*dryRun = true
+	*alertWebhook, *notifyAdmin = "", ""
+	*statsEnabled = false
+
+	msg := newMessageInfo()
+	msg.explaining = true
+	ctx := withMessage(context.Background(), msg)
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	err := forward(ctx, os.Stdin, *origTo, set.Args())
+
+	fmt.Printf("Message %s", msg.queueID)
+	if id := strings.TrimSpace(msg.messageID); id != "" {
+		fmt.Printf(" %s", id)
+	}
+	if msg.returnPath != "" {
+		fmt.Printf(" from %s", msg.returnPath)
+	}
+	fmt.Println()
+	for i, step := range msg.explanation {
+		fmt.Printf("%3d. %s\n", i+1, step)
+	}
+	fmt.Printf("Decision: %s\n", explainDecision(msg, err))
+	return 0
+}
+
+// explainDecision describes the outcome of processing msg, which failed with
+// err, as Postfix would see it.
+func explainDecision(msg *messageInfo, err error) string {
+	if err != nil {
+		verdict := "bounce"
+		if exitCode(err) == ExTempFail {
+			verdict = "defer"
+		}
+		return fmt.Sprintf("%s with exit status %d (%s): %s", verdict, exitCode(err), enhancedStatus(err), err)
+	}
+	if len(msg.recipients) == 0 {
+		return "discard, exit status 0"
+	}
+	return "forward, exit status 0"
+}
+
+// explainMapping describes the result of looking up addr in a map, which
+// returned canonical.
+func explainMapping(addr, canonical string) string {
+	if canonical == addr {
+		return "no entry for " + addr
+	}
+	return addr + " maps to " + canonical
+}
+
+// explainList describes a list of addresses found by a lookup.
+func explainList(addrs []string) string {
+	if len(addrs) == 0 {
+		return "none"
+	}
+	return strings.Join(addrs, ", ")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+)
+
+// isExternal reports whether a message originates outside the internal
+// networks and domains. A message is external when its originating client
+// address is outside the internal networks, or its sender is outside the
+// internal domains. Either check only applies when networks or domains are
+// configured. Locally submitted messages, which have no client address,
+// are considered to originate from an internal network.
+func isExternal(clientIP net.IP, sender string, networks hostList, domains []string) bool {
+	if len(networks.nets) > 0 && clientIP != nil && !networks.containsIP(clientIP) {
+		return true
+	}
+	if len(domains) > 0 {
+		_, domain := splitAddress(sender)
+		for _, d := range domains {
+			if strings.EqualFold(domain, d) || strings.HasSuffix(strings.ToLower(domain), "."+strings.ToLower(d)) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// subjectTagger returns a headerFilter which prefixes the Subject header
+// with tag, unless the subject already contains it.
+func subjectTagger(tag string) headerFilter {
+	return func(field []byte) []byte {
+		if !isHeader(field, []string{"Subject"}) || bytes.Contains(field, []byte(tag)) {
+			return field
+		}
+		i := bytes.IndexByte(field, ':') + 1
+		value := bytes.TrimLeft(field[i:], " \t")
+		tagged := append(field[:i:i], ' ')
+		tagged = append(tagged, tag...)
+		tagged = append(tagged, ' ')
+		return append(tagged, value...)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// storeFallback stores the message forwarded in sub, read from content, in
+// the --fallback-maildir after delivering it failed with reason. The
+// envelope is recorded in X-Envelope-From and X-Envelope-To headers, so the
+// message can be re-injected once delivery works again.
+func storeFallback(ctx context.Context, sub *submission, content io.Reader, reason error) error {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	eol := string(guessLineEnding(data[:strings.IndexByte(string(data), '\n')+1]))
+	envelope := fmt.Sprintf("X-Envelope-From: <%s>%sX-Envelope-To: %s%s",
+		sub.returnPath, eol, strings.Join(sub.recipients, ", "), eol)
+	if err := deliverMaildir(ctx, *fallbackMaildir, io.MultiReader(strings.NewReader(envelope), bytes.NewReader(data))); err != nil {
+		return err
+	}
+	warnf(ctx, "delivery to %s failed, stored the message in %s instead: %s",
+		strings.Join(sub.recipients, ", "), *fallbackMaildir, reason)
+	notifyFallback(ctx, reason.Error())
+	return nil
+}
+
+// notifyFallback notifies the admin address and the alert webhook, if
+// configured, that the current message was stored in --fallback-maildir.
+// Webhook alerts are sent at most once per --alert-window, which requires
+// --state-dir to keep track of previous alerts.
+func notifyFallback(ctx context.Context, reason string) {
+	if *notifyAdmin != "" {
+		notify(ctx, "Postforward: message stored locally",
+			fmt.Sprintf("Postforward was unable to forward a message, it was stored in\n%s instead.", *fallbackMaildir), reason)
+	}
+	if *alertWebhook == "" || !stateConfigured() {
+		return
+	}
+	if ok, err := once("fallback-alert", *alertWindow); err != nil || !ok {
+		if err != nil {
+			warnf(ctx, "unable to record fallback alert: %s", err)
+		}
+		return
+	}
+	alert(ctx, fmt.Sprintf("Postforward on %s: delivery is failing, messages are stored in %s. Latest error: %s",
+		getHostname(ctx), *fallbackMaildir, reason))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// faultInjection enables the --fault flag when set to "yes" at build time,
+// as make build-faults does with -ldflags "-X main.faultInjection=yes".
+// Regular builds don't have the flag, so faults can't be injected in
+// production by mistake.
+var faultInjection string
+
+// The faults injected with --fault.
+var (
+	// faultSRSLatency delays SRS daemon lookups.
+	faultSRSLatency time.Duration
+	// faultSRSErrorRate is the share of SRS daemon lookups failing.
+	faultSRSErrorRate float64
+	// faultSMTPLatency delays SMTP and LMTP deliveries.
+	faultSMTPLatency time.Duration
+	// faultSMTP4xxRate and faultSMTP5xxRate are the shares of SMTP and
+	// LMTP deliveries rejected temporarily and permanently.
+	faultSMTP4xxRate float64
+	faultSMTP5xxRate float64
+)
+
+func init() {
+	if faultInjection == "yes" {
+		flag.Var(&faultFlag{}, "fault", "inject a fault for resilience testing: srs-latency=DURATION, srs-error-rate=RATE, smtp-latency=DURATION, smtp-4xx-rate=RATE or smtp-5xx-rate=RATE (may be repeated)")
+	}
+}
+
+// faultFlag is the value of --fault, which sets the fault variables.
+type faultFlag struct {
+	specs []string
+}
+
+func (f *faultFlag) String() string {
+	return strings.Join(f.specs, ",")
+}
+
+func (f *faultFlag) Set(value string) error {
+	name, arg, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected name=value, got %q", value)
+	}
+	durations := map[string]*time.Duration{
+		"srs-latency":  &faultSRSLatency,
+		"smtp-latency": &faultSMTPLatency,
+	}
+	rates := map[string]*float64{
+		"srs-error-rate": &faultSRSErrorRate,
+		"smtp-4xx-rate":  &faultSMTP4xxRate,
+		"smtp-5xx-rate":  &faultSMTP5xxRate,
+	}
+	switch {
+	case durations[name] != nil:
+		d, err := time.ParseDuration(arg)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid duration %q", arg)
+		}
+		*durations[name] = d
+	case rates[name] != nil:
+		rate, err := strconv.ParseFloat(arg, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return fmt.Errorf("invalid rate %q, expected a number from 0 to 1", arg)
+		}
+		*rates[name] = rate
+	default:
+		return fmt.Errorf("unknown fault %q", name)
+	}
+	f.specs = append(f.specs, value)
+	return nil
+}
+
+// faultOccurs reports whether a fault injected at the given rate occurs.
+func faultOccurs(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+// injectLatency waits for d, or until ctx is done.
+func injectLatency(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	debugf(ctx, "injecting %s of latency", d)
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// srsFault injects the SRS faults of --fault into a daemon lookup.
+func srsFault(ctx context.Context) error {
+	if err := injectLatency(ctx, faultSRSLatency); err != nil {
+		return err
+	}
+	if faultOccurs(faultSRSErrorRate) {
+		return fmt.Errorf("injected fault")
+	}
+	return nil
+}
+
+// smtpFault injects the SMTP faults of --fault into a delivery. A rejection
+// is returned as the reply a server would have sent.
+func smtpFault(ctx context.Context) error {
+	if err := injectLatency(ctx, faultSMTPLatency); err != nil {
+		return err
+	}
+	switch {
+	case faultOccurs(faultSMTP4xxRate):
+		return &textproto.Error{Code: 451, Msg: "4.3.0 Injected fault"}
+	case faultOccurs(faultSMTP5xxRate):
+		return &textproto.Error{Code: 554, Msg: "5.3.0 Injected fault"}
+	}
+	return nil
+}
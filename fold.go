@@ -0,0 +1,68 @@
+package main
+
+import "bytes"
+
+// Header line lengths from RFC 5322: lines must not be longer than
+// maxLineLength octets, and should not be longer than foldLineLength
+// characters, excluding the line ending.
+const (
+	maxLineLength  = 998
+	foldLineLength = 78
+)
+
+// foldField folds the lines of a header field which are longer than limit
+// octets, inserting line breaks in front of whitespace so the resulting
+// lines are at most foldLineLength long where possible. Lines without
+// suitable whitespace are left intact.
+func foldField(field []byte, limit int) []byte {
+	eol := guessLineEnding(field)
+	var out []byte
+	for _, line := range bytes.SplitAfter(field, []byte("\n")) {
+		content := bytes.TrimRight(line, "\r\n")
+		ending := line[len(content):]
+		if len(content) <= limit {
+			out = append(out, line...)
+			continue
+		}
+		for len(content) > foldLineLength {
+			i := foldPoint(content)
+			if i < 0 {
+				break
+			}
+			out = append(append(out, content[:i]...), eol...)
+			content = content[i:]
+		}
+		out = append(append(out, content...), ending...)
+	}
+	return out
+}
+
+// foldPoint returns the position of the whitespace to fold line at: the
+// last one within foldLineLength, or the first one after it. Leading and
+// trailing whitespace don't count, as folding there would leave a line of
+// only whitespace. It returns -1 when the line can't be folded.
+func foldPoint(line []byte) int {
+	start := len(line) - len(bytes.TrimLeft(line, " \t"))
+	point := -1
+	for i := start + 1; i < len(line); i++ {
+		if !isWSP(rune(line[i])) || isWSP(rune(line[i-1])) || len(bytes.TrimLeft(line[i:], " \t")) == 0 {
+			continue
+		}
+		if i > foldLineLength && point >= 0 {
+			break
+		}
+		point = i
+		if i > foldLineLength {
+			break
+		}
+	}
+	return point
+}
+
+// headerFolder returns a headerFilter which folds header lines longer than
+// maxLineLength octets.
+func headerFolder() headerFilter {
+	return func(field []byte) []byte {
+		return foldField(field, maxLineLength)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// greylistEntry records when a sender/recipient pair was first and last
+// seen, and whether it has passed greylisting.
+type greylistEntry struct {
+	first, last time.Time
+	passed      bool
+}
+
+// greylist checks the sender/recipient pair against the greylist database
+// in --state-dir. The first attempt for an unknown pair is deferred, later
+// attempts pass once --greylist-delay has elapsed. Pairs which don't retry
+// within --greylist-retry-window after the delay are forgotten, as are passed
+// pairs which haven't been seen for --greylist-lifetime.
+//
+// It returns a non-nil error describing why the message is deferred.
+func greylist(sender, recipient string) (deferred error, err error) {
+	f, err := lockedFile("greylist")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	now := clk.Now()
+	entries := map[string]*greylistEntry{}
+	var keys []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 5 {
+			continue
+		}
+		first, err1 := strconv.ParseInt(fields[2], 10, 64)
+		last, err2 := strconv.ParseInt(fields[3], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		e := &greylistEntry{time.Unix(first, 0), time.Unix(last, 0), fields[4] == "1"}
+		if e.passed && now.Sub(e.last) > *greylistLifetime ||
+			!e.passed && now.Sub(e.first) > *greylistDelay+*greylistRetryWindow {
+			continue
+		}
+		key := fields[0] + " " + fields[1]
+		if _, ok := entries[key]; !ok {
+			keys = append(keys, key)
+		}
+		entries[key] = e
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Sender and recipient are stored as fields, so they may not be empty
+	// or contain whitespace.
+	key := greylistField(sender) + " " + greylistField(recipient)
+	e, ok := entries[key]
+	switch {
+	case !ok:
+		entries[key] = &greylistEntry{first: now, last: now}
+		keys = append(keys, key)
+		deferred = fmt.Errorf("greylisted, please try again in %s", *greylistDelay)
+	case !e.passed && now.Sub(e.first) < *greylistDelay:
+		e.last = now
+		deferred = fmt.Errorf("greylisted, please try again in %s", (*greylistDelay - now.Sub(e.first)).Round(time.Second))
+	default:
+		e.passed, e.last = true, now
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	for _, k := range keys {
+		e := entries[k]
+		passed := 0
+		if e.passed {
+			passed = 1
+		}
+		fmt.Fprintf(w, "%s %d %d %d\n", k, e.first.Unix(), e.last.Unix(), passed)
+	}
+	return deferred, w.Flush()
+}
+
+// greylistField returns s in a form which can be stored as a single field
+// of the greylist database.
+func greylistField(s string) string {
+	s = strings.Join(strings.Fields(strings.ToLower(s)), "")
+	if s == "" {
+		return "<>"
+	}
+	return s
+}
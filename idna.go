@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+// Punycode parameters as defined in RFC 3492 section 5.
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+	// acePrefix marks labels which have been converted to A-labels.
+	acePrefix = "xn--"
+)
+
+var errPunycode = errors.New("idna: invalid punycode")
+
+// domainToASCII converts all U-labels in domain to their A-label form.
+// Labels which are already ASCII are returned unchanged, non-ASCII labels
+// are lowercased before conversion.
+//
+// This is a subset of the IDNA2008 / UTS #46 processing: no Unicode
+// normalization or validation of code points is performed. Domains
+// received in mail are expected to have been normalized by the sender.
+func domainToASCII(domain string) (string, error) {
+	if isASCII(domain) {
+		return domain, nil
+	}
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		encoded, err := punyEncode(strings.ToLower(label))
+		if err != nil {
+			return "", err
+		}
+		labels[i] = acePrefix + encoded
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// domainToUnicode converts all A-labels in domain to their U-label form for
+// display. Labels which can't be decoded are returned unchanged.
+func domainToUnicode(domain string) string {
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if len(label) <= len(acePrefix) || !strings.EqualFold(label[:len(acePrefix)], acePrefix) {
+			continue
+		}
+		if decoded, err := punyDecode(strings.ToLower(label[len(acePrefix):])); err == nil {
+			labels[i] = decoded
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// addressToASCII converts the domain of addr to its A-label form.
+func addressToASCII(addr string) (string, error) {
+	local, domain := splitAddress(addr)
+	if domain == "" || isASCII(domain) {
+		return addr, nil
+	}
+	domain, err := domainToASCII(domain)
+	if err != nil {
+		return "", err
+	}
+	return local + "@" + domain, nil
+}
+
+// displayAddresses converts A-labels in the domains of all addresses found
+// in the header value v back to U-labels, for use in display text.
+func displayAddresses(v string) string {
+	addrs, err := mail.ParseAddressList(v)
+	if err != nil {
+		return v
+	}
+	for _, addr := range addrs {
+		local, domain := splitAddress(addr.Address)
+		if display := domainToUnicode(domain); display != domain {
+			v = string(replaceAddress([]byte(v), addr.Address, local+"@"+display))
+		}
+	}
+	return v
+}
+
+// isASCII reports whether s consists of ASCII characters only.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// punyAdapt is the bias adaptation function from RFC 3492 section 6.1.
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+// punyThreshold returns the threshold t for position k given the bias.
+func punyThreshold(k, bias int) int {
+	switch {
+	case k <= bias:
+		return punyTMin
+	case k >= bias+punyTMax:
+		return punyTMax
+	}
+	return k - bias
+}
+
+// punyEncode encodes a label using the Punycode algorithm of RFC 3492
+// section 6.3. The ACE prefix is not added.
+func punyEncode(label string) (string, error) {
+	input := []rune(label)
+	var out []byte
+	for _, r := range input {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	b := len(out)
+	h := b
+	if b > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for h < len(input) {
+		m := int(utf8.MaxRune) + 1
+		for _, r := range input {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		if (m - n) > (1<<31-1-delta)/(h+1) {
+			return "", errPunycode
+		}
+		delta += (m - n) * (h + 1)
+		n = m
+		for _, r := range input {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := punyThreshold(k, bias)
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, h+1, h == b)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(out), nil
+}
+
+// punyDecode decodes a Punycode label as described in RFC 3492 section 6.2.
+// The ACE prefix must already have been removed.
+func punyDecode(encoded string) (string, error) {
+	var out []rune
+	pos := 0
+	if b := strings.LastIndex(encoded, "-"); b >= 0 {
+		for i := 0; i < b; i++ {
+			if encoded[i] >= utf8.RuneSelf {
+				return "", errPunycode
+			}
+			out = append(out, rune(encoded[i]))
+		}
+		pos = b + 1
+	}
+
+	n, i, bias := punyInitialN, 0, punyInitialBias
+	for pos < len(encoded) {
+		oldi, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if pos >= len(encoded) {
+				return "", errPunycode
+			}
+			digit, ok := punyDigitValue(encoded[pos])
+			pos++
+			if !ok || digit > (1<<31-1-i)/w {
+				return "", errPunycode
+			}
+			i += digit * w
+			t := punyThreshold(k, bias)
+			if digit < t {
+				break
+			}
+			w *= punyBase - t
+		}
+		bias = punyAdapt(i-oldi, len(out)+1, oldi == 0)
+		n += i / (len(out) + 1)
+		i %= len(out) + 1
+		if n > utf8.MaxRune {
+			return "", errPunycode
+		}
+		out = append(out, 0)
+		copy(out[i+1:], out[i:])
+		out[i] = rune(n)
+		i++
+	}
+	return string(out), nil
+}
+
+// punyDigit returns the basic code point for digit d (0-35).
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+// punyDigitValue returns the numeric value of the basic code point c.
+func punyDigitValue(c byte) (int, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return int(c-'0') + 26, true
+	case 'a' <= c && c <= 'z':
+		return int(c - 'a'), true
+	case 'A' <= c && c <= 'Z':
+		return int(c - 'A'), true
+	}
+	return 0, false
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Actions when keeping a local copy of a message fails.
+const (
+	// keepCopyDefer defers the message, so both the copy and the forwarded
+	// message are retried.
+	keepCopyDefer = "defer"
+	// keepCopyIgnore forwards the message anyway, only logging the failure.
+	keepCopyIgnore = "ignore"
+)
+
+// keepCopyLifetime is how long copies are remembered, so a message which is
+// retried after its copy was kept isn't stored twice. It exceeds the default
+// Postfix maximal_queue_lifetime.
+const keepCopyLifetime = 7 * 24 * time.Hour
+
+// keepCopy delivers a copy of the message in the file original, before any
+// rewriting, to the local mailbox given by --keep-copy. Mailbox paths ending
+// in a slash are Maildirs, other paths mbox files, as with Postfix
+// home_mailbox. An lmtp:// URL delivers the copy to recipient via LMTP.
+//
+// With --state-dir, copies are recorded by the digest of the message, and a
+// message which was already stored isn't stored again when it's retried.
+func keepCopy(ctx context.Context, original *os.File, digest []byte, recipient string) error {
+	msg := messageFrom(ctx)
+	store := func() error {
+		content, err := originalContent(original)
+		if err != nil {
+			return err
+		}
+		sender := strings.Trim(msg.returnPath, "<>")
+		switch {
+		case strings.HasPrefix(*keepCopySpec, "lmtp://"):
+			if recipient == "" {
+				return fmt.Errorf("delivery via LMTP requires --orig-to")
+			}
+			delivery, err := parseDelivery(*keepCopySpec, *deliverTLS, *deliverPasswordFile, *downgrade8bitFlag)
+			if err != nil {
+				return err
+			}
+			return delivery.deliver(ctx, getHostname(ctx), sender, []string{recipient}, content)
+		case strings.HasSuffix(*keepCopySpec, "/"):
+			return deliverMaildir(ctx, *keepCopySpec, content)
+		default:
+			return deliverMbox(*keepCopySpec, sender, msg.arrival, content)
+		}
+	}
+	if !stateConfigured() {
+		if err := store(); err != nil {
+			return err
+		}
+	} else if stored, err := storeOnce(fmt.Sprintf("%x", digest), store); err != nil {
+		return err
+	} else if !stored {
+		infof(ctx, "a copy was already kept in %s", *keepCopySpec)
+		return nil
+	}
+	infof(ctx, "kept a copy in %s", *keepCopySpec)
+	return nil
+}
+
+// originalContent returns a reader streaming the message in the file
+// original, as spooled before any rewriting.
+func originalContent(original *os.File) (io.Reader, error) {
+	info, err := original.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(io.NewSectionReader(original, 0, info.Size()))
+	// The envelope line inserted by Postfix isn't part of the message.
+	if head, err := r.Peek(len("From ")); err == nil && string(head) == "From " {
+		if _, err := r.ReadString('\n'); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// storeOnce calls store unless it already succeeded for the message with the
+// given key within keepCopyLifetime, as recorded in --state-dir. Entries
+// older than that are forgotten. It reports whether store was called.
+//
+// The state is only locked while it's read and updated, so a slow mailbox
+// doesn't hold up other messages. Should the same message be processed
+// twice at once, both copies are kept.
+func storeOnce(key string, store func() error) (bool, error) {
+	kept, err := recordedKey("keep-copy", key, keepCopyLifetime)
+	if err != nil || kept {
+		return false, err
+	}
+	if err := store(); err != nil {
+		return false, err
+	}
+	return true, recordKey("keep-copy", key, keepCopyLifetime)
+}
+
+// deliverMaildir delivers the message read from content into the Maildir at dir, which is created
+// when it doesn't exist yet. The message is written to tmp/ and moved into
+// new/ once it's complete. With --metadata-sidecar, the processing record is
+// written next to it once processing finished, see writeSidecars.
+func deliverMaildir(ctx context.Context, dir string, content io.Reader) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	host := strings.NewReplacer("/", `\057`, ":", `\072`).Replace(getHostname(ctx))
+	name := fmt.Sprintf("%d.P%d_%s.%s", clk.Now().Unix(), os.Getpid(), messageFrom(ctx).queueID, host)
+	tmp := filepath.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, "new", name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if *metadataSidecar {
+		msg := messageFrom(ctx)
+		msg.sidecars = append(msg.sidecars, filepath.Join(dir, metadataDir, name+".json"))
+	}
+	return nil
+}
+
+// deliverMbox appends the message read from content to the mbox file at path, with a From line for
+// the given sender and arrival time. Lines starting with "From " are quoted
+// as in the mboxrd format. The file is locked while writing, and a partially
+// written message is removed again.
+func deliverMbox(path, sender string, arrival time.Time, content io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	if sender == "" {
+		sender = "MAILER-DAEMON"
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "From %s %s\n", sender, arrival.UTC().Format(time.ANSIC))
+	r := bufio.NewReader(content)
+	var last byte
+	for {
+		line, rerr := r.ReadBytes('\n')
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			w.WriteByte('>')
+		}
+		w.Write(line)
+		if len(line) > 0 {
+			last = line[len(line)-1]
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			f.Truncate(size)
+			return rerr
+		}
+	}
+	if last != '\n' {
+		w.WriteByte('\n')
+	}
+	w.WriteByte('\n')
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Truncate(size)
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestOriginalContent checks that the envelope line inserted by Postfix is
+// removed from kept copies.
+func TestOriginalContent(t *testing.T) {
+	tests := []struct {
+		spooled, content string
+	}{
+		{"From sender@example.org  Sat Jan  1 00:00:00 2000\n" + testMessage, testMessage},
+		{testMessage, testMessage},
+		{"From sender@example.org", ""},
+		{"Fro", "Fro"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		f, err := os.CreateTemp(t.TempDir(), "original")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(test.spooled); err != nil {
+			t.Fatal(err)
+		}
+		r, err := originalContent(f)
+		if err != nil {
+			t.Fatalf("originalContent(%q) failed: %s", test.spooled, err)
+		}
+		if data, err := io.ReadAll(r); err != nil || string(data) != test.content {
+			t.Errorf("originalContent(%q) yields %q, %v", test.spooled, data, err)
+		}
+	}
+}
+
+// TestDeliverMbox checks that messages are appended to mbox files with From
+// lines quoted as in the mboxrd format.
+func TestDeliverMbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mbox")
+	arrival := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	messages := []struct {
+		sender, content string
+	}{
+		{"sender@example.org", "Subject: one\n\nFrom here\n>From there\n"},
+		{"", "Subject: two\n\nno final newline"},
+	}
+	for _, m := range messages {
+		if err := deliverMbox(path, m.sender, arrival, strings.NewReader(m.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "From sender@example.org Sat Jan  1 00:00:00 2000\n" +
+		"Subject: one\n\n>From here\n>>From there\n\n" +
+		"From MAILER-DAEMON Sat Jan  1 00:00:00 2000\n" +
+		"Subject: two\n\nno final newline\n\n"
+	if string(data) != want {
+		t.Errorf("mbox holds %q, expected %q", data, want)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// defaultLane is the priority lane of messages matching no --lane
+// condition.
+const defaultLane = "default"
+
+// laneCondition selects the messages of a priority lane: those of at least
+// minSize bytes, from sender, or with the given header field. sender is an
+// address or an @domain, and a header field matches when its value contains
+// value, or with any value when value is empty.
+type laneCondition struct {
+	lane    string
+	minSize int64
+	sender  string
+	header  string
+	value   string
+}
+
+// matches reports whether the condition selects the message from sender
+// with the given header, of size bytes.
+func (c laneCondition) matches(sender string, header mail.Header, size int64) bool {
+	switch {
+	case c.minSize > 0:
+		return size >= c.minSize
+	case strings.HasPrefix(c.sender, "@"):
+		_, domain := splitAddress(sender)
+		return strings.EqualFold("@"+domain, c.sender)
+	case c.sender != "":
+		return strings.EqualFold(sender, c.sender)
+	}
+	for _, v := range header[textproto.CanonicalMIMEHeaderKey(c.header)] {
+		if strings.Contains(strings.ToLower(v), strings.ToLower(c.value)) {
+			return true
+		}
+	}
+	return false
+}
+
+// laneSet holds the priority lanes of daemon mode. Every lane has its own
+// pool of concurrency slots, so messages waiting for one lane don't hold up
+// those of another. A nil laneSet puts every message in the default lane,
+// without a limit.
+type laneSet struct {
+	conditions []laneCondition
+	// slots holds a semaphore for every lane with a concurrency limit.
+	slots map[string]chan struct{}
+}
+
+// parseLanes parses the --lane conditions, of the form lane:size>N,
+// lane:sender=ADDRESS, lane:header=NAME or lane:header=NAME:VALUE, and the
+// lane=n entries of --lane-concurrency. Conditions are tried in order.
+func parseLanes(specs []string, concurrency string) (*laneSet, error) {
+	if len(specs) == 0 && concurrency == "" {
+		return nil, nil
+	}
+	l := &laneSet{slots: map[string]chan struct{}{}}
+	known := map[string]bool{defaultLane: true}
+	for _, spec := range specs {
+		name, cond, ok := strings.Cut(spec, ":")
+		name, cond = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(cond)
+		if !ok || name == "" || name == defaultLane {
+			return nil, fmt.Errorf("invalid lane %q, expected lane:condition", spec)
+		}
+		c := laneCondition{lane: name}
+		switch key, value, _ := strings.Cut(cond, "="); {
+		case strings.HasPrefix(cond, "size>"):
+			size, err := parseSize(cond[len("size>"):])
+			if err != nil || size == 0 {
+				return nil, fmt.Errorf("invalid size in lane %q", spec)
+			}
+			c.minSize = size
+		case key == "sender" && value != "":
+			c.sender = value
+		case key == "header" && value != "":
+			c.header, c.value, _ = strings.Cut(value, ":")
+			c.header = strings.TrimSpace(c.header)
+			c.value = strings.TrimSpace(c.value)
+		default:
+			return nil, fmt.Errorf("invalid condition in lane %q, expected size>N, sender=ADDRESS or header=NAME[:VALUE]", spec)
+		}
+		l.conditions = append(l.conditions, c)
+		known[name] = true
+	}
+	err := parseDomainList(concurrency, func(name, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid concurrency %q", value)
+		}
+		if !known[name] {
+			return fmt.Errorf("unknown lane %q", name)
+		}
+		l.slots[name] = make(chan struct{}, n)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// classify returns the lane of the message data from sender, as received
+// via LMTP.
+func (l *laneSet) classify(sender string, data []byte) string {
+	if l == nil {
+		return defaultLane
+	}
+	var header mail.Header
+	if m, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+		header = m.Header
+	}
+	for _, c := range l.conditions {
+		if c.matches(sender, header, int64(len(data))) {
+			return c.lane
+		}
+	}
+	return defaultLane
+}
+
+// acquire waits for a concurrency slot of the given lane, or until ctx is
+// done. The returned function releases the slot, and must be called once the
+// message is forwarded.
+func (l *laneSet) acquire(ctx context.Context, lane string) (release func(), err error) {
+	if l == nil || l.slots[lane] == nil {
+		return func() {}, nil
+	}
+	slots := l.slots[lane]
+	select {
+	case slots <- struct{}{}:
+	default:
+		debugf(ctx, "lane %s is busy, waiting", lane)
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return func() { <-slots }, nil
+}
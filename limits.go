@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// memoryCheckInterval is how often memory usage is sampled when a memory
+// limit is in effect.
+const memoryCheckInterval = 50 * time.Millisecond
+
+// parseSize parses a size in bytes with an optional k, M or G suffix (powers
+// of 1024), such as "512k" or "64M".
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'k', 'K':
+			mult = 1 << 10
+		case 'm', 'M':
+			mult = 1 << 20
+		case 'g', 'G':
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// maxHeaderSize bounds the header section of messages, which is held in
+// memory while the body is streamed. It's well above the Postfix
+// header_size_limit.
+const maxHeaderSize = 1 << 20
+
+// messageSizeLimit is the --max-size limit in bytes, or 0 for no limit.
+var messageSizeLimit int64
+
+// sizeLimiter reads from r, failing with errMessageTooLarge once more than
+// limit bytes were read.
+type sizeLimiter struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func (l *sizeLimiter) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if l.n += int64(n); l.n > l.limit {
+		return n, fmt.Errorf("%w of %d bytes", errMessageTooLarge, l.limit)
+	}
+	return n, err
+}
+
+// limitCPUTime limits the CPU time available to this process, and thus to
+// the processing of a single message. The soft limit is enforced using
+// RLIMIT_CPU, turning the resulting SIGXCPU into a temporary failure which is
+// passed to exceeded. The hard limit leaves a little slack for exiting
+// cleanly.
+func limitCPUTime(limit time.Duration, exceeded func(error)) error {
+	soft := uint64((limit + time.Second - 1) / time.Second)
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_CPU, &rlim); err != nil {
+		return err
+	}
+	setRlimit(&rlim.Cur, soft)
+	setRlimit(&rlim.Max, soft+2)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGXCPU)
+	if err := syscall.Setrlimit(syscall.RLIMIT_CPU, &rlim); err != nil {
+		signal.Stop(signals)
+		return err
+	}
+	go func() {
+		<-signals
+		exceeded(temporaryError("CPU time limit of %s exceeded", limit))
+	}()
+	return nil
+}
+
+// setRlimit stores v in an rlimit field, whose type differs between
+// operating systems.
+func setRlimit[T ~int64 | ~uint64](field *T, v uint64) {
+	*field = T(v)
+}
+
+// limitMemory limits the memory used while processing a message. Exceeding
+// an RLIMIT_AS or RLIMIT_DATA limit is fatal to the Go runtime, which can't
+// be turned into a clean exit status, so the limit is enforced by sampling
+// the memory obtained from the operating system instead. The garbage
+// collector is told about the limit so it works harder to stay below it.
+// Exceeding the limit passes a temporary failure to exceeded.
+func limitMemory(limit int64, exceeded func(error)) {
+	debug.SetMemoryLimit(limit)
+	go func() {
+		var stats runtime.MemStats
+		for range time.Tick(memoryCheckInterval) {
+			runtime.ReadMemStats(&stats)
+			if used := int64(stats.Sys - stats.HeapReleased); used > limit {
+				exceeded(temporaryError("Memory limit of %d bytes exceeded (%d bytes in use)", limit, used))
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Log formats, selected with --log.
+const (
+	// logStderr writes plain lines to stderr, which Postfix includes in
+	// its own logs and in bounces.
+	logStderr = "stderr"
+	logSyslog = "syslog"
+	logJSON   = "json"
+)
+
+// logger writes records in the structured log formats. It is nil when
+// logging to stderr.
+var logger *slog.Logger
+
+// logLevel is the minimum level of records written.
+var logLevel = slog.LevelInfo
+
+// setupLogging sets up logging as configured by --log and --log-level.
+func setupLogging() error {
+	switch strings.ToLower(*logLevelFlag) {
+	case "debug":
+		logLevel = slog.LevelDebug
+	case "info":
+		logLevel = slog.LevelInfo
+	case "warning", "warn":
+		logLevel = slog.LevelWarn
+	case "error":
+		logLevel = slog.LevelError
+	default:
+		return fmt.Errorf("invalid --log-level %q, expected debug, info, warning or error", *logLevelFlag)
+	}
+
+	switch *logFormat {
+	case logStderr:
+		logger = nil
+	case logJSON:
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if a.Key == slog.TimeKey && len(groups) == 0 {
+					return slog.Time(slog.TimeKey, clk.Now())
+				}
+				return a
+			},
+		}))
+	case logSyslog:
+		w, err := syslog.New(syslog.LOG_MAIL|syslog.LOG_INFO, "postforward")
+		if err != nil {
+			return fmt.Errorf("unable to connect to syslog: %w", err)
+		}
+		logger = slog.New(syslogHandler{w: w})
+	default:
+		return fmt.Errorf("invalid --log %q, expected stderr, syslog or json", *logFormat)
+	}
+	return nil
+}
+
+// logRecord logs msg at the given level, with the given fields. On stderr,
+// the fields are left out and the message is prefixed with the queue ID of
+// the message processed in ctx. The structured formats include the queue ID,
+// Message-ID and return-path of the message as fields. Records about a
+// message being explained are added to its explanation, whatever their
+// level.
+func logRecord(ctx context.Context, level slog.Level, msg string, attrs ...slog.Attr) {
+	m := messageFrom(ctx)
+	if m.explaining {
+		if level >= slog.LevelWarn {
+			msg = "warning: " + msg
+		}
+		m.explanation = append(m.explanation, msg)
+		return
+	}
+	if level < logLevel {
+		return
+	}
+	if logger == nil {
+		switch level {
+		case slog.LevelDebug:
+			msg = "debug: " + msg
+		case slog.LevelWarn:
+			msg = "warning: " + msg
+		}
+		if m.queueID != "" {
+			msg = m.queueID + ": " + msg
+		}
+		fmt.Fprintln(os.Stderr, msg)
+		return
+	}
+	if m.queueID != "" {
+		attrs = append([]slog.Attr{
+			slog.String("queue_id", m.queueID),
+			slog.String("message_id", m.messageID),
+			slog.String("return_path", m.returnPath),
+		}, attrs...)
+	}
+	logger.LogAttrs(ctx, level, msg, attrs...)
+}
+
+// logForwarded logs the outcome of submitting the message in ctx to sub,
+// with fields to trace it by. Only the structured formats write it, on
+// stderr Postfix would include it in the diagnostics of the message.
+func logForwarded(ctx context.Context, sub *submission, err error) {
+	if logger == nil {
+		return
+	}
+	via := "sendmail"
+	if *deliver != "" {
+		via = *deliver
+	}
+	attrs := []slog.Attr{
+		slog.String("rewritten_return_path", sub.returnPath),
+		slog.Any("recipients", sub.recipients),
+		slog.String("via", via),
+		slog.Duration("duration", clk.Now().Sub(messageFrom(ctx).arrival)),
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		attrs = append(attrs, slog.Int("status", exitErr.ExitCode()))
+	case err == nil && *deliver == "":
+		attrs = append(attrs, slog.Int("status", 0))
+	}
+	if err != nil {
+		logRecord(ctx, slog.LevelError, "forwarding failed", append(attrs, slog.String("error", err.Error()))...)
+		return
+	}
+	logRecord(ctx, slog.LevelInfo, "forwarded", attrs...)
+}
+
+// syslogHandler writes records to syslog in the style of Postfix: the queue
+// ID, the message and the fields as comma-separated key=value pairs.
+type syslogHandler struct {
+	w     *syslog.Writer
+	attrs []slog.Attr
+}
+
+func (h syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+func (h syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	var queueID string
+	parts := []string{r.Message}
+	add := func(a slog.Attr) bool {
+		switch {
+		case a.Key == "queue_id":
+			queueID = a.Value.String()
+		case a.Value.String() != "":
+			parts = append(parts, a.Key+"="+syslogValue(a.Value))
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		add(a)
+	}
+	r.Attrs(add)
+	line := strings.Join(parts, ", ")
+	if queueID != "" {
+		line = queueID + ": " + line
+	}
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.w.Err(line)
+	case r.Level >= slog.LevelWarn:
+		return h.w.Warning(line)
+	case r.Level >= slog.LevelInfo:
+		return h.w.Info(line)
+	default:
+		return h.w.Debug(line)
+	}
+}
+
+func (h syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return syslogHandler{w: h.w, attrs: append(append([]slog.Attr(nil), h.attrs...), attrs...)}
+}
+
+func (h syslogHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+// syslogValue formats a field value for syslog. Lists are comma-separated,
+// other values with spaces, commas or quotes are quoted.
+func syslogValue(v slog.Value) string {
+	if list, ok := v.Any().([]string); ok {
+		return strings.Join(list, ",")
+	}
+	s := v.String()
+	if strings.ContainsAny(s, " ,\"") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// loopHeader is the header field recording the addresses a message was
+// forwarded for, when --detect-loops is enabled.
+const loopHeader = "X-Loop"
+
+// detectLoop returns an error when forwarding the message with the given
+// header would make it loop: when it has more than --max-hops Received
+// headers, or with --detect-loops, when it was already forwarded for origTo.
+// Postfix adds one Delivered-To header for origTo when delivering to
+// postforward, any further one means the message came back. recorded is the
+// form of origTo in the header fields added by postforward, as returned by
+// privateAddress with --private-destination.
+func detectLoop(header mail.Header, origTo, recorded string) error {
+	if hops := len(header["Received"]); *maxHops > 0 && hops >= *maxHops {
+		return loopError("Mail forwarding loop detected: message has %d Received headers, the limit is --max-hops %d", hops, *maxHops)
+	}
+	if !*detectLoops {
+		return nil
+	}
+	if addressedTo(header, []string{loopHeader}, origTo) || addressedTo(header, []string{loopHeader}, recorded) {
+		return loopError("Mail forwarding loop detected: message was already forwarded for %s (%s header)", origTo, loopHeader)
+	}
+	delivered := 0
+	for _, value := range header["Delivered-To"] {
+		if addr, err := addressToASCII(strings.TrimSpace(value)); err == nil && (strings.EqualFold(addr, origTo) || strings.EqualFold(addr, recorded)) {
+			delivered++
+		}
+	}
+	if delivered > 1 {
+		return loopError("Mail forwarding loop detected: message was already delivered to %s (Delivered-To header)", origTo)
+	}
+	return nil
+}
+
+// loopField returns the header field marking the message as forwarded for
+// origTo.
+func loopField(origTo string) string {
+	return fmt.Sprintf("%s: %s", loopHeader, origTo)
+}
+
+// detectOwnLoop returns an error when the message with the given header
+// passed through this host at least --max-own-hops times within
+// --own-hops-window before now, as counted by the Received headers added by
+// the hosts in --own-hostnames. Unlike --max-hops, this catches loops
+// between a few hosts early, without depending on other MTAs.
+func detectOwnLoop(ctx context.Context, header mail.Header, now time.Time) error {
+	if *maxOwnHops <= 0 {
+		return nil
+	}
+	identities := splitAddressList(*ownHostnames)
+	if len(identities) == 0 {
+		identities = []string{getHostname(ctx)}
+	}
+	hops := 0
+	for _, value := range header["Received"] {
+		hop := parseReceived(value)
+		if hop.date.IsZero() || now.Sub(hop.date) > *ownHopsWindow {
+			continue
+		}
+		for _, identity := range identities {
+			if strings.EqualFold(hop.by, strings.TrimSuffix(identity, ".")) {
+				hops++
+				break
+			}
+		}
+	}
+	if hops >= *maxOwnHops {
+		return loopError("Mail forwarding loop detected: message passed through %s %d times within %s, the limit is --max-own-hops %d",
+			strings.Join(identities, ", "), hops, *ownHopsWindow, *maxOwnHops)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// manifestHeader is the header field describing an attachment of the
+// original message, added once for every attachment with
+// --attachment-manifest.
+const manifestHeader = "X-Attachment-Manifest"
+
+// maxManifestDepth bounds the nesting of multipart entities searched for
+// attachments.
+const maxManifestDepth = 16
+
+// attachment describes an attachment of a message.
+type attachment struct {
+	name        string
+	contentType string
+	size        int64
+	sum         []byte
+}
+
+// field returns the manifest header field for the attachment, e.g.
+// X-Attachment-Manifest: name="report.pdf"; type=application/pdf;
+// size=48213; sha256=... File names which aren't plain ASCII are encoded as
+// in RFC 2231.
+func (a attachment) field() string {
+	name := fmt.Sprintf("name=%q", a.name)
+	if !isASCII(a.name) || strings.ContainsAny(a.name, "\"\\\r\n") {
+		name = "name*=utf-8''" + strings.ReplaceAll(url.PathEscape(a.name), "'", "%27")
+	}
+	return fmt.Sprintf("%s: %s; type=%s; size=%d; sha256=%s",
+		manifestHeader, name, a.contentType, a.size, hex.EncodeToString(a.sum))
+}
+
+// attachments returns the attachments of the message with the given
+// header, reading its body from body: the parts marked as attachments, or
+// with a file name, including those of messages included inline. The sizes
+// and digests are those of the decoded content.
+func attachments(header textproto.MIMEHeader, body io.Reader) ([]attachment, error) {
+	return appendAttachments(nil, header, body, 0)
+}
+
+func appendAttachments(found []attachment, header textproto.MIMEHeader, body io.Reader, depth int) ([]attachment, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	name := dparams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && disposition != "attachment" {
+		if depth >= maxManifestDepth {
+			return found, fmt.Errorf("multipart entities nested too deeply")
+		}
+		parts := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := parts.NextRawPart()
+			if err == io.EOF {
+				return found, nil
+			}
+			if err != nil {
+				return found, err
+			}
+			if found, err = appendAttachments(found, part.Header, part, depth+1); err != nil {
+				return found, err
+			}
+		}
+	}
+	if disposition != "attachment" && name == "" {
+		if mediaType != "message/rfc822" {
+			return found, nil
+		}
+		// Messages shown inline, like the original with --mode attach,
+		// are searched for attachments themselves.
+		if depth >= maxManifestDepth {
+			return found, fmt.Errorf("messages nested too deeply")
+		}
+		r := textproto.NewReader(bufio.NewReader(body))
+		inner, err := r.ReadMIMEHeader()
+		if err != nil {
+			return found, err
+		}
+		return appendAttachments(found, inner, r.R, depth+1)
+	}
+
+	var content io.Reader = body
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		// The decoder skips line breaks.
+		content = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		content = quotedprintable.NewReader(body)
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, content)
+	if err != nil {
+		return found, fmt.Errorf("attachment %q: %w", name, err)
+	}
+	if name != "" {
+		if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+			name = decoded
+		}
+	}
+	return append(found, attachment{name: name, contentType: mediaType, size: size, sum: h.Sum(nil)}), nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+)
+
+// Header fields affected by the header_sender and header_recipient
+// masquerade classes, as in Postfix's cleanup(8).
+var (
+	senderHeaders    = []string{"From", "Resent-From", "Sender", "Resent-Sender", "Reply-To", "Resent-Reply-To", "Return-Receipt-To", "Errors-To"}
+	recipientHeaders = []string{"To", "Resent-To", "Cc", "Resent-Cc", "Bcc", "Resent-Bcc"}
+)
+
+// masquerader strips the subdomain structure from addresses, similar to
+// Postfix's masquerade_domains feature.
+type masquerader struct {
+	// domains is processed from left to right and processing stops at the
+	// first match. A domain prefixed with ! is never masqueraded.
+	domains []string
+	// exceptions lists user names that are never masqueraded.
+	exceptions []string
+	// classes selects which addresses are masqueraded. Valid classes are
+	// envelope_sender, envelope_recipient, header_sender and
+	// header_recipient.
+	classes map[string]bool
+}
+
+// newMasquerader returns a masquerader from comma or whitespace separated
+// lists of domains, exceptions and classes.
+func newMasquerader(domains, exceptions, classes string) masquerader {
+	m := masquerader{
+		domains:    splitAddressList(domains),
+		exceptions: splitAddressList(exceptions),
+		classes:    map[string]bool{},
+	}
+	for _, c := range splitAddressList(classes) {
+		m.classes[strings.ToLower(c)] = true
+	}
+	return m
+}
+
+// enabled reports whether any masquerade domains are configured.
+func (m masquerader) enabled() bool {
+	return len(m.domains) > 0
+}
+
+// applies reports whether masquerading is enabled for class.
+func (m masquerader) applies(class string) bool {
+	return m.enabled() && m.classes[class]
+}
+
+// address returns the masqueraded form of addr.
+func (m masquerader) address(addr string) string {
+	local, domain := splitAddress(addr)
+	if domain == "" {
+		return addr
+	}
+	for _, e := range m.exceptions {
+		if strings.EqualFold(e, local) {
+			return addr
+		}
+	}
+	for _, d := range m.domains {
+		excluded := strings.HasPrefix(d, "!")
+		d = strings.TrimPrefix(d, "!")
+		if strings.EqualFold(domain, d) {
+			return addr
+		}
+		if len(domain) > len(d) && strings.EqualFold(domain[len(domain)-len(d)-1:], "."+d) {
+			if excluded {
+				return addr
+			}
+			return local + "@" + d
+		}
+	}
+	return addr
+}
+
+// addressList masquerades all addresses found in the header value v,
+// leaving the remaining text such as display names and comments intact.
+// Values which can't be parsed as an address list are returned unchanged.
+func (m masquerader) addressList(v []byte) []byte {
+	unfolded := strings.NewReplacer("\r\n", "", "\n", "").Replace(string(v))
+	addrs, err := mail.ParseAddressList(unfolded)
+	if err != nil {
+		return v
+	}
+	for _, addr := range addrs {
+		if masked := m.address(addr.Address); masked != addr.Address {
+			v = replaceAddress(v, addr.Address, masked)
+		}
+	}
+	return v
+}
+
+// headerFilter returns a headerFilter which masquerades the addresses in
+// sender and recipient headers, according to the configured classes.
+func (m masquerader) headerFilter() headerFilter {
+	var names []string
+	if m.applies("header_sender") {
+		names = append(names, senderHeaders...)
+	}
+	if m.applies("header_recipient") {
+		names = append(names, recipientHeaders...)
+	}
+	return func(field []byte) []byte {
+		if !isHeader(field, names) {
+			return field
+		}
+		i := bytes.IndexByte(field, ':') + 1
+		return append(field[:i:i], m.addressList(field[i:])...)
+	}
+}
+
+// replaceAddress replaces all occurrences of the address old in v with new.
+// Occurrences which are part of a longer address are left alone.
+func replaceAddress(v []byte, old, new string) []byte {
+	var out []byte
+	for {
+		i := bytes.Index(v, []byte(old))
+		if i < 0 {
+			return append(out, v...)
+		}
+		end := i + len(old)
+		if (i > 0 && isAddressByte(v[i-1])) || (end < len(v) && (isAddressByte(v[end]) || v[end] == '.')) {
+			out = append(out, v[:end]...)
+		} else {
+			out = append(append(out, v[:i]...), new...)
+		}
+		v = v[end:]
+	}
+}
+
+// isAddressByte reports whether c may appear in the local part or domain of
+// an unquoted address (RFC 5322 atext, plus the dot).
+func isAddressByte(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-/=?^_`{|}~.", c) >= 0
+}
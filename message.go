@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+// messageInfo summarizes the message being processed, for use in
+// diagnostics and admin notifications.
+type messageInfo struct {
+	// queueID uniquely identifies the message. It is assigned at ingestion
+	// and included in the Received header and all diagnostics.
+	queueID string
+	arrival time.Time
+	// returnPath is the original return-path, including angle brackets.
+	returnPath string
+	messageID  string
+	// origTo is the original recipient, if known.
+	origTo string
+	// size is the number of bytes of the message read so far.
+	size       int64
+	subject    string
+	recipients []string
+	// clientIP is the address of the client which originally submitted
+	// the message, according to the trusted part of the Received chain.
+	clientIP net.IP
+	// protection describes whether the message is signed or encrypted, as
+	// returned by protectedContent. Body transformations must be skipped
+	// for protected messages.
+	protection string
+	// header holds the raw header section of the message.
+	header []byte
+	// verdicts are the authentication results of the message, if it was
+	// authenticated.
+	verdicts []authResult
+	// addedHeaders are the header fields added to the forwarded message.
+	addedHeaders []string
+	// deliveries are the outcomes of the submissions made so far.
+	deliveries []deliveryRecord
+	// sidecars are the paths --metadata-sidecar records are written to
+	// once processing finished.
+	sidecars []string
+	// explaining is set by the explain subcommand, which prints the
+	// explanation recorded by logRecord and explainf instead of logging.
+	explaining  bool
+	explanation []string
+}
+
+// newMessageInfo assigns a queue ID to a message arriving now.
+func newMessageInfo() *messageInfo {
+	arrival := clk.Now()
+	return &messageInfo{queueID: ids.NewID(arrival), arrival: arrival}
+}
+
+type messageKey struct{}
+
+// withMessage returns a context for processing the given message.
+func withMessage(ctx context.Context, m *messageInfo) context.Context {
+	return context.WithValue(ctx, messageKey{}, m)
+}
+
+// messageFrom returns the message processed in ctx. Outside of message
+// processing, it returns an empty messageInfo.
+func messageFrom(ctx context.Context) *messageInfo {
+	if m, ok := ctx.Value(messageKey{}).(*messageInfo); ok {
+		return m
+	}
+	return &messageInfo{}
+}
+
+// debugf logs a debugging message about the message processed in ctx.
+func debugf(ctx context.Context, format string, a ...interface{}) {
+	logRecord(ctx, slog.LevelDebug, fmt.Sprintf(format, a...))
+}
+
+// explainf records a step of processing the message in ctx, which only the
+// explain subcommand prints.
+func explainf(ctx context.Context, format string, a ...interface{}) {
+	if m := messageFrom(ctx); m.explaining {
+		m.explanation = append(m.explanation, fmt.Sprintf(format, a...))
+	}
+}
+
+// infof logs an informational message about the message processed in ctx.
+func infof(ctx context.Context, format string, a ...interface{}) {
+	logRecord(ctx, slog.LevelInfo, fmt.Sprintf(format, a...))
+}
+
+// warnf logs a warning about the message processed in ctx.
+func warnf(ctx context.Context, format string, a ...interface{}) {
+	logRecord(ctx, slog.LevelWarn, fmt.Sprintf(format, a...))
+}
+
+// logf logs the failure to process the message in ctx. With --log syslog,
+// it's written to stderr as well, as Postfix reads the reason from there.
+func logf(ctx context.Context, msg string) {
+	if *logFormat == logSyslog {
+		if id := messageFrom(ctx).queueID; id != "" {
+			fmt.Fprintln(os.Stderr, id+": "+msg)
+		} else {
+			fmt.Fprintln(os.Stderr, msg)
+		}
+	}
+	logRecord(ctx, slog.LevelError, msg)
+}
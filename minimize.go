@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Values of --header-profile.
+const (
+	profileNone    = "none"
+	profileMinimal = "minimal"
+)
+
+// minimalHeaders are the header fields --header-profile minimal removes
+// from forwarded mail: verdicts and identifiers of internal filters, which
+// have no use at the destination and reveal the infrastructure mail passed
+// through. Names ending in "*" match every header field starting with them.
+var minimalHeaders = []string{
+	"X-Spam-*",
+	"X-Virus-*",
+	"X-Amavis-*",
+	"X-Quarantine-ID",
+	"X-Rspamd-*",
+	"X-Internal-*",
+	"X-Originating-IP",
+	"X-MS-Exchange-Organization-*",
+}
+
+// matchHeader reports whether line starts a header field matching one of
+// the given patterns: header names, or prefixes of them followed by "*".
+// Header names are compared case-insensitively.
+func matchHeader(line []byte, patterns []string) bool {
+	name := headerName(line)
+	if name == "" {
+		return false
+	}
+	for _, p := range patterns {
+		if prefix := strings.TrimSuffix(p, "*"); prefix != p {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripInternalAuthResults returns a headerFilter which removes the
+// Authentication-Results headers added by internal hosts: those with the
+// authserv-id servID, or one in the given internal domains.
+func stripInternalAuthResults(servID string, domains []string) headerFilter {
+	return func(field []byte) []byte {
+		if !isHeader(field, []string{authResultsHeader}) {
+			return field
+		}
+		value := field[bytes.IndexByte(field, ':')+1:]
+		if i := bytes.IndexByte(value, ';'); i >= 0 {
+			value = value[:i]
+		}
+		// The authserv-id may be followed by a version.
+		id := strings.Fields(string(value))
+		if len(id) == 0 {
+			return field
+		}
+		if strings.EqualFold(id[0], servID) {
+			return nil
+		}
+		for _, d := range domains {
+			if strings.EqualFold(id[0], d) || strings.HasSuffix(strings.ToLower(id[0]), "."+strings.ToLower(d)) {
+				return nil
+			}
+		}
+		return field
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// checkHostPort checks the TCP address addr, of the form host:port. IPv6
+// addresses are given in brackets, optionally with a zone for link-local
+// addresses, as in [fe80::1%eth0]:10001.
+func checkHostPort(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		if strings.Count(addr, ":") > 1 && !strings.HasPrefix(addr, "[") {
+			return fmt.Errorf("invalid address %q, IPv6 addresses must be in brackets, as in [2001:db8::1]:25", addr)
+		}
+		return fmt.Errorf("invalid address %q, expected host:port", addr)
+	}
+	if host == "" || port == "" {
+		return fmt.Errorf("invalid address %q, expected host:port", addr)
+	}
+	if strings.Contains(host, ":") && net.ParseIP(stripZone(host)) == nil {
+		return fmt.Errorf("invalid IPv6 address %q", host)
+	}
+	return nil
+}
+
+// checkHostPorts checks the comma-separated list of TCP addresses of the
+// named flag.
+func checkHostPorts(name, list string) error {
+	for _, addr := range strings.Split(list, ",") {
+		if err := checkHostPort(strings.TrimSpace(addr)); err != nil {
+			return temporaryError("Invalid --%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// stripZone returns host without the zone of an IPv6 address, such as the
+// %eth0 of fe80::1%eth0.
+func stripZone(host string) string {
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		return host[:i]
+	}
+	return host
+}
+
+// parseServerURL parses the URL of a server, such as
+// smtp://[fe80::1%eth0]:25. The zone of an IPv6 address may be given as
+// is, rather than percent-encoded as %25, as url.Parse requires.
+func parseServerURL(spec string) (*url.URL, error) {
+	start := strings.Index(spec, "://")
+	if start < 0 {
+		return nil, fmt.Errorf("invalid URL %q: missing scheme", spec)
+	}
+	start += len("://")
+	if at := strings.LastIndex(spec, "@"); at >= start {
+		start = at + 1
+	}
+	if open := strings.Index(spec[start:], "["); open >= 0 {
+		open += start
+		if end := strings.Index(spec[open:], "]"); end >= 0 {
+			literal := spec[open : open+end]
+			if i := strings.Index(literal, "%"); i >= 0 && !strings.HasPrefix(literal[i:], "%25") {
+				spec = spec[:open+i] + "%25" + spec[open+i+1:]
+			}
+		}
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if host := u.Hostname(); strings.Contains(host, ":") && net.ParseIP(stripZone(host)) == nil {
+		return nil, fmt.Errorf("invalid IPv6 address %q", host)
+	}
+	return u, nil
+}
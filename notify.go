@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// notifyPermanentFailure notifies the admin address, if configured, that the
+// current message could not be forwarded and will be bounced.
+func notifyPermanentFailure(ctx context.Context, reason string) {
+	if *notifyAdmin == "" {
+		return
+	}
+	notify(ctx, "Postforward: permanent delivery failure",
+		"Postforward was unable to forward a message, it will be bounced to its sender.", reason)
+}
+
+// notifyOutage notifies the admin address, if configured, about a backend
+// outage. Outage notifications are sent at most once per --notify-interval,
+// which requires --state-dir to keep track of previous notifications.
+func notifyOutage(ctx context.Context, reason string) {
+	if *notifyAdmin == "" || !stateConfigured() {
+		return
+	}
+	if ok, err := once("notify-outage", *notifyInterval); err != nil || !ok {
+		if err != nil {
+			warnf(ctx, "unable to record outage notification: %s", err)
+		}
+		return
+	}
+	notify(ctx, "Postforward: backend outage",
+		"Postforward is unable to reach a backend. Affected messages are\ndeferred and will be retried.", reason)
+}
+
+// notify sends a short notification about the current message to the admin
+// address. Failures to send are logged but otherwise ignored, as they must
+// not affect the outcome of the message itself.
+func notify(ctx context.Context, subject, intro, reason string) {
+	msg := messageFrom(ctx)
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: Postforward <MAILER-DAEMON>\n")
+	fmt.Fprintf(&body, "To: %s\n", *notifyAdmin)
+	fmt.Fprintf(&body, "Subject: %s\n", subject)
+	fmt.Fprintf(&body, "Auto-Submitted: auto-generated\n")
+	fmt.Fprintf(&body, "Date: %s\n", clk.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&body, "\n")
+	fmt.Fprintf(&body, "%s\n\n", intro)
+	fmt.Fprintf(&body, "Queue ID:    %s\n", msg.queueID)
+	fmt.Fprintf(&body, "Reason:      %s\n", reason)
+	fmt.Fprintf(&body, "Sender:      %s\n", msg.returnPath)
+	fmt.Fprintf(&body, "Recipients:  %s\n", strings.Join(msg.recipients, ", "))
+	fmt.Fprintf(&body, "Subject:     %s\n", decodeHeader(msg.subject))
+	if msg.clientIP != nil {
+		fmt.Fprintf(&body, "Client IP:   %s\n", msg.clientIP)
+	}
+	if *notifyHeaders && len(msg.header) > 0 {
+		fmt.Fprintf(&body, "\nOriginal message headers:\n\n")
+		body.Write(msg.header)
+	}
+
+	// Notifications use the null sender so they can never bounce back.
+	sendmail := exec.CommandContext(ctx, *sendmailPath, "-i", "-f", "", "--", *notifyAdmin)
+	sendmail.Stdin = &body
+	if out, err := sendmail.CombinedOutput(); err != nil {
+		warnf(ctx, "unable to notify %s: %s (%s)", *notifyAdmin, err, bytes.TrimSpace(out))
+	}
+}
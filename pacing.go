@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// paceRate is a messages per time window rate limit.
+type paceRate struct {
+	limit  int
+	window time.Duration
+}
+
+// String formats the rate the way it is configured, e.g. 30/m.
+func (r paceRate) String() string {
+	unit := map[time.Duration]string{time.Second: "s", time.Minute: "m", time.Hour: "h"}[r.window]
+	return fmt.Sprintf("%d/%s", r.limit, unit)
+}
+
+// parsePaceRates parses a comma-separated list of domain=rate entries, where
+// rate is a number of messages per second, minute or hour, such as
+// "gmail.com=30/m,outlook.com=600/h".
+func parsePaceRates(s string) (map[string]paceRate, error) {
+	rates := map[string]paceRate{}
+	err := parseDomainList(s, func(domain, value string) error {
+		i := strings.Index(value, "/")
+		if i < 0 {
+			return fmt.Errorf("invalid rate %q", value)
+		}
+		limit, err := strconv.Atoi(value[:i])
+		if err != nil || limit <= 0 {
+			return fmt.Errorf("invalid rate %q", value)
+		}
+		window, ok := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[value[i+1:]]
+		if !ok {
+			return fmt.Errorf("invalid rate unit in %q, expected s, m or h", value)
+		}
+		rates[domain] = paceRate{limit, window}
+		return nil
+	})
+	return rates, err
+}
+
+// parsePaceConcurrency parses a comma-separated list of domain=n entries.
+func parsePaceConcurrency(s string) (map[string]int, error) {
+	limits := map[string]int{}
+	err := parseDomainList(s, func(domain, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid concurrency %q", value)
+		}
+		limits[domain] = n
+		return nil
+	})
+	return limits, err
+}
+
+// parseDomainList calls fn for every domain=value entry in a comma-separated
+// list.
+func parseDomainList(s string, fn func(domain, value string) error) error {
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.Index(entry, "=")
+		if i < 0 {
+			return fmt.Errorf("invalid entry %q, expected domain=value", entry)
+		}
+		if err := fn(strings.ToLower(strings.TrimSpace(entry[:i])), strings.TrimSpace(entry[i+1:])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// paceKey returns the configured domain which applies to the recipient
+// domain, matching the domain itself or any of its parent domains.
+func paceKey(domain string, configured func(string) bool) (string, bool) {
+	domain = strings.ToLower(domain)
+	for d := domain; d != ""; {
+		if configured(d) {
+			return d, true
+		}
+		i := strings.Index(d, ".")
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	return "", false
+}
+
+// pace checks the delivery pacing limits for the destination domains of the
+// given recipients, returning an error describing the first limit which is
+// exceeded. Pacing state is shared by all postforward processes using the
+// same --state-dir. The returned function releases the concurrency slots
+// taken for the delivery, and must be called once it is done.
+func pace(recipients []string, rates map[string]paceRate, concurrency map[string]int) (release func(), err error) {
+	var slots []io.Closer
+	release = func() {
+		for _, slot := range slots {
+			slot.Close()
+		}
+	}
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+
+	domains := map[string]bool{}
+	for _, r := range recipients {
+		_, domain := splitAddress(r)
+		domains[domain] = true
+	}
+	keys := []string{}
+	for d := range domains {
+		keys = append(keys, d)
+	}
+	sort.Strings(keys)
+
+	for _, domain := range keys {
+		if key, ok := paceKey(domain, func(d string) bool { _, ok := concurrency[d]; return ok }); ok {
+			slot, err := acquireSlot("pace-"+key, concurrency[key])
+			if err != nil {
+				return release, err
+			}
+			if slot == nil {
+				return release, fmt.Errorf("concurrency limit of %d deliveries to %s reached", concurrency[key], key)
+			}
+			slots = append(slots, slot)
+		}
+		if key, ok := paceKey(domain, func(d string) bool { _, ok := rates[d]; return ok }); ok {
+			rate := rates[key]
+			_, recorded, err := recordEvent("pace-"+key, rate.window, rate.limit)
+			if err != nil {
+				return release, err
+			}
+			if !recorded {
+				return release, fmt.Errorf("rate limit of %s for %s reached", rate, key)
+			}
+		}
+	}
+	return release, nil
+}
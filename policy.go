@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// policyMaxRequest bounds the size of a policy request. Postfix requests
+// are well below a kilobyte.
+const policyMaxRequest = 64 << 10
+
+// servePolicy implements the Postfix SMTPD policy delegation protocol
+// (SMTPD_POLICY_README) on the socket given in Postfix notation, until ctx
+// is done. Postfix asks about every recipient with check_policy_service,
+// and is answered by policyDecision.
+func servePolicy(ctx context.Context, spec string, recipients []string) error {
+	return serveConnections(ctx, spec, "policy", func(conn net.Conn) {
+		servePolicyConn(ctx, conn, recipients)
+	})
+}
+
+// servePolicyConn answers the policy requests of a single connection, which
+// Postfix keeps open for further requests.
+func servePolicyConn(ctx context.Context, conn net.Conn, recipients []string) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	r := bufio.NewReader(conn)
+	for {
+		// Requests are name=value lines, ended by an empty line.
+		attrs := map[string]string{}
+		size := 0
+		for {
+			conn.SetReadDeadline(time.Now().Add(lmtpIdleTimeout))
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if size += len(line); size > policyMaxRequest {
+				warnf(ctx, "policy request exceeds %d bytes, closing connection", policyMaxRequest)
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			if line == "" {
+				break
+			}
+			if name, value, ok := strings.Cut(line, "="); ok {
+				attrs[name] = value
+			}
+		}
+		fmt.Fprintf(conn, "action=%s\n\n", policyDecision(ctx, attrs, recipients))
+	}
+}
+
+// policyDecision returns the action for the policy request with the given
+// attributes: DUNNO for recipients postforward doesn't forward, and the
+// --policy-action for those it does, describing how. Lookup failures defer
+// the recipient, and recipients whose rule expired are rejected, as when
+// their mail is forwarded.
+func policyDecision(ctx context.Context, attrs map[string]string, static []string) string {
+	if attrs["request"] != "smtpd_access_policy" || attrs["recipient"] == "" {
+		return "DUNNO"
+	}
+	ctx = withMessage(ctx, newMessageInfo())
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	action, err := policyAction(ctx, attrs["sender"], attrs["recipient"], static)
+	if err == nil {
+		return action
+	}
+	warnf(ctx, "policy: %s", err)
+	status := enhancedStatus(err)
+	reason := strings.Join(strings.Fields(err.Error()), " ")
+	if status[0] == '4' {
+		// Like other restrictions, a temporary failure only defers mail
+		// which would otherwise be accepted.
+		return fmt.Sprintf("DEFER_IF_PERMIT %s %s", status, reason)
+	}
+	return fmt.Sprintf("REJECT %s %s", status, reason)
+}
+
+// policyAction decides how mail from sender to recipient would be
+// forwarded: the recipients it's forwarded to, and the return-path it's
+// forwarded with. Header based decisions, such as loop detection, need the
+// message itself and aren't made here.
+func policyAction(ctx context.Context, sender, recipient string, static []string) (string, error) {
+	now := clk.Now()
+	origTo, err := addressToASCII(foldCase(recipient))
+	if err != nil {
+		return "", permanentError("Invalid recipient address %s: %s", recipient, err)
+	}
+	var domains []string
+	if *virtualMap != "" || *senderCanonicalMap != "" || *recipientCanonicalMap != "" {
+		domains = localDomains(ctx, *localDomainList)
+	}
+	if *recipientCanonicalMap != "" {
+		m, err := loadAddressMap(ctx, *recipientCanonicalMap, domains)
+		if err != nil {
+			return "", temporaryError("Unable to read recipient canonical map: %w", err)
+		}
+		if origTo, err = m.canonicalize(ctx, origTo); err != nil {
+			return "", temporaryError("Recipient canonical map lookup error: %w", err)
+		}
+	}
+	dests, err := lookupRecipients(ctx, origTo, domains)
+	if err != nil {
+		return "", err
+	}
+	recipients := append(append([]string(nil), static...), dests...)
+	if len(recipients) == 0 {
+		return "DUNNO", nil
+	}
+	for i, r := range recipients {
+		if recipients[i], err = addressToASCII(r); err != nil {
+			return "", permanentError("Invalid recipient address %s: %s", r, err)
+		}
+	}
+	if len(rules) > 0 {
+		var expired *forwardRule
+		if recipients, expired = activeRecipients(ctx, recipients, now); expired != nil {
+			reason := expired.expiredMessage
+			if reason == "" {
+				reason = defaultExpiredMessage
+			}
+			return "", withStatus("5.2.1", noUserError("%s", reason))
+		}
+	}
+
+	returnPath, err := addressToASCII(foldCase(sender))
+	if err != nil {
+		return "", permanentError("Invalid sender address %s: %s", sender, err)
+	}
+	if *senderCanonicalMap != "" && returnPath != "" {
+		m, err := loadAddressMap(ctx, *senderCanonicalMap, domains)
+		if err != nil {
+			return "", temporaryError("Unable to read sender canonical map: %w", err)
+		}
+		if returnPath, err = m.canonicalize(ctx, returnPath); err != nil {
+			return "", temporaryError("Sender canonical map lookup error: %w", err)
+		}
+	}
+	// The return-path is rewritten unless every submission keeps its own,
+	// like those of rules with srs = false.
+	srs := returnPath
+	if returnPath != "" && *forwardMode != modeAttach {
+		for _, sub := range groupRecipients(recipients) {
+			if sub.rule != nil && (sub.rule.noSRS || sub.rule.sender != "") {
+				continue
+			}
+			needed, err := srsNeeded(ctx, returnPath)
+			if err != nil {
+				return "", err
+			}
+			if needed {
+				if srs, err = srsForward(ctx, returnPath, now); err != nil {
+					return "", err
+				}
+			}
+			break
+		}
+	}
+	debugf(ctx, "policy: mail from <%s> to %s is forwarded to %s from <%s>", sender, recipient, strings.Join(recipients, ", "), srs)
+	return strings.NewReplacer(
+		"{sender}", sender,
+		"{recipient}", recipient,
+		"{recipients}", strings.Join(recipients, ","),
+		"{srs}", srs,
+	).Replace(*policyActionTemplate), nil
+}
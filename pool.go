@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// lookupPoolSize is the number of idle connections kept to a lookup server.
+const lookupPoolSize = 8
+
+// After connecting to a server failed, connection pools wait before trying
+// again, starting at reconnectBackoff and doubling up to reconnectBackoffMax
+// with every further failure, so a recovering server isn't hammered.
+const (
+	reconnectBackoff    = 100 * time.Millisecond
+	reconnectBackoffMax = 30 * time.Second
+)
+
+// connPool keeps idle connections to a lookup server for reuse, so lookups in
+// daemon mode don't need to connect every time.
+type connPool struct {
+	network string
+	addr    string
+	idle    chan *pooledConn
+	// setup, if set, prepares new connections before their first use,
+	// e.g. by authenticating.
+	setup func(c *textproto.Conn) error
+
+	mu sync.Mutex
+	// failures counts the consecutive failed attempts to connect, after
+	// which no connection is attempted before retryAt.
+	failures int
+	retryAt  time.Time
+}
+
+type pooledConn struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+func newConnPool(network, addr string) *connPool {
+	return &connPool{network: network, addr: addr, idle: make(chan *pooledConn, lookupPoolSize)}
+}
+
+// do calls fn with a connection to the server, which is returned to the pool
+// unless fn fails. Pending I/O fails when ctx is done. Idle connections may
+// have been closed by the server in the meantime, so when fn fails on a
+// reused connection, it is retried once on a new one. Lookups are safe to
+// repeat.
+func (p *connPool) do(ctx context.Context, fn func(c *textproto.Conn) error) error {
+	for attempt := 0; ; attempt++ {
+		c, reused, err := p.get(ctx)
+		if err != nil {
+			return err
+		}
+		stop := context.AfterFunc(ctx, func() {
+			c.conn.SetDeadline(time.Now())
+		})
+		err = fn(c.text)
+		if stop() && err == nil {
+			p.put(c)
+			return nil
+		}
+		c.conn.Close()
+		if err == nil {
+			return nil
+		}
+		if reused && attempt == 0 && ctx.Err() == nil {
+			continue
+		}
+		return ctxErr(ctx, err)
+	}
+}
+
+func (p *connPool) get(ctx context.Context) (*pooledConn, bool, error) {
+	select {
+	case c := <-p.idle:
+		return c, true, nil
+	default:
+	}
+	if err := p.wait(); err != nil {
+		return nil, false, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, p.network, p.addr)
+	if err != nil {
+		p.failed(ctx, err)
+		return nil, false, err
+	}
+	c := &pooledConn{conn: conn, text: textproto.NewConn(conn)}
+	if p.setup != nil {
+		stop := context.AfterFunc(ctx, func() {
+			conn.SetDeadline(time.Now())
+		})
+		err := p.setup(c.text)
+		stop()
+		if err != nil {
+			conn.Close()
+			p.failed(ctx, err)
+			return nil, false, ctxErr(ctx, err)
+		}
+	}
+	p.connected(ctx)
+	return c, false, nil
+}
+
+// wait fails while the pool backs off from failed connection attempts.
+// Once the backoff ended, a single attempt is let through, pushing the end
+// forward again until its result is known.
+func (p *connPool) wait() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failures == 0 {
+		return nil
+	}
+	now := time.Now()
+	if now.Before(p.retryAt) {
+		return fmt.Errorf("connecting to %s failed recently, next attempt in %s", p.addr, p.retryAt.Sub(now).Round(time.Millisecond))
+	}
+	p.retryAt = now.Add(reconnectBackoffMax)
+	return nil
+}
+
+// failed records a failed connection attempt, and starts backing off.
+// The backoff is jittered, so processes sharing a server don't reconnect
+// all at once. In daemon mode, where connections outlive messages, the
+// server going down and coming back up is logged.
+func (p *connPool) failed(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		// Running out of time says nothing about the server.
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures++
+	backoff := reconnectBackoffMax
+	if p.failures < 16 {
+		backoff = min(reconnectBackoff<<(p.failures-1), reconnectBackoffMax)
+	}
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	p.retryAt = time.Now().Add(backoff)
+	if p.failures == 1 && *daemon != "" {
+		warnf(ctx, "connecting to %s failed, backing off: %s", p.addr, err)
+	} else {
+		debugf(ctx, "reconnecting to %s failed %d times, next attempt in %s: %s", p.addr, p.failures, backoff.Round(time.Millisecond), err)
+	}
+}
+
+// connected records a successful connection attempt, ending the backoff.
+func (p *connPool) connected(ctx context.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failures > 0 && *daemon != "" {
+		infof(ctx, "connected to %s again, after %d failed attempts", p.addr, p.failures)
+	}
+	p.failures = 0
+}
+
+func (p *connPool) put(c *pooledConn) {
+	select {
+	case p.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+// lookupCache holds lookup results for a limited time.
+type lookupCache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	value   string
+	expires time.Time
+}
+
+func newLookupCache() *lookupCache {
+	return &lookupCache{entries: map[string]cacheEntry{}}
+}
+
+// get returns the cached result for key, if it hasn't expired yet.
+func (c *lookupCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || !clk.Now().Before(e.expires) {
+		return "", false
+	}
+	return e.value, true
+}
+
+// put caches value as the result for key for the given time. Expired
+// entries are dropped along the way. Nothing is cached for a ttl of zero.
+func (c *lookupCache) put(key, value string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := clk.Now()
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry{value: value, expires: now.Add(ttl)}
+}
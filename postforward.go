@@ -3,13 +3,24 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
+	"mime"
+	"net"
 	"net/mail"
 	"net/textproto"
 	"os"
 	"os/exec"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -19,6 +30,15 @@ const (
 	// should only be used for user's data and not system
 	// files.
 	ExDataErr = 65
+	// The user specified did not exist.  This might
+	// be used for mail addresses or remote logins.
+	ExNoUser = 67
+	// A service is unavailable.  This can occur
+	// if a support program or file does not exist.  This
+	// can also be used as a catchall message when something
+	// you wanted to do doesn't work, but you don't know
+	// why.
+	ExUnavailable = 69
 	// Temporary failure, indicating something that is not
 	// really an error.  In sendmail, this means that a
 	// mailer (e.g.) could not create a connection, and
@@ -26,28 +46,371 @@ const (
 	ExTempFail = 75
 )
 
+var configFile = flag.String("config", "", "read settings and per-recipient forwarding rules from this file (command line flags take precedence)")
+var addHeaders = newListFlag("add-header", "header to add to forwarded mail, e.g. \"X-Forwarded-By: postforward\" (may be repeated)")
+var stripHeaderNames = newListFlag("strip-header", "name of a header to remove from forwarded mail, or a prefix of names followed by * (may be repeated)")
+var headerProfile = flag.String("header-profile", profileNone, "header fields to remove from forwarded mail: none, or minimal (spam and virus filter verdicts, internal headers and Authentication-Results of internal hosts)")
+var dkimKey = flag.String("dkim-key", "", "DKIM-sign forwarded mail with the PEM encoded RSA or Ed25519 private key in this file")
+var dkimDomain = flag.String("dkim-domain", "", "signing domain (d=) of DKIM signatures")
+var dkimSelector = flag.String("dkim-selector", "", "selector (s=) of DKIM signatures")
+var traceKey = flag.String("trace-key", "", "sign the trace header fields added to forwarded mail with the PEM encoded RSA or Ed25519 private key in this file, for the verify-trace subcommand")
+var dkimKeyTablePath = flag.String("dkim-key-table", "", "DKIM-sign forwarded mail for the domains listed in this table source file, with values of the form \"selector keyfile\", falling back to --dkim-key")
+var authResultsEnabled = flag.Bool("auth-results", false, "evaluate SPF, DKIM, DMARC and ARC of the received message and add an Authentication-Results header")
+var authservID = flag.String("authserv-id", "", "authserv-id used in Authentication-Results headers (default: the postfix myhostname)")
+var arcKey = flag.String("arc-key", "", "ARC-seal forwarded mail with the PEM encoded RSA or Ed25519 private key in this file (implies --auth-results)")
+var arcDomain = flag.String("arc-domain", "", "signing domain (d=) of ARC sets")
+var arcSelector = flag.String("arc-selector", "", "selector (s=) of ARC sets")
+var attachmentManifest = flag.Bool("attachment-manifest", false, "add an X-Attachment-Manifest header with the file name, type, size and SHA-256 digest of every attachment of the message")
+var digestHeaderEnabled = flag.Bool("digest-header", false, "add an X-Forward-Digest header with the SHA-256 digest of the forwarded body")
+var logDigest = flag.Bool("log-digest", false, "log the SHA-256 digests of the body as received and as delivered")
+var daemon = flag.String("daemon", "", "run as a daemon, accepting messages via LMTP on this socket (unix:/path or inet:host:port) instead of reading one from stdin")
+var policyService = flag.String("policy-service", "", "run as a Postfix SMTPD policy service on this socket (unix:/path or inet:host:port), answering check_policy_service requests about forwarded recipients")
+var policyActionTemplate = flag.String("policy-action", "PREPEND X-Postforward-Policy: forward to={recipients}; srs={srs}", "policy service action for forwarded recipients, with {sender}, {recipient}, {recipients} and {srs} (the forwarded return-path) replaced")
+var laneSpecs = newListFlag("lane", "in daemon mode, put messages matching a condition in a priority lane: lane:size>N, lane:sender=ADDRESS or @DOMAIN, lane:header=NAME or lane:header=NAME:VALUE (may be repeated)")
+var laneConcurrency = flag.String("lane-concurrency", "", "comma-separated list of lane=n entries limiting the number of messages of a priority lane forwarded at the same time, including the default lane")
+var replyTemplate = flag.String("reply-template", "{reason}", "text of LMTP rejection replies in daemon mode, with {reason}, {status}, {recipient} and {queue_id} replaced")
+var deliver = flag.String("deliver", "", "submit forwarded mail via SMTP or LMTP to this URL (smtp://[user@]host[:port] or lmtp://[user@]host[:port]) instead of calling sendmail")
+var deliverTLS = flag.String("deliver-tls", tlsMay, "TLS policy for --deliver: none, may (use STARTTLS when offered) or verify (require STARTTLS with a valid certificate)")
+var deliverPasswordFile = flag.String("deliver-password-file", "", "file containing the password to authenticate with as the user given in --deliver")
+var downgrade8bitFlag = flag.Bool("downgrade-8bit", false, "convert 8-bit messages to quoted-printable or base64 when the --deliver server doesn't offer 8BITMIME")
+var deterministic = flag.Bool("deterministic", false, "use a fixed clock, queue IDs and hostname, making the output reproducible (for testing)")
+var detectVerificationFlag = flag.Bool("detect-verification", false, "report forwarding confirmation codes of provider verification messages (e.g. Gmail) via stderr, --alert-webhook and --notify-admin")
+var shadow = flag.Bool("shadow", false, "perform all lookups, rewriting and policy evaluation and log what would be forwarded, but deliver the original message unmodified, from its original return-path")
 var dryRun = flag.Bool("dry-run", false, "show what would be done, don't actually forward mail")
+var recipientsFromHeader = flag.String("recipients-from-header", "", "comma-separated list of headers to read additional recipients from (e.g. X-Forward-To)")
+var origTo = flag.String("orig-to", "", "original recipient address of the message (e.g. Postfix ${original_recipient})")
+var expectOrigRecipient = flag.String("expect-original-recipient", "", "check that the message is addressed to --orig-to in its To, Cc, Delivered-To or X-Original-To header, and defer or reject it otherwise: defer or reject")
+var detectLoops = flag.Bool("detect-loops", false, "reject mail already forwarded for --orig-to, as recorded in an X-Loop header added to forwarded mail, or delivered to it more than once")
+var addDeliveredTo = flag.Bool("add-delivered-to", false, "add a Delivered-To header with the --orig-to address, unless the message already has one, for filtering at the destination")
+var addOriginalTo = flag.Bool("add-original-to", false, "add an X-Original-To header with the --orig-to address, unless the message already has one, for filtering at the destination")
+var maxOwnHops = flag.Int("max-own-hops", 0, "reject mail with at least this many Received headers added by --own-hostnames within --own-hops-window as looping (0: no limit)")
+var ownHostnames = flag.String("own-hostnames", "", "comma-separated list of the names this host appears as in the by clause of Received headers (default: the postfix myhostname)")
+var ownHopsWindow = flag.Duration("own-hops-window", time.Hour, "time window within which Received headers count towards --max-own-hops")
+var maxHops = flag.Int("max-hops", 50, "reject mail with at least this many Received headers as looping (0: no limit)")
+var trustedHostsFlag = flag.String("trusted-hosts", "127.0.0.0/8,::1", "comma-separated list of addresses, networks and host names of trusted mail hosts in the Received chain")
+var userForwardsEnabled = flag.Bool("user-forwards", false, "forward to destinations listed in the ~/.postforward file of the --orig-to user")
+var userForwardsDir = flag.String("user-forwards-dir", "", "read per-user forwarding files from this directory instead of home directories (implies --user-forwards)")
+var virtualMap = flag.String("virtual-map", "", "resolve --orig-to to forwarding destinations using this virtual(5) alias table source file")
+var senderCanonicalMap = flag.String("sender-canonical-map", "", "canonical(5) table source file used to rewrite the envelope sender before SRS")
+var recipientCanonicalMap = flag.String("recipient-canonical-map", "", "canonical(5) table source file used to rewrite --orig-to before recipient resolution")
+var masqueradeDomains = flag.String("masquerade-domains", "", "comma-separated list of domains whose subdomain structure is stripped from addresses (prefix with ! to exclude)")
+var masqueradeExceptions = flag.String("masquerade-exceptions", "", "comma-separated list of user names that are never masqueraded")
+var masqueradeClasses = flag.String("masquerade-classes", "envelope_sender,header_sender,header_recipient", "addresses subject to masquerading: envelope_sender, envelope_recipient, header_sender, header_recipient")
+var addressCaseFlag = flag.String("address-case", casePreserve, "case policy for addresses used in SRS encoding and map lookups: preserve, lower or normalize (lowercase domain only)")
+var recipientDelimiterFlag = flag.String("recipient-delimiter", "", "characters separating user names from address extensions, any of which starts an extension (default: postfix recipient_delimiter)")
+var localDomainList = flag.String("local-domains", "", "domains for which bare user keys in lookup tables apply (default: postfix mydestination)")
+var forwardWindow = flag.String("forward-window", "", "only forward during these semicolon-separated weekly time windows, e.g. \"Mon-Fri 18:00-08:00; Sat,Sun\"")
+var forwardWindowTimezone = flag.String("forward-window-timezone", "", "time zone of --forward-window, e.g. Europe/Madrid (default: local time)")
+var outsideWindowRecipients = flag.String("outside-window-recipients", "", "comma-separated list of recipients to forward to instead outside --forward-window (default: defer the message)")
+var vacationMessage = flag.String("vacation-message", "", "send an auto-reply with the text in this file to the senders of forwarded mail (requires --orig-to and --state-dir)")
+var vacationSubject = flag.String("vacation-subject", "", "subject of auto-replies (default: \"Auto: \" followed by the original subject)")
+var vacationInterval = flag.Duration("vacation-interval", 7*24*time.Hour, "minimum time between auto-replies to the same sender")
+var vacationSuppress = flag.String("vacation-suppress", "", "file listing addresses and @domains which never receive auto-replies")
+var archiveBcc = flag.String("archive-bcc", "", "also send every forwarded message to this archive address, which isn't added to the headers")
+var fallbackMaildir = flag.String("fallback-maildir", "", "store messages in this Maildir, and report them as delivered, when forwarding them fails temporarily")
+var metadataSidecar = flag.Bool("metadata-sidecar", false, "write a JSON record of processing next to messages stored in a Maildir by --keep-copy or --fallback-maildir, in its metadata/ directory")
+var keepCopySpec = flag.String("keep-copy", "", "also deliver a copy of every message to this local mailbox: a Maildir (path ending in /), an mbox file or lmtp://host[:port] (delivering to --orig-to)")
+var keepCopyFailure = flag.String("keep-copy-failure", keepCopyDefer, "what to do when keeping a copy fails: defer (retry forwarding and the copy later) or ignore (forward anyway)")
+var greylistEnabled = flag.Bool("greylist", false, "defer the first forwarding attempt for unknown sender/recipient pairs (requires --state-dir)")
+var greylistDelay = flag.Duration("greylist-delay", 5*time.Minute, "time before a retried greylisted message is accepted")
+var greylistRetryWindow = flag.Duration("greylist-retry-window", 48*time.Hour, "time after --greylist-delay within which a greylisted message must be retried")
+var greylistLifetime = flag.Duration("greylist-lifetime", 35*24*time.Hour, "time after which sender/recipient pairs which passed greylisting are forgotten when not seen")
+var internalNetworks = flag.String("internal-networks", "", "comma-separated list of internal networks; mail originating elsewhere is tagged as external")
+var internalDomains = flag.String("internal-domains", "", "comma-separated list of internal sender domains; mail from other domains is tagged as external")
+var externalHeader = flag.String("external-header", "", "header to add to mail of external origin, e.g. \"X-External-Forward: yes\"")
+var externalSubjectTag = flag.String("external-subject-tag", "", "tag to prefix the subject of mail of external origin with, e.g. [EXTERNAL]")
+var inputFormat = flag.String("input-format", "pipe", "format of the message on stdin: pipe (as delivered by pipe(8) and local(8)) or qf (a Postfix queue file)")
+var forwardMode = flag.String("mode", modeResend, "forwarding mode: resend (forward the message, rewriting its return-path) or attach (forward a new message from --orig-to with the original attached)")
+var attachSubjectPrefix = flag.String("attach-subject-prefix", "Fwd: ", "prefix of the subject of messages forwarded with --mode attach")
+var attachTextFile = flag.String("attach-text-file", "", "file with the text of messages forwarded with --mode attach, instead of a summary of the original")
+var foldHeaders = flag.Bool("fold-headers", false, "fold header lines longer than 998 octets, which strict MTAs reject, and the headers added by postforward at 78 characters")
+var maxCPUTime = flag.Duration("max-cpu-time", 0, "defer the message when processing it takes more than this much CPU time (e.g. 30s)")
+var maxSize = flag.String("max-size", "", "bounce messages larger than this (e.g. 10M), like Postfix message_size_limit")
+var maxMemory = flag.String("max-memory", "", "defer the message when processing it needs more than this much memory (e.g. 256M)")
+var paceRates = flag.String("pace", "", "comma-separated list of per-destination-domain rate limits, e.g. gmail.com=30/m (requires --state-dir)")
+var paceConcurrencyFlag = flag.String("pace-concurrency", "", "comma-separated list of per-destination-domain concurrency limits, e.g. gmail.com=2 (requires --state-dir)")
+var logFormat = flag.String("log", logStderr, "where and how to log: stderr (plain lines, as read by Postfix), syslog (mail facility) or json (one JSON object per line on stderr)")
+var logLevelFlag = flag.String("log-level", "info", "minimum level of logged messages: debug, info, warning or error")
 var path = flag.String("path", "", "override $PATH with this value when executing binaries")
 var rpHeader = flag.String("rp-header", "Return-Path", "header name containing the return-path (MAIL FROM) value")
+var alertWebhook = flag.String("alert-webhook", "", "URL of a (Slack-compatible) webhook to alert when too many messages fail (requires --state-dir)")
+var alertThreshold = flag.Int("alert-threshold", 10, "number of failed messages within --alert-window which fires the alert webhook")
+var alertWindow = flag.Duration("alert-window", 10*time.Minute, "time window in which failed messages are counted for alerting")
+var notifyAdmin = flag.String("notify-admin", "", "send a notification to this address on permanent failures and backend outages")
+var notifyHeaders = flag.Bool("notify-headers", false, "include the original message headers in admin notifications")
+var notifyInterval = flag.Duration("notify-interval", time.Hour, "minimum time between repeated backend outage notifications")
 var sendmailPath = flag.String("sendmail-path", "sendmail", "path to the sendmail binary (deprecated: use --path instead)")
-var srsAddr = flag.String("srs-addr", "localhost:10001", "TCP address for SRS lookups")
+var timeout = flag.Duration("timeout", 0, "defer the message when forwarding it takes longer than this (e.g. 1m)")
+var srsAddr = flag.String("srs-addr", "localhost:10001", "comma-separated list of TCP addresses for SRS lookups, tried in order")
+var srsProto = flag.String("srs-proto", "tcp", "protocol for SRS lookups: tcp (tcp_table(5), as spoken by postsrsd 1.x) or socketmap (as spoken by postsrsd 2.x)")
+var srsSocket = flag.String("srs-socket", "", "comma-separated list of sockets for SRS lookups, as unix:/path or inet:host:port, tried in order (overrides --srs-addr)")
+var srsTimeout = flag.Duration("srs-timeout", 5*time.Second, "time limit of a single SRS lookup (0: no limit)")
+var srsRetries = flag.Int("srs-retries", 2, "number of times failed SRS lookups are retried, with exponential backoff")
+var srsCacheTTL = flag.Duration("srs-cache-ttl", 0, "cache SRS lookup results for this long (e.g. 1m, useful with --daemon)")
+var srsSocketmapName = flag.String("srs-socketmap-name", "forward", "map name used in socketmap SRS lookups")
+var srsReverseAddr = flag.String("srs-reverse-addr", "localhost:10002", "comma-separated list of TCP addresses for reverse SRS lookups with --srs-proto tcp, tried in order")
+var srsReverseSocketmapName = flag.String("srs-reverse-socketmap-name", "reverse", "map name used in socketmap reverse SRS lookups")
+var srsDomain = flag.String("srs-domain", "", "domain of rewritten addresses when using built-in SRS rewriting")
+var srsPolicy = flag.String("srs-policy", srsAlways, "when to rewrite the return-path: always, spf-needed (only when SPF of the original sender would fail for --srs-policy-ip) or never")
+var srsPolicyIP = flag.String("srs-policy-ip", "", "comma-separated IP addresses forwarded mail is sent from, to evaluate SPF for with --srs-policy spf-needed")
+var srsPolicyHELO = flag.String("srs-policy-helo", "", "HELO name forwarded mail is sent with, to evaluate SPF for with --srs-policy spf-needed (default: the Postfix hostname)")
+var dsnPolicy = flag.String("dsn-policy", dsnForward, "how to forward delivery status and disposition notifications: forward, no-srs (keeping their return-path), reverse (returning them to the original sender, like --reverse always) or discard")
+var mdnPolicy = flag.String("mdn-policy", mdnPass, "what to do with read receipt requests in forwarded mail: pass, strip or rewrite (sending the receipts to --orig-to instead)")
+var privateDestination = flag.Bool("private-destination", false, "keep forwarding addresses out of forwarded mail: header fields added by postforward record them hashed, --mode attach addresses the message to --orig-to and read receipt requests are removed")
+var srsReverseMode = flag.String("reverse", reverseNever, "return bounces sent to SRS addresses to the original sender: never, auto (when --orig-to is an SRS address) or always (rejecting messages to other addresses)")
+var batvSecretFile = flag.String("batv-secret-file", "", "tag envelope senders in --batv-domains with BATV prvs signatures made with the secret read from this file")
+var batvDomains = flag.String("batv-domains", "", "comma-separated list of domains whose envelope senders are tagged with --batv-secret-file, such as --srs-domain and the domains of local senders")
+var batvValidate = flag.Bool("batv-validate", false, "reject bounces to --orig-to addresses in --batv-domains without a valid prvs tag")
+var srsHashAlgorithm = flag.String("srs-hash-algorithm", srsSHA1, "HMAC hash of built-in SRS rewriting: sha1 (as libsrs2 and postsrsd) or sha256")
+var srsHashLengthFlag = flag.Int("srs-hash-length", srsHashLength, "number of base64 characters of the hash in addresses rewritten by built-in SRS")
+var srsMaxAgeFlag = flag.Int("srs-max-age", srsMaxAge, "number of days addresses rewritten by built-in SRS are accepted when reversing them")
+var srsSecretFile = flag.String("srs-secret-file", "", "rewrite the return-path using built-in SRS with the secret read from this file, instead of looking it up at --srs-addr")
+var statsEnabled = flag.Bool("stats", false, "record per-address forwarding statistics in --state-dir, for the report subcommand")
+var stateDir = flag.String("state-dir", "", "directory in which to keep state across invocations")
+var stateBackend = flag.String("state-backend", "", "keep the state shared by postforward processes in this Redis server, as redis://[:password@]host[:port][/db], instead of --state-dir, so it's shared across hosts")
 
-// lookupTCP performs a TCP table lookup for the specified key against the
-// given address.
-func lookupTCP(addr, key string) (string, error) {
-	c, err := textproto.Dial("tcp", addr)
-	if err != nil {
+// srsPools holds the connections to the SRS daemons, in the order they're
+// tried, set up on first use. srsReversePools are used for reverse lookups;
+// postsrsd 1.x serves them on a separate port, 2.x on the same socket.
+var (
+	srsPools        []*connPool
+	srsReversePools []*connPool
+	srsPoolErr      error
+	srsPoolOnce     sync.Once
+)
+
+// srsRetryBackoff is the time waited before retrying failed SRS lookups the
+// first time. It doubles with every further retry.
+const srsRetryBackoff = 100 * time.Millisecond
+
+// srsCache holds the results of SRS lookups for --srs-cache-ttl.
+var srsCache = newLookupCache()
+
+// errSRSNotFound is returned by SRS lookups the daemon has no result for.
+var errSRSNotFound = errors.New("srs: address not found")
+
+// lookupSRS looks up the SRS rewritten form of addr using the configured
+// daemons and protocol, or the address it stands for when reverse is set.
+// The daemons are tried in order, in up to
+// --srs-retries more rounds when all of them fail, with exponential backoff.
+// Every lookup is bounded by --srs-timeout, and the whole lookup is aborted
+// when ctx is done.
+func lookupSRS(ctx context.Context, addr string, reverse bool) (string, error) {
+	srsPoolOnce.Do(func() {
+		if *srsProto != "tcp" && *srsProto != "socketmap" {
+			srsPoolErr = fmt.Errorf("invalid --srs-proto: %s", *srsProto)
+			return
+		}
+		if *srsSocket == "" {
+			for _, address := range strings.Split(*srsAddr, ",") {
+				srsPools = append(srsPools, newConnPool("tcp", strings.TrimSpace(address)))
+			}
+			for _, address := range strings.Split(*srsReverseAddr, ",") {
+				srsReversePools = append(srsReversePools, newConnPool("tcp", strings.TrimSpace(address)))
+			}
+			return
+		}
+		for _, spec := range strings.Split(*srsSocket, ",") {
+			network, address, err := parseSocket(strings.TrimSpace(spec))
+			if err != nil {
+				srsPoolErr = err
+				return
+			}
+			srsPools = append(srsPools, newConnPool(network, address))
+		}
+		srsReversePools = srsPools
+	})
+	if srsPoolErr != nil {
+		return "", srsPoolErr
+	}
+	pools, cacheKey := srsPools, addr
+	if reverse {
+		pools, cacheKey = srsReversePools, "reverse "+addr
+	}
+	if rewritten, ok := srsCache.get(cacheKey); ok {
+		return rewritten, nil
+	}
+
+	var err error
+	backoff := srsRetryBackoff
+	for round := 0; round <= *srsRetries; round++ {
+		if round > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+			backoff *= 2
+		}
+		for _, pool := range pools {
+			var rewritten string
+			if rewritten, err = lookupSRSAt(ctx, pool, addr, reverse); err == nil {
+				srsCache.put(cacheKey, rewritten, *srsCacheTTL)
+				return rewritten, nil
+			}
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			if errors.Is(err, errSRSNotFound) {
+				return "", err
+			}
+			warnf(ctx, "srs: lookup at %s failed: %s", pool.addr, err)
+		}
+	}
+	return "", err
+}
+
+// lookupSRSAt looks up the SRS rewritten form of addr, or its reverse, at
+// the daemon connected to by pool, within --srs-timeout. Addresses the
+// daemon doesn't rewrite are returned unchanged.
+func lookupSRSAt(ctx context.Context, pool *connPool, addr string, reverse bool) (string, error) {
+	if *srsTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *srsTimeout)
+		defer cancel()
+	}
+	if err := srsFault(ctx); err != nil {
 		return "", err
 	}
+	var rewritten string
+	var err error
+	switch {
+	case *srsProto != "socketmap":
+		rewritten, err = lookupTCP(ctx, pool, addr)
+	case reverse:
+		rewritten, err = lookupSocketmap(ctx, pool, *srsReverseSocketmapName, addr)
+	default:
+		rewritten, err = lookupSocketmap(ctx, pool, *srsSocketmapName, addr)
+	}
+	if !reverse && errors.Is(err, errSRSNotFound) {
+		return addr, nil
+	}
+	return rewritten, err
+}
 
-	id, err := c.Cmd("get " + key)
+// builtinSRS returns the rewriter of built-in SRS rewriting, as configured
+// by --srs-secret-file, --srs-domain and the --srs-hash-* and --srs-max-age
+// parameters.
+func builtinSRS() (srsRewriter, error) {
+	if *srsDomain == "" {
+		return srsRewriter{}, temporaryError("--srs-domain is required with --srs-secret-file")
+	}
+	secret, err := readSRSSecret(*srsSecretFile)
 	if err != nil {
-		return "", err
+		return srsRewriter{}, temporaryError("Unable to read SRS secret: %w", err)
+	}
+	domain, err := domainToASCII(*srsDomain)
+	if err != nil {
+		return srsRewriter{}, temporaryError("Invalid --srs-domain: %w", err)
+	}
+	return srsRewriter{
+		secret:     secret,
+		domain:     domain,
+		hashLength: *srsHashLengthFlag,
+		maxAge:     *srsMaxAgeFlag,
+		newHash:    srsHashFunc(*srsHashAlgorithm),
+	}, nil
+}
+
+// srsForward returns the SRS rewritten form of the envelope sender addr, as
+// rewritten at time now by built-in rewriting when --srs-secret-file is given,
+// and looked up from the SRS daemon otherwise.
+func srsForward(ctx context.Context, addr string, now time.Time) (string, error) {
+	if *srsSecretFile != "" {
+		s, err := builtinSRS()
+		if err != nil {
+			return "", err
+		}
+		return s.forward(addr, now), nil
+	}
+	rewritten, err := lookupSRS(ctx, addr, false)
+	if err != nil {
+		notifyOutage(ctx, fmt.Sprintf("SRS lookup error: %s", err))
+		return "", temporaryError("SRS lookup error: %w", err)
+	}
+	return rewritten, nil
+}
+
+// srsReverse returns the original envelope sender the SRS address addr
+// stands for, reversed at time now by built-in rewriting when
+// --srs-secret-file is given, and looked up from the SRS daemon otherwise.
+// Forged and expired addresses are rejected with a permanent error.
+func srsReverse(ctx context.Context, addr string, now time.Time) (string, error) {
+	if *srsSecretFile != "" {
+		s, err := builtinSRS()
+		if err != nil {
+			return "", err
+		}
+		orig, err := s.reverse(addr, now)
+		if err != nil {
+			return "", withStatus("5.7.1", permanentError("Invalid SRS address %s: %w", addr, err))
+		}
+		return orig, nil
+	}
+	orig, err := lookupSRS(ctx, addr, true)
+	switch {
+	case errors.Is(err, errSRSNotFound):
+		return "", withStatus("5.7.1", permanentError("Invalid SRS address %s: not found by the SRS daemon", addr))
+	case err != nil:
+		notifyOutage(ctx, fmt.Sprintf("SRS lookup error: %s", err))
+		return "", temporaryError("SRS lookup error: %w", err)
 	}
-	c.StartResponse(id)
-	defer c.EndResponse(id)
+	return orig, nil
+}
 
-	code, msg, err := c.ReadCodeLine(-1)
+// parseSocket parses a socket specification in Postfix notation, either
+// unix:/path or inet:host:port, into a network and address for net.Dial.
+// IPv6 addresses are given in brackets, as in inet:[::1]:10001.
+func parseSocket(spec string) (network, address string, err error) {
+	kind, address, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "unix":
+		return "unix", address, nil
+	case "inet":
+		if err := checkHostPort(address); err != nil {
+			return "", "", err
+		}
+		return "tcp", address, nil
+	default:
+		return "", "", fmt.Errorf("invalid socket %q, expected unix:/path or inet:host:port", spec)
+	}
+}
+
+// dialContext connects to a server, arranging for pending I/O to fail when
+// ctx is done. The returned function closes the connection. Hosts with both
+// IPv6 and IPv4 addresses are dialed as in RFC 6555, Happy Eyeballs: when
+// IPv6 doesn't connect within 300ms, IPv4 is tried in parallel.
+func dialContext(ctx context.Context, network, addr string) (net.Conn, func(), error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	return conn, func() {
+		stop()
+		conn.Close()
+	}, nil
+}
+
+// lookupTCP performs a tcp_table(5) lookup for the specified key using a
+// connection from pool. The lookup is aborted when ctx is done.
+func lookupTCP(ctx context.Context, pool *connPool, key string) (string, error) {
+	var code int
+	var msg string
+	err := pool.do(ctx, func(c *textproto.Conn) error {
+		id, err := c.Cmd("get %s", key)
+		if err != nil {
+			return err
+		}
+		c.StartResponse(id)
+		defer c.EndResponse(id)
+
+		code, msg, err = c.ReadCodeLine(-1)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
@@ -55,80 +418,321 @@ func lookupTCP(addr, key string) (string, error) {
 	case 200:
 		return msg, nil
 	case 500:
-		fmt.Fprintf(os.Stderr, "warning: srs: returncode 500 (%v)\n", msg)
-		return key, nil
+		warnf(ctx, "srs: returncode 500 (%v)", msg)
+		return "", errSRSNotFound
 	default:
 		return "", fmt.Errorf("srs: unexpected returncode %d (%v)", code, msg)
 	}
 }
 
+// ctxErr returns the reason ctx is done when it is, and err otherwise. The
+// I/O errors resulting from cancellation are not helpful in diagnostics.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
 // die writes msg to stderr and aborts the program with the given status code.
-func die(msg string, code int) {
-	fmt.Fprintln(os.Stderr, msg)
+// The message is prefixed with the queue ID of the message processed in ctx.
+func die(ctx context.Context, msg string, code int) {
+	reportFailure(ctx, msg, code)
+	logf(ctx, msg)
 	os.Exit(code)
 }
 
-// headerRewriter wraps the given reader and performs header rewriting on read
-// data. Specifically, this strips the "From sender time_stamp" envelope header
-// inserted by Postfix and adds supplied headers.
+// reportFailure counts a failure while processing the message in ctx towards
+// the alert threshold, and reports permanent failures to the admin. Failures
+// are reported even when processing was canceled.
+func reportFailure(ctx context.Context, msg string, code int) {
+	if messageFrom(ctx).queueID == "" {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	recordStats(ctx, statsFailed)
+	writeSidecars(ctx, statsFailed, msg)
+	recordFailure(ctx, msg)
+	if code != ExTempFail {
+		notifyPermanentFailure(ctx, msg)
+	}
+}
+
+// headerFilter inspects a complete header field, including any continuation
+// lines, and returns the field to write in its place. Returning nil removes
+// the field from the message.
+type headerFilter func(field []byte) []byte
+
+// headerRewriter reads the header section from the given reader and performs
+// header rewriting on it. Specifically, this strips the "From sender
+// time_stamp" envelope header inserted by Postfix and passes every header
+// field through the given filters. It returns the
+// rewritten header section, including the empty line ending it, and a reader
+// for the body, which is passed through as-is.
 //
 // Note that the Return-Path header is left intact. Postfix (specifically,
 // the cleanup daemon) will replace this header automatically.
-func headerRewriter(in io.Reader, headers []string) io.Reader {
+func headerRewriter(in io.Reader, filters []headerFilter) (*bytes.Buffer, io.Reader, error) {
 	buffer := bytes.Buffer{}
 	reader := bufio.NewReader(in)
 	linenum := 0
+	var field []byte
+	flush := func() {
+		for _, filter := range filters {
+			if field == nil {
+				break
+			}
+			field = filter(field)
+		}
+		buffer.Write(field)
+		field = nil
+	}
 	for {
 		linenum++
 		line, err := reader.ReadBytes('\n')
 		if err != nil {
 			if err == io.EOF {
+				flush()
 				buffer.Write(line)
-				return &buffer
+				return &buffer, reader, nil
 			}
-			die(fmt.Sprintf("Unexpected error occurred while reading input: %s", err), ExTempFail)
+			return nil, nil, err
+		}
+
+		if linenum == 1 && bytes.HasPrefix(line, []byte("From ")) {
+			continue
+		}
+		// Continuation lines belong to the preceding header field.
+		if field != nil && (line[0] == ' ' || line[0] == '\t') {
+			field = append(field, line...)
+			continue
+		}
+		flush()
+		// The first empty line ends the header section. The body is passed
+		// through completely untouched.
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			buffer.Write(line)
+			return &buffer, reader, nil
 		}
+		field = line
+	}
+}
+
+// envelope holds the parts of a message's header section needed to forward
+// it.
+type envelope struct {
+	header mail.Header
+	// raw is the header section, including the empty line ending it.
+	raw        []byte
+	returnPath string
+}
+
+// readEnvelope parses the header section of the message read from in and
+// extracts the return-path from the rpHeader header. It returns a reader
+// which yields the complete message again, for use with headerRewriter. Only
+// the header section is held in memory, up to maxHeaderSize bytes; the body
+// is left to be streamed from in. When the return-path is missing, the
+// envelope is returned along with the error.
+func readEnvelope(in io.Reader, rpHeader string) (envelope, io.Reader, error) {
+	reader := bufio.NewReader(in)
+	var raw []byte
+	start := 0
+	for {
+		line, err := reader.ReadSlice('\n')
+		raw = append(raw, line...)
+		if len(raw) > maxHeaderSize {
+			return envelope{}, nil, fmt.Errorf("header section exceeds %d bytes", maxHeaderSize)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			// A message may consist of a header section alone, but not of
+			// part of a line: the input was cut short, e.g. by a dropped
+			// connection, and mustn't be forwarded half assembled.
+			switch {
+			case len(raw) == 0:
+				return envelope{}, nil, errors.New("empty input")
+			case raw[len(raw)-1] != '\n':
+				return envelope{}, nil, errors.New("input ends in the middle of the header section")
+			}
+			break
+		}
+		if err != nil {
+			return envelope{}, nil, err
+		}
+		if len(bytes.TrimRight(raw[start:], "\r\n")) == 0 {
+			break
+		}
+		start = len(raw)
+	}
+	message, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return envelope{}, nil, err
+	}
+	env := envelope{
+		header:     message.Header,
+		raw:        raw,
+		returnPath: message.Header.Get(rpHeader),
+	}
+	if env.returnPath == "" {
+		return env, nil, errors.New("Missing return-path header in message")
+	}
+	if rp := env.returnPath; len(rp) < 2 || rp[0] != '<' || rp[len(rp)-1] != '>' {
+		return env, nil, fmt.Errorf("invalid return-path %q, expected <address>", rp)
+	}
+	return env, io.MultiReader(bytes.NewReader(env.raw), reader), nil
+}
+
+// stripHeaders returns a headerFilter which removes the headers matching
+// the given names, which may be prefixes followed by "*".
+func stripHeaders(names ...string) headerFilter {
+	return func(field []byte) []byte {
+		if matchHeader(field, names) {
+			return nil
+		}
+		return field
+	}
+}
+
+// isHeader reports whether line starts a header field with one of the given
+// names. Header names are compared case-insensitively.
+func isHeader(line []byte, names []string) bool {
+	name := headerName(line)
+	for _, n := range names {
+		if strings.EqualFold(name, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerName returns the name of the header field starting at line, or an
+// empty string when line doesn't start a header field.
+func headerName(line []byte) string {
+	i := bytes.IndexByte(line, ':')
+	if i < 0 {
+		return ""
+	}
+	return string(bytes.TrimRight(line[:i], " \t"))
+}
 
-		if linenum == 1 {
-			lineEnding := guessLineEnding(line)
-			for _, header := range headers {
-				buffer.WriteString(header)
-				buffer.Write(lineEnding)
+// headerRecipients returns the addresses listed in the given headers of
+// message, along with the names of the headers which should be stripped from
+// the forwarded copy. The standard To and Cc headers are used for addressing
+// but left in place, all other headers are removed once they've been read.
+func headerRecipients(header mail.Header, names []string) (recipients []string, strip []string, err error) {
+	for _, name := range names {
+		name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if name != "To" && name != "Cc" {
+			strip = append(strip, name)
+		}
+		if len(header[name]) == 0 {
+			continue
+		}
+		addrs, err := header.AddressList(name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid address in %s header: %s", name, err)
+		}
+		for _, addr := range addrs {
+			// The addresses are passed to sendmail, where they mustn't be
+			// mistaken for options or local names.
+			if strings.HasPrefix(addr.Address, "-") || !strings.Contains(addr.Address, "@") {
+				return nil, nil, fmt.Errorf("invalid recipient %q in %s header", addr.Address, name)
 			}
+			recipients = append(recipients, addr.Address)
+		}
+	}
+	return recipients, strip, nil
+}
 
-			if bytes.HasPrefix(line, []byte("From ")) {
+// originalRecipientHeaders lists the headers checked for the original
+// recipient. Besides the header recipients, this includes the headers added by
+// Postfix local(8) and pipe(8) upon delivery.
+var originalRecipientHeaders = []string{"To", "Cc", "Delivered-To", "X-Original-To"}
+
+// addressedTo reports whether addr appears in one of the named headers of
+// the message. Addresses are compared case insensitively, using A-labels for
+// internationalized domains. Headers which can't be parsed are skipped.
+func addressedTo(header mail.Header, names []string, addr string) bool {
+	for _, name := range names {
+		for _, value := range header[name] {
+			addrs, err := mail.ParseAddressList(value)
+			if err != nil {
 				continue
 			}
+			for _, a := range addrs {
+				if ascii, err := addressToASCII(a.Address); err == nil && strings.EqualFold(ascii, addr) {
+					return true
+				}
+			}
 		}
-		// Remove From: header in case it exists
-		if bytes.HasPrefix(line, []byte("From: ")) {
-			continue
+	}
+	return false
+}
+
+// encodedWord matches an RFC 2047 encoded-word.
+var encodedWord = regexp.MustCompile(`=\?[^?\s]+\?[bBqQ]\?[^?\s]*\?=`)
+
+// decodeHeader decodes RFC 2047 encoded-words in a header value for display
+// in diagnostics. Encoded-words using unsupported character sets are left
+// as-is.
+func decodeHeader(v string) string {
+	dec := mime.WordDecoder{}
+	var out strings.Builder
+	last := 0
+	prevDecoded := false
+	for _, loc := range encodedWord.FindAllStringIndex(v, -1) {
+		between := v[last:loc[0]]
+		word, err := dec.Decode(v[loc[0]:loc[1]])
+		decoded := err == nil
+		// Whitespace between two adjacent encoded-words is not displayed.
+		if !(prevDecoded && decoded && strings.TrimSpace(between) == "") {
+			out.WriteString(between)
 		}
-		buffer.Write(line)
+		if decoded {
+			out.WriteString(word)
+		} else {
+			out.WriteString(v[loc[0]:loc[1]])
+		}
+		prevDecoded = decoded
+		last = loc[1]
 	}
+	out.WriteString(v[last:])
+	return out.String()
 }
 
+// hostname caches the result of getHostname.
+var hostname string
+
 // getHostname returns the system hostname. It tries to get the value from
 // postfix, falling back to os.Hostname() when that fails.
-func getHostname() string {
+func getHostname(ctx context.Context) string {
+	if hostname != "" {
+		return hostname
+	}
 	out, err := exec.Command("postconf", "-h", "myhostname").Output()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "warning: unable to get hostname from postfix (%v)\n", err)
-		hostname, _ := os.Hostname()
+		warnf(ctx, "unable to get hostname from postfix (%v)", err)
+		hostname, _ = os.Hostname()
 		return hostname
 	}
-	return string(bytes.TrimSpace(out))
+	hostname = string(bytes.TrimSpace(out))
+	return hostname
 }
 
 // guessLineEnding guesses the correct line endings to use based on the line
 // ending used in the supplied input line. This mimics postfix behavior, as
 // seen in sendmail.c:
 //
-// if (strip_cr == STRIP_CR_DUNNO && type == REC_TYPE_NORM) {
-//     if (VSTRING_LEN(buf) > 0 && vstring_end(buf)[-1] == '\r')
-//         strip_cr = STRIP_CR_DO;
-//     else
-//         strip_cr = STRIP_CR_DONT;
+//	if (strip_cr == STRIP_CR_DUNNO && type == REC_TYPE_NORM) {
+//	    if (VSTRING_LEN(buf) > 0 && vstring_end(buf)[-1] == '\r')
+//	        strip_cr = STRIP_CR_DO;
+//	    else
+//	        strip_cr = STRIP_CR_DONT;
 //
 // Note that based on http://www.postfix.org/postconf.5.html#sendmail_fix_line_endings,
 // we should be able to get away with hard-coding \r\n or \n as well.
@@ -141,25 +745,307 @@ func guessLineEnding(line []byte) []byte {
 
 func main() {
 	flag.Parse()
+	if err := loadEnvironment(); err != nil {
+		die(context.Background(), fmt.Sprintf("Invalid environment: %s", err), ExTempFail)
+	}
+	if *configFile != "" {
+		if err := loadConfig(*configFile); err != nil {
+			die(context.Background(), fmt.Sprintf("Invalid configuration file: %s", err), ExTempFail)
+		}
+	}
+	if flag.NArg() == 2 && flag.Arg(0) == "config" && flag.Arg(1) == "dump" {
+		dumpConfig(os.Stdout)
+		os.Exit(0)
+	}
+	if flag.NArg() >= 2 && flag.Arg(0) == "test" && strings.HasPrefix(flag.Arg(1), "-") {
+		os.Exit(testCorpus(flag.Args()[1:]))
+	}
+	if flag.NArg() >= 2 && flag.Arg(0) == "report" && strings.HasPrefix(flag.Arg(1), "-") {
+		os.Exit(usageReport(flag.Args()[1:]))
+	}
+	if flag.NArg() >= 2 && flag.Arg(0) == "probe" {
+		os.Exit(probeAddress(flag.Args()[1:]))
+	}
+	if flag.NArg() >= 2 && flag.Arg(0) == "verify-trace" && strings.HasPrefix(flag.Arg(1), "-") {
+		os.Exit(verifyTraceCommand(flag.Args()[1:]))
+	}
+	if *deterministic {
+		clk, ids, hostname = fixedClock{deterministicTime}, &sequentialIDs{}, deterministicHostname
+	}
+	if flag.NArg() >= 1 && flag.Arg(0) == "explain" {
+		os.Exit(explainMessage(flag.Args()[1:]))
+	}
+	// Processing is canceled on shutdown signals and when the timeout
+	// expires.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if *daemon != "" {
+		runDaemon(ctx)
+		return
+	}
+	if *policyService != "" {
+		runPolicyService(ctx)
+		return
+	}
+	ctx = withMessage(ctx, newMessageInfo())
+
+	// Processing functions only return errors. Their severity is mapped to an
+	// exit status here.
+	fail := func(err error) {
+		die(ctx, err.Error(), exitCode(err))
+	}
+	if *maxCPUTime > 0 {
+		if err := limitCPUTime(*maxCPUTime, fail); err != nil {
+			fail(temporaryError("Unable to set CPU time limit: %w", err))
+		}
+	}
+	if *maxMemory != "" {
+		limit, err := parseSize(*maxMemory)
+		if err != nil {
+			fail(temporaryError("Invalid --max-memory: %w", err))
+		}
+		limitMemory(limit, fail)
+	}
+	if err := configure(); err != nil {
+		fail(err)
+	}
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	if err := forward(ctx, os.Stdin, *origTo, flag.Args()); err != nil {
+		fail(err)
+	}
+}
+
+// runDaemon runs postforward in daemon mode until a shutdown signal cancels
+// ctx. Resource limits apply to the whole process, and thus can't be used.
+func runDaemon(ctx context.Context) {
+	switch {
+	case *maxCPUTime > 0 || *maxMemory != "":
+		die(ctx, "--max-cpu-time and --max-memory can't be used with --daemon", ExTempFail)
+	case *inputFormat != "pipe":
+		die(ctx, "--input-format can't be used with --daemon", ExTempFail)
+	case *origTo != "":
+		die(ctx, "--orig-to can't be used with --daemon, the LMTP recipient is used instead", ExTempFail)
+	}
+	if err := configure(); err != nil {
+		die(ctx, err.Error(), exitCode(err))
+	}
+	lanes, err := parseLanes(*laneSpecs, *laneConcurrency)
+	if err != nil {
+		die(ctx, fmt.Sprintf("Invalid --lane or --lane-concurrency: %s", err), ExTempFail)
+	}
+	if err := serveDaemon(ctx, *daemon, flag.Args(), lanes); err != nil {
+		die(ctx, fmt.Sprintf("Daemon error: %s", err), ExTempFail)
+	}
+}
+
+// runPolicyService runs postforward as a policy service until a shutdown
+// signal cancels ctx.
+func runPolicyService(ctx context.Context) {
+	switch {
+	case *maxCPUTime > 0 || *maxMemory != "":
+		die(ctx, "--max-cpu-time and --max-memory can't be used with --policy-service", ExTempFail)
+	case *origTo != "":
+		die(ctx, "--orig-to can't be used with --policy-service, the recipient of the request is used instead", ExTempFail)
+	}
+	if err := configure(); err != nil {
+		die(ctx, err.Error(), exitCode(err))
+	}
+	if err := servePolicy(ctx, *policyService, flag.Args()); err != nil {
+		die(ctx, fmt.Sprintf("Policy service error: %s", err), ExTempFail)
+	}
+}
+
+// configure applies the process wide settings given by the command line
+// flags.
+func configure() error {
+	if err := setupLogging(); err != nil {
+		return temporaryError("%w", err)
+	}
+	switch *addressCaseFlag {
+	case casePreserve, caseLower, caseNormalize:
+		addressCase = *addressCaseFlag
+	default:
+		return temporaryError("Invalid --address-case value: %s", *addressCaseFlag)
+	}
+	switch *srsPolicy {
+	case srsAlways, srsSPFNeeded, srsNever:
+	default:
+		return temporaryError("Invalid --srs-policy value: %s", *srsPolicy)
+	}
+	switch *expectOrigRecipient {
+	case "", "defer", "reject":
+	default:
+		return temporaryError("Invalid --expect-original-recipient value: %s", *expectOrigRecipient)
+	}
+	if *vacationMessage != "" && !stateConfigured() {
+		return temporaryError("--vacation-message requires --state-dir or --state-backend")
+	}
+	switch *forwardMode {
+	case modeResend, modeAttach:
+	default:
+		return temporaryError("Invalid --mode value: %s", *forwardMode)
+	}
+	if *srsSocket == "" {
+		if err := checkHostPorts("srs-addr", *srsAddr); err != nil {
+			return err
+		}
+		if err := checkHostPorts("srs-reverse-addr", *srsReverseAddr); err != nil {
+			return err
+		}
+	}
+	switch *srsHashAlgorithm {
+	case srsSHA1, srsSHA256:
+	default:
+		return temporaryError("Invalid --srs-hash-algorithm value: %s", *srsHashAlgorithm)
+	}
+	if max := srsMaxHashLength(*srsHashAlgorithm); *srsHashLengthFlag < 1 || *srsHashLengthFlag > max {
+		return temporaryError("Invalid --srs-hash-length: %d, expected 1 to %d", *srsHashLengthFlag, max)
+	}
+	if *srsMaxAgeFlag < 1 || *srsMaxAgeFlag >= srsTimeSlots {
+		return temporaryError("Invalid --srs-max-age: %d, expected 1 to %d", *srsMaxAgeFlag, srsTimeSlots-1)
+	}
+	switch *srsReverseMode {
+	case reverseNever, reverseAuto, reverseAlways:
+	default:
+		return temporaryError("Invalid --reverse value: %s", *srsReverseMode)
+	}
+	switch *dsnPolicy {
+	case dsnForward, dsnNoSRS, dsnReverse, dsnDiscard:
+	default:
+		return temporaryError("Invalid --dsn-policy value: %s", *dsnPolicy)
+	}
+	if *batvSecretFile != "" && *batvDomains == "" {
+		return temporaryError("--batv-secret-file requires --batv-domains")
+	}
+	if (*batvDomains != "" || *batvValidate) && *batvSecretFile == "" {
+		return temporaryError("--batv-domains and --batv-validate require --batv-secret-file")
+	}
+	switch *headerProfile {
+	case profileNone, profileMinimal:
+	default:
+		return temporaryError("Invalid --header-profile value: %s", *headerProfile)
+	}
+	switch *mdnPolicy {
+	case mdnPass, mdnStrip, mdnRewrite:
+	default:
+		return temporaryError("Invalid --mdn-policy value: %s", *mdnPolicy)
+	}
+	// With --input-format qf and in daemon mode, the original recipient is
+	// given per message, and checked by forward.
+	if *mdnPolicy == mdnRewrite && *origTo == "" && *inputFormat == "pipe" && *daemon == "" && *policyService == "" {
+		return temporaryError("--mdn-policy rewrite requires --orig-to")
+	}
+	if *maxSize != "" {
+		limit, err := parseSize(*maxSize)
+		if err != nil || limit == 0 {
+			return temporaryError("Invalid --max-size: %s", *maxSize)
+		}
+		messageSizeLimit = limit
+	}
+	if *stateBackend != "" {
+		if _, err := stateRedis(); err != nil {
+			return temporaryError("Invalid --state-backend: %w", err)
+		}
+	}
 	if *path != "" {
 		err := os.Setenv("PATH", *path)
 		if err != nil {
-			die(fmt.Sprintf("Unable to set $PATH: %s", err), ExTempFail)
+			return temporaryError("Unable to set $PATH: %w", err)
 		}
 	}
+	return nil
+}
 
-	buffer := bytes.Buffer{}
-	message, err := mail.ReadMessage(io.TeeReader(os.Stdin, &buffer))
+// forward forwards the message read from in, which was originally addressed
+// to origTo, to the given recipients and those resolved as configured by the
+// command line flags. Lookups and delivery are aborted when ctx is done.
+func forward(ctx context.Context, in io.Reader, origTo string, recipients []string) error {
+	msg := messageFrom(ctx)
+	input := io.Reader(countingReader{r: in, n: &msg.size})
+	if messageSizeLimit > 0 {
+		input = &sizeLimiter{r: input, limit: messageSizeLimit}
+	}
+	switch *inputFormat {
+	case "pipe":
+	case "qf":
+		qf, content, err := readQueueFile(input)
+		if err != nil {
+			return permanentError("Unable to read queue file: %w", err)
+		}
+		if origTo == "" && len(qf.origRecipients) == 1 {
+			origTo = qf.origRecipients[0]
+		}
+		input = content
+	default:
+		return temporaryError("Invalid --input-format value: %s", *inputFormat)
+	}
+
+	env, message, err := readEnvelope(input, *rpHeader)
+	msg.header = env.raw
+	msg.subject = env.header.Get("Subject")
+	msg.messageID = env.header.Get("Message-ID")
 	if err != nil {
-		die(fmt.Sprintf("Parse error: %s", err), ExDataErr)
+		return permanentError("Parse error: %w", err)
 	}
+	if msg.protection = protectedContent(env.header); msg.protection != "" {
+		infof(ctx, "message is %s, its content is passed through unmodified", msg.protection)
+	}
+	returnPath := env.returnPath
+	msg.returnPath = returnPath
+	explainf(ctx, "read message from %s with subject %q", returnPath, decodeHeader(msg.subject))
 
-	returnPath := message.Header.Get(*rpHeader)
-	if returnPath == "" {
-		die("Parse error: Missing return-path header in message", ExDataErr)
+	var original *os.File
+	var originalDigest []byte
+	if *keepCopySpec != "" || *shadow {
+		switch *keepCopyFailure {
+		case keepCopyDefer, keepCopyIgnore:
+		default:
+			return temporaryError("Invalid --keep-copy-failure value: %s", *keepCopyFailure)
+		}
+		// The copy is kept as received, and with --shadow the message is
+		// delivered as received, so it's spooled before it's rewritten.
+		h := sha256.New()
+		if original, err = spoolBody(io.TeeReader(message, h)); err != nil {
+			return temporaryError("Error spooling message: %w", err)
+		}
+		defer original.Close()
+		originalDigest = h.Sum(nil)
+		message = original
 	}
 
-	fromName := message.Header.Get("From")
+	report, spooled, err := classifyReport(ctx, env.header, message)
+	if err != nil {
+		return temporaryError("Error spooling message: %w", err)
+	}
+	if spooled != nil {
+		defer spooled.Close()
+		message = spooled
+		infof(ctx, "message is a %s", report)
+	}
+
+	trusted, err := parseHostList(*trustedHostsFlag)
+	if err != nil {
+		return temporaryError("Invalid --trusted-hosts: %w", err)
+	}
+	clientIP, problems := originatingIP(env.header, trusted)
+	msg.clientIP = clientIP
+	for _, problem := range problems {
+		warnf(ctx, "suspicious Received chain: %s", problem)
+	}
+	if clientIP != nil {
+		explainf(ctx, "originally submitted by client %s, according to the Received chain", clientIP)
+	}
+
+	masq := newMasquerader(*masqueradeDomains, *masqueradeExceptions, *masqueradeClasses)
+	fromName := env.header.Get("From")
+	if masq.applies("header_sender") {
+		fromName = string(masq.addressList([]byte(fromName)))
+	}
+	fromName = displayAddresses(fromName)
 	if fromName == "" {
 		fromName = "unknown (forwarded)"
 	} else {
@@ -167,32 +1053,786 @@ func main() {
 	}
 
 	extraHeaders := []string{
-		fmt.Sprintf("Received: by %s (Postforward); %s",
-			getHostname(), time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700")),
+		fmt.Sprintf("Received: by %s (Postforward) id %s; %s",
+			getHostname(ctx), msg.queueID, msg.arrival.Format("Mon, 2 Jan 2006 15:04:05 -0700")),
 		fmt.Sprintf("X-Original-Return-Path: %s", returnPath)}
 
-	returnPath = returnPath[1 : len(returnPath)-1] // Remove <> brackets
-	returnPath, err = lookupTCP(*srsAddr, returnPath)
+	var domains []string
+	if *virtualMap != "" || *senderCanonicalMap != "" || *recipientCanonicalMap != "" {
+		domains = localDomains(ctx, *localDomainList)
+	}
+	origTo, err = addressToASCII(foldCase(origTo))
 	if err != nil {
-		die(fmt.Sprintf("SRS lookup error: %s", err), ExTempFail)
+		return permanentError("Invalid --orig-to address: %w", err)
+	}
+	// The original recipient is only known per message, as with --input-format
+	// qf and in daemon mode, so flags requiring it are checked here. Missing
+	// it is a configuration error, which defers mail until it's fixed.
+	if *expectOrigRecipient != "" {
+		if origTo == "" {
+			return temporaryError("--expect-original-recipient requires --orig-to")
+		}
+		if !addressedTo(env.header, originalRecipientHeaders, origTo) {
+			if *expectOrigRecipient == "defer" {
+				return withStatus("4.7.1", temporaryError("Message is not addressed to %s", origTo))
+			}
+			return withStatus("5.7.1", permanentError("Message is not addressed to %s", origTo))
+		}
+		explainf(ctx, "message is addressed to %s, as --expect-original-recipient requires", origTo)
+	}
+	if *vacationMessage != "" && origTo == "" {
+		return temporaryError("--vacation-message requires --orig-to")
+	}
+	if *mdnPolicy == mdnRewrite && origTo == "" {
+		return temporaryError("--mdn-policy rewrite requires --orig-to")
+	}
+	if *recipientCanonicalMap != "" && origTo != "" {
+		m, err := loadAddressMap(ctx, *recipientCanonicalMap, domains)
+		if err != nil {
+			return temporaryError("Unable to read recipient canonical map: %w", err)
+		}
+		canonical, err := m.canonicalize(ctx, origTo)
+		if err != nil {
+			return temporaryError("Recipient canonical map lookup error: %w", err)
+		}
+		explainf(ctx, "recipient canonical map %s: %s", *recipientCanonicalMap, explainMapping(origTo, canonical))
+		origTo = canonical
+	}
+	// Bounces to tagged envelope senders are received for the prvs
+	// address, which is processed as the address it stands for.
+	var batv *batvSigner
+	if *batvSecretFile != "" {
+		signer, err := loadBATVSigner()
+		if err != nil {
+			return err
+		}
+		batv = &signer
+		if origTo != "" {
+			_, err := batv.verify(origTo, msg.arrival)
+			if err != nil && *batvValidate && returnPath == "<>" && batvDomain(origTo) {
+				return withStatus("5.7.1", permanentError("Bounce to %s has no valid BATV tag: %w", origTo, err))
+			}
+			if untagged, _, ok := splitPRVS(origTo); ok {
+				debugf(ctx, "removed BATV tag from %s", origTo)
+				origTo = untagged
+			}
+		}
+	}
+	msg.origTo = origTo
+	if origTo != "" {
+		explainf(ctx, "original recipient is %s", origTo)
+	}
+	if *forwardMode == modeAttach && origTo == "" {
+		return temporaryError("--mode attach requires --orig-to")
+	}
+	if *detectLoops && origTo == "" {
+		return temporaryError("--detect-loops requires --orig-to")
+	}
+	// recorded is the form of origTo in the header fields added to the
+	// message, which reveal the forwarding destinations of previous hops
+	// otherwise.
+	recorded := origTo
+	if *privateDestination && origTo != "" {
+		if recorded, err = privateAddress(origTo); err != nil {
+			return err
+		}
+	}
+	if err := detectLoop(env.header, origTo, recorded); err != nil {
+		return err
+	}
+	if err := detectOwnLoop(ctx, env.header, msg.arrival); err != nil {
+		return err
+	}
+	explainf(ctx, "no mail forwarding loop detected")
+	if *detectLoops {
+		extraHeaders = append(extraHeaders, loopField(recorded))
+	}
+	// reversed is the original sender a bounce sent to an SRS address is
+	// returned to.
+	var reversed string
+	if *srsReverseMode != reverseNever && origTo == "" {
+		return temporaryError("--reverse requires --orig-to")
+	}
+	if report != nil && origTo == "" && *dsnPolicy == dsnReverse {
+		return temporaryError("--dsn-policy reverse requires --orig-to")
+	}
+	if report != nil && *dsnPolicy == dsnDiscard {
+		infof(ctx, "discarding %s, as set by --dsn-policy", report)
+		return nil
+	}
+	if *srsReverseMode == reverseAlways || (*srsReverseMode == reverseAuto && isSRSAddress(origTo)) ||
+		(report != nil && *dsnPolicy == dsnReverse) {
+		if reversed, err = srsReverse(ctx, origTo, msg.arrival); err != nil {
+			return err
+		}
+		infof(ctx, "returning message to %s to the original sender %s", origTo, reversed)
+	}
+	if (*addDeliveredTo || *addOriginalTo) && origTo == "" {
+		return temporaryError("--add-delivered-to and --add-original-to require --orig-to")
+	}
+	// Like Postfix, the address is added without angle brackets, which
+	// destination filters such as Gmail's deliveredto: match on.
+	if *addDeliveredTo && !addressedTo(env.header, []string{"Delivered-To"}, origTo) {
+		extraHeaders = append(extraHeaders, "Delivered-To: "+recorded)
+	}
+	if *addOriginalTo && !addressedTo(env.header, []string{"X-Original-To"}, origTo) {
+		extraHeaders = append(extraHeaders, "X-Original-To: "+recorded)
 	}
 
-	mailreader := io.MultiReader(headerRewriter(&buffer, extraHeaders), os.Stdin)
-	args := append([]string{"-i", "-f", returnPath, "-F", fromName}, flag.Args()...)
-	sendmail := exec.Command(*sendmailPath, args...)
-	sendmail.Stdin = mailreader
-	sendmail.Stdout = os.Stdout
-	sendmail.Stderr = os.Stderr
+	// Remove the From: header in case it exists, except from returned
+	// bounces, which have no sender to put in its place.
+	var strip []string
+	if reversed == "" {
+		strip = append(strip, "From")
+	}
+	// Read receipts would reveal the final destination to the sender, so
+	// their requests may be removed, or point to the forwarding address.
+	if *mdnPolicy != mdnPass || *privateDestination {
+		strip = append(strip, mdnRequestHeaders...)
+		if requester := env.header.Get("Disposition-Notification-To"); requester != "" {
+			debugf(ctx, "removing read receipt request to %s", requester)
+			if *mdnPolicy == mdnRewrite {
+				extraHeaders = append(extraHeaders, "Disposition-Notification-To: <"+origTo+">")
+			}
+		}
+	}
+	recipients = append([]string(nil), recipients...)
+	if len(recipients) > 0 {
+		explainf(ctx, "recipients given on the command line: %s", strings.Join(recipients, ", "))
+	}
+	if *recipientsFromHeader != "" {
+		extra, names, err := headerRecipients(env.header, strings.Split(*recipientsFromHeader, ","))
+		if err != nil {
+			return permanentError("Parse error: %w", err)
+		}
+		explainf(ctx, "recipients taken from the header fields %s: %s", strings.Join(names, ", "), explainList(extra))
+		recipients = append(recipients, extra...)
+		strip = append(strip, names...)
+	}
+	dests, err := lookupRecipients(ctx, origTo, domains)
+	if err != nil {
+		return err
+	}
+	recipients = append(recipients, dests...)
+	if *forwardWindow != "" {
+		windows, err := parseSchedule(*forwardWindow)
+		if err != nil {
+			return temporaryError("Invalid --forward-window: %w", err)
+		}
+		loc, err := time.LoadLocation(*forwardWindowTimezone)
+		if err != nil {
+			return temporaryError("Invalid --forward-window-timezone: %w", err)
+		}
+		if !inSchedule(windows, msg.arrival.In(loc)) {
+			if *outsideWindowRecipients == "" {
+				return withStatus("4.3.2", temporaryError("Outside of forwarding window, deferring message"))
+			}
+			infof(ctx, "outside of forwarding window, forwarding to %s instead", *outsideWindowRecipients)
+			recipients = splitAddressList(*outsideWindowRecipients)
+		} else {
+			explainf(ctx, "arrived within --forward-window %s", *forwardWindow)
+		}
+	}
+	if reversed != "" {
+		recipients = []string{reversed}
+	}
+	msg.recipients = recipients
+	if len(recipients) == 0 {
+		return permanentError("No recipients specified")
+	}
+	if *detectVerificationFlag {
+		if provider, code, ok := detectVerification(env.header); ok {
+			reportVerification(ctx, provider, code, recipients)
+		}
+	}
 
-	if *dryRun {
-		fmt.Printf("Would call sendmail with args: %v\n", args)
-		fmt.Print("Would pipe the following data into sendmail:\n\n")
-		io.Copy(os.Stdout, mailreader)
-		os.Exit(0)
+	returnPath = foldCase(returnPath[1 : len(returnPath)-1]) // Remove <> brackets, checked by readEnvelope
+	returnPath, err = addressToASCII(returnPath)
+	if err != nil {
+		return permanentError("Parse error: invalid return-path: %w", err)
+	}
+	if *senderCanonicalMap != "" && returnPath != "" {
+		m, err := loadAddressMap(ctx, *senderCanonicalMap, domains)
+		if err != nil {
+			return temporaryError("Unable to read sender canonical map: %w", err)
+		}
+		canonical, err := m.canonicalize(ctx, returnPath)
+		if err != nil {
+			return temporaryError("Sender canonical map lookup error: %w", err)
+		}
+		explainf(ctx, "sender canonical map %s: %s", *senderCanonicalMap, explainMapping(returnPath, canonical))
+		returnPath = canonical
+	}
+	if masq.applies("envelope_sender") {
+		if masqueraded := masq.address(returnPath); masqueraded != returnPath {
+			explainf(ctx, "masquerading return-path %s as %s", returnPath, masqueraded)
+			returnPath = masqueraded
+		}
+	}
+	for i, r := range recipients {
+		if masq.applies("envelope_recipient") {
+			r = masq.address(r)
+		}
+		if recipients[i], err = addressToASCII(r); err != nil {
+			return permanentError("Invalid recipient address %s: %s", r, err)
+		}
+	}
+	if len(rules) > 0 && reversed == "" {
+		var expired *forwardRule
+		if recipients, expired = activeRecipients(ctx, recipients, msg.arrival); expired != nil {
+			reason := expired.expiredMessage
+			if reason == "" {
+				reason = defaultExpiredMessage
+			}
+			// The address existed, but is disabled now.
+			return withStatus("5.2.1", noUserError("%s", reason))
+		}
+		key := strings.TrimSpace(env.header.Get("Message-ID"))
+		if key == "" {
+			key = string(env.raw)
+		}
+		recipients = splitRecipients(ctx, recipients, key)
+	}
+	submissions := groupRecipients(recipients)
+	for _, sub := range submissions {
+		if sub.rule != nil {
+			explainf(ctx, "%s rule %s applies to %s", sub.rule.kind, sub.rule.match, strings.Join(sub.recipients, ", "))
+		}
+	}
+	if *archiveBcc != "" {
+		archive, err := addressToASCII(foldCase(*archiveBcc))
+		if err != nil {
+			return temporaryError("Invalid --archive-bcc address: %w", err)
+		}
+		explainf(ctx, "adding archive recipient %s", archive)
+		submissions = addArchive(submissions, archive)
+	}
+	var srsReturnPath string
+	rewritten := false
+	for _, sub := range submissions {
+		switch {
+		case reversed != "":
+			// Returned bounces keep their null sender.
+			sub.returnPath = returnPath
+			explainf(ctx, "returned bounce keeps the null sender")
+		case sub.rule != nil && sub.rule.sender != "":
+			sub.returnPath = sub.rule.sender
+			explainf(ctx, "%s rule %s sets the return-path to %s", sub.rule.kind, sub.rule.match, sub.returnPath)
+		case *forwardMode == modeAttach:
+			// The forwarded message is from the forwarding address, so
+			// its bounces are as well.
+			sub.returnPath = origTo
+			explainf(ctx, "--mode attach sends the message from %s", origTo)
+		case sub.rule != nil && sub.rule.noSRS, report != nil && *dsnPolicy == dsnNoSRS:
+			sub.returnPath = returnPath
+			explainf(ctx, "not rewriting return-path %s for %s", returnPath, strings.Join(sub.recipients, ", "))
+		default:
+			if !rewritten {
+				needed, err := srsNeeded(ctx, returnPath)
+				if err != nil {
+					return err
+				}
+				srsReturnPath = returnPath
+				if needed {
+					if srsReturnPath, err = srsForward(ctx, returnPath, msg.arrival); err != nil {
+						return err
+					}
+					debugf(ctx, "rewrote return-path %s to %s", returnPath, srsReturnPath)
+				} else {
+					debugf(ctx, "not rewriting return-path %s, as allowed by --srs-policy %s", returnPath, *srsPolicy)
+				}
+				rewritten = true
+			}
+			sub.returnPath = srsReturnPath
+		}
+		if batv != nil && sub.returnPath != "" && batvDomain(sub.returnPath) {
+			if _, _, ok := splitPRVS(sub.returnPath); !ok {
+				sub.returnPath = batv.sign(sub.returnPath, msg.arrival)
+				explainf(ctx, "tagged return-path with BATV as %s", sub.returnPath)
+			}
+		}
 	}
 
-	if err = sendmail.Run(); err != nil {
-		die(fmt.Sprintf("Error delivering message to sendmail: %s", err), ExTempFail)
+	var signer *dkimSigner
+	if *dkimKey != "" {
+		if *dkimDomain == "" || *dkimSelector == "" {
+			return temporaryError("--dkim-domain and --dkim-selector are required with --dkim-key")
+		}
+		s, err := loadDKIMSigner(*dkimKey, *dkimDomain, *dkimSelector)
+		if err != nil {
+			return temporaryError("Unable to read DKIM key: %w", err)
+		}
+		signer = &s
+	}
+	var traceSigner *dkimSigner
+	if *traceKey != "" {
+		s, err := loadDKIMSigner(*traceKey, "", "")
+		if err != nil {
+			return temporaryError("Unable to read trace key: %w", err)
+		}
+		traceSigner = &s
+	}
+	var keyTable *dkimKeyTable
+	if *dkimKeyTablePath != "" {
+		if keyTable, err = loadDKIMKeyTable(ctx, *dkimKeyTablePath); err != nil {
+			return temporaryError("Unable to read DKIM key table: %w", err)
+		}
+	}
+	// signers holds the signer of every submission. With a key table, mail
+	// is signed on behalf of the domain of its From header, which is that
+	// of the return-path, or else the forwarding domain.
+	signers := map[*submission]*dkimSigner{}
+	for _, sub := range submissions {
+		signers[sub] = signer
+		if keyTable == nil {
+			continue
+		}
+		_, fromDomain := splitAddress(sub.returnPath)
+		_, forwardingDomain := splitAddress(origTo)
+		s, err := keyTable.signer(fromDomain, forwardingDomain)
+		if err != nil {
+			return temporaryError("Unable to read DKIM key: %w", err)
+		}
+		if s != nil {
+			signers[sub] = s
+		}
+	}
+	for _, sub := range submissions {
+		if s := signers[sub]; s != nil {
+			explainf(ctx, "DKIM signing mail to %s as d=%s, s=%s", strings.Join(sub.recipients, ", "), s.domain, s.selector)
+		}
+	}
+	var sealer *dkimSigner
+	if *arcKey != "" {
+		if *arcDomain == "" || *arcSelector == "" {
+			return temporaryError("--arc-domain and --arc-selector are required with --arc-key")
+		}
+		s, err := loadDKIMSigner(*arcKey, *arcDomain, *arcSelector)
+		if err != nil {
+			return temporaryError("Unable to read ARC key: %w", err)
+		}
+		sealer = &s
+		explainf(ctx, "ARC sealing as d=%s, s=%s", s.domain, s.selector)
+	}
+	authEnabled := *authResultsEnabled || sealer != nil
+	servID := *authservID
+	if servID == "" {
+		servID = getHostname(ctx)
 	}
 
+	var addedHeaders []string
+	var filters []headerFilter
+	if *forwardMode == modeAttach && reversed == "" {
+		// The original message is attached unchanged, the filters only
+		// apply to the header of the new message.
+		to := recipients
+		if *privateDestination {
+			to = []string{origTo}
+		}
+		if message, err = attachMessage(ctx, env.header, message, origTo, to); err != nil {
+			return temporaryError("Unable to read --attach-text-file: %w", err)
+		}
+	} else {
+		strip = append(strip, *stripHeaderNames...)
+		if *headerProfile == profileMinimal {
+			strip = append(strip, minimalHeaders...)
+			filters = append(filters, stripInternalAuthResults(servID, splitAddressList(*internalDomains)))
+		}
+		filters = append(filters, stripHeaders(strip...))
+		explainf(ctx, "removing the header fields %s", strings.Join(strip, ", "))
+		if recorded != origTo {
+			filters = append(filters, privateTrace(origTo, recorded))
+		}
+	}
+	if *externalHeader != "" || *externalSubjectTag != "" {
+		networks, err := parseHostList(*internalNetworks)
+		if err != nil {
+			return temporaryError("Invalid --internal-networks: %w", err)
+		}
+		if isExternal(clientIP, strings.Trim(msg.returnPath, "<>"), networks, splitAddressList(*internalDomains)) {
+			explainf(ctx, "message is external")
+			if *externalHeader != "" {
+				addedHeaders = append(addedHeaders, *externalHeader)
+			}
+			if *externalSubjectTag != "" {
+				filters = append(filters, subjectTagger(*externalSubjectTag))
+			}
+		}
+	}
+	addedHeaders = append(addedHeaders, *addHeaders...)
+	if masq.enabled() {
+		filters = append(filters, masq.headerFilter())
+	}
+	if *foldHeaders {
+		filters = append(filters, headerFolder())
+	}
+	rewrittenHeader, body, err := headerRewriter(message, filters)
+	if err != nil {
+		return temporaryError("Unexpected error occurred while reading input: %w", err)
+	}
+	received := sha256.New()
+	body = io.TeeReader(body, received)
+	var spool *os.File
+	var bodyHashes map[string][]byte
+	var results []authResult
+	if *digestHeaderEnabled || *attachmentManifest || signer != nil || keyTable != nil || authEnabled || len(submissions) > 1 || messageSizeLimit > 0 || *fallbackMaildir != "" || (*deliver != "" && *downgrade8bitFlag) {
+		// The digests have to be known before the header section is written,
+		// and each submission needs its own copy, so the whole body is read
+		// up front. With --max-size, it's read up front so an oversized
+		// message is never partially delivered, with --fallback-maildir
+		// so it can be stored after delivery failed, and with
+		// --downgrade-8bit so it can be converted before it's signed.
+		spool, bodyHashes, err = spoolHashedBody(body)
+		if err != nil {
+			return temporaryError("Error spooling message body: %w", err)
+		}
+		defer spool.Close()
+		if authEnabled {
+			ip := clientIP
+			if ip != nil && trusted.containsIP(ip) {
+				// Locally submitted mail isn't subject to SPF.
+				ip = nil
+			}
+			results = authenticate(ctx, env.raw, env.header, bodyHashes, ip, strings.Trim(msg.returnPath, "<>"), msg.arrival)
+			msg.verdicts = results
+		}
+	}
+
+	if *attachmentManifest {
+		info, err := spool.Stat()
+		if err != nil {
+			return temporaryError("Error reading spooled message body: %w", err)
+		}
+		// The header the body belongs to, which with --mode attach is the
+		// one of the new message.
+		header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(rewrittenHeader.Bytes()))).ReadMIMEHeader()
+		if err != nil {
+			return temporaryError("Unexpected error occurred while reading input: %w", err)
+		}
+		found, err := attachments(header, io.NewSectionReader(spool, 0, info.Size()))
+		if err != nil {
+			warnf(ctx, "attachment manifest may be incomplete: %s", err)
+		}
+		for _, a := range found {
+			addedHeaders = append(addedHeaders, a.field())
+		}
+	}
+
+	msg.addedHeaders = append(append([]string(nil), extraHeaders...), addedHeaders...)
+	for _, field := range msg.addedHeaders {
+		explainf(ctx, "adding header field %s", field)
+	}
+
+	// composeHeader returns the header section forwarded in sub: the
+	// rewritten header of the message, with the header fields added by
+	// postforward and the rule of sub in front of it.
+	composeHeader := func(sub *submission) *bytes.Buffer {
+		fields := append([]string(nil), extraHeaders...)
+		signer := signers[sub]
+		if (*deliver != "" || signer != nil || sealer != nil) && sub.returnPath != "" && *forwardMode == modeResend && reversed == "" {
+			// sendmail adds a From header using the -F full name. When
+			// submitting via SMTP, nothing else does, and when signing or
+			// sealing, the header has to be there already.
+			from := mail.Address{Name: fromName, Address: sub.returnPath}
+			fields = append(fields, "From: "+from.String())
+		}
+		fields = append(fields, addedHeaders...)
+		if sub.rule != nil {
+			fields = append(fields, sub.rule.headers...)
+		}
+		raw := rewrittenHeader.Bytes()
+		eol := guessLineEnding(raw[:bytes.IndexByte(raw, '\n')+1])
+		header := &bytes.Buffer{}
+		for _, field := range fields {
+			line := append([]byte(field), eol...)
+			if *foldHeaders {
+				line = foldField(line, foldLineLength)
+			}
+			header.Write(line)
+		}
+		header.Write(raw)
+
+		if traceSigner != nil {
+			field, err := traceSigner.signTrace(header.Bytes(), len(extraHeaders), msg.arrival)
+			if err != nil {
+				warnf(ctx, "not signing trace header fields: %s", err)
+			} else {
+				header = bytes.NewBuffer(append(field, header.Bytes()...))
+			}
+		}
+		if *digestHeaderEnabled {
+			header = bytes.NewBuffer(append(digestField(received.Sum(nil), header.Bytes()), header.Bytes()...))
+		}
+		if authEnabled {
+			field := authResultsField(servID, results, eol)
+			if *foldHeaders {
+				field = foldField(field, foldLineLength)
+			}
+			header = bytes.NewBuffer(append(field, header.Bytes()...))
+		}
+		if signer != nil {
+			field, err := signer.sign(header.Bytes(), bodyHashes[canonRelaxed], msg.arrival)
+			if err != nil {
+				warnf(ctx, "not DKIM signing message: %s", err)
+			} else {
+				header = bytes.NewBuffer(append(field, header.Bytes()...))
+			}
+		}
+		if sealer != nil {
+			chain, err := arcChain(splitHeaderFields(env.raw))
+			switch {
+			case err != nil:
+				warnf(ctx, "not ARC sealing message: %s", err)
+			case len(chain) > 0 && chain[len(chain)-1].failed():
+				warnf(ctx, "not ARC sealing message: received ARC chain already failed")
+			default:
+				field, err := sealer.seal(header.Bytes(), chain, resultOf(results, "arc"), servID, results, bodyHashes[canonRelaxed], msg.arrival)
+				if err != nil {
+					warnf(ctx, "not ARC sealing message: %s", err)
+				} else {
+					header = bytes.NewBuffer(append(field, header.Bytes()...))
+				}
+			}
+		}
+		return header
+	}
+	logDigests := func(delivered hash.Hash) {
+		if !*logDigest {
+			return
+		}
+		receivedSum, deliveredSum := received.Sum(nil), delivered.Sum(nil)
+		infof(ctx, "Body digest as received sha256=%x, as delivered sha256=%x", receivedSum, deliveredSum)
+		if !bytes.Equal(receivedSum, deliveredSum) {
+			warnf(ctx, "Body digests as received and as delivered differ")
+		}
+	}
+	var delivery smtpDelivery
+	if *deliver != "" {
+		if delivery, err = parseDelivery(*deliver, *deliverTLS, *deliverPasswordFile, *downgrade8bitFlag); err != nil {
+			return temporaryError("Invalid --deliver: %w", err)
+		}
+	}
+	if msg.explaining {
+		if *keepCopySpec != "" {
+			explainf(ctx, "would keep a copy in %s", *keepCopySpec)
+		}
+		if *fallbackMaildir != "" {
+			explainf(ctx, "would store the message in %s if forwarding fails", *fallbackMaildir)
+		}
+	} else if *dryRun {
+		fmt.Printf("Would forward message from %s with subject %q\n",
+			decodeHeader(env.header.Get("From")), decodeHeader(env.header.Get("Subject")))
+		if clientIP != nil {
+			fmt.Printf("Message was originally submitted by client %s\n", clientIP)
+		}
+		if *keepCopySpec != "" {
+			fmt.Printf("Would keep a copy in %s\n", *keepCopySpec)
+		}
+		if *fallbackMaildir != "" {
+			fmt.Printf("Would store the message in %s if forwarding fails\n", *fallbackMaildir)
+		}
+	} else {
+		if *greylistEnabled {
+			rcpt := origTo
+			if rcpt == "" {
+				rcpt = strings.Join(recipients, ",")
+			}
+			deferred, err := greylist(strings.Trim(msg.returnPath, "<>"), rcpt)
+			if err != nil {
+				return temporaryError("Greylisting error: %w", err)
+			}
+			if deferred != nil && *shadow {
+				infof(ctx, "shadow: would defer delivery: %s", deferred)
+			} else if deferred != nil {
+				return withStatus("4.7.1", temporaryError("Delivery deferred: %w", deferred))
+			}
+		}
+
+		if *paceRates != "" || *paceConcurrencyFlag != "" {
+			rates, err := parsePaceRates(*paceRates)
+			if err != nil {
+				return temporaryError("Invalid --pace: %w", err)
+			}
+			concurrency, err := parsePaceConcurrency(*paceConcurrencyFlag)
+			if err != nil {
+				return temporaryError("Invalid --pace-concurrency: %w", err)
+			}
+			var all []string
+			for _, sub := range submissions {
+				all = append(all, sub.recipients...)
+			}
+			release, err := pace(all, rates, concurrency)
+			if err != nil {
+				return temporaryError("Delivery deferred: %w", err)
+			}
+			defer release()
+		}
+
+		// Keeping the copy first means it isn't lost when forwarding fails
+		// for good. Retries don't store it again, see keepCopy.
+		if *keepCopySpec != "" {
+			if err := keepCopy(ctx, original, originalDigest, origTo); err != nil {
+				if *keepCopyFailure == keepCopyDefer {
+					return temporaryError("Unable to keep a copy in %s: %w", *keepCopySpec, ctxErr(ctx, err))
+				}
+				warnf(ctx, "unable to keep a copy in %s: %s", *keepCopySpec, err)
+			}
+		}
+	}
+
+	// 8-bit messages are converted before the header is composed, so the
+	// DKIM and ARC signatures cover the message as delivered. Whether the
+	// server needs that is only known once it was greeted.
+	if delivery.downgrade && msg.protection == "" && !*dryRun && !*shadow {
+		content, err := io.ReadAll(io.MultiReader(bytes.NewReader(rewrittenHeader.Bytes()), spool))
+		if err != nil {
+			return temporaryError("Error reading spooled message body: %w", err)
+		}
+		if has8bit(content) {
+			offered, err := delivery.offers8BITMIME(ctx, getHostname(ctx))
+			if err != nil {
+				return err
+			}
+			if converted, changed := downgrade8bit(content); !offered && changed {
+				infof(ctx, "%s does not offer 8BITMIME, converted the message to 7-bit", delivery.addr)
+				header, convertedBody := splitEntity(converted)
+				rewrittenHeader = bytes.NewBuffer(header)
+				spool, bodyHashes, err = spoolHashedBody(bytes.NewReader(convertedBody))
+				if err != nil {
+					return temporaryError("Error spooling message body: %w", err)
+				}
+				defer spool.Close()
+			}
+		}
+	}
+
+	// With --shadow, the original message is delivered, and stored in
+	// --fallback-maildir, instead of the rewritten one.
+	var shadowed []byte
+	if *shadow && !*dryRun {
+		content, err := originalContent(original)
+		if err == nil {
+			shadowed, err = io.ReadAll(content)
+		}
+		if err != nil {
+			return temporaryError("Error reading spooled message: %w", err)
+		}
+	}
+	// A failed submission doesn't stop the others. With --state-dir, those
+	// which succeeded are recorded, so retrying the message only repeats the
+	// failed ones.
+	var failed error
+	for _, sub := range submissions {
+		if spool != nil {
+			if _, err := spool.Seek(0, io.SeekStart); err != nil {
+				return temporaryError("Error reading spooled message body: %w", err)
+			}
+			body = spool
+		}
+		delivered := sha256.New()
+		var mailreader io.Reader = io.MultiReader(composeHeader(sub), io.TeeReader(body, delivered))
+		sender := sub.returnPath
+		if *shadow && !*dryRun {
+			// The message is rewritten as usual, but only logged, and the
+			// original is delivered instead.
+			n, err := io.Copy(io.Discard, mailreader)
+			if err != nil {
+				return temporaryError("Unexpected error occurred while reading input: %w", err)
+			}
+			infof(ctx, "shadow: would forward %d bytes from <%s> to %s", n, sub.returnPath, strings.Join(sub.recipients, ", "))
+			mailreader, sender = bytes.NewReader(shadowed), strings.Trim(msg.returnPath, "<>")
+		}
+		args := append([]string{"-i", "-f", sender, "-F", fromName, "--"}, sub.recipients...)
+		sendmail := exec.CommandContext(ctx, *sendmailPath, args...)
+		sendmail.Stdin = mailreader
+		sendmail.Stdout = os.Stdout
+		sendmail.Stderr = os.Stderr
+
+		if msg.explaining {
+			via := "sendmail"
+			if *deliver != "" {
+				via = *deliver
+			}
+			explainf(ctx, "would forward to %s from <%s> via %s", strings.Join(sub.recipients, ", "), sub.returnPath, via)
+			continue
+		}
+		if *dryRun {
+			if *deliver != "" {
+				fmt.Printf("Would deliver to %s from %s to %v\n", *deliver, sub.returnPath, sub.recipients)
+				fmt.Print("Would submit the following data:\n\n")
+			} else {
+				fmt.Printf("Would call sendmail with args: %v\n", args)
+				fmt.Print("Would pipe the following data into sendmail:\n\n")
+			}
+			io.Copy(os.Stdout, mailreader)
+			logDigests(delivered)
+			continue
+		}
+
+		var key string
+		if len(submissions) > 1 && stateConfigured() {
+			key = submissionKey(env.raw, sub)
+			done, err := submitted(key)
+			if err != nil {
+				return temporaryError("Unable to read submission state: %w", err)
+			}
+			if done {
+				infof(ctx, "already forwarded to %s, not submitting again", strings.Join(sub.recipients, ", "))
+				continue
+			}
+		}
+		debugf(ctx, "submitting from %s to %s", sender, strings.Join(sub.recipients, ", "))
+		if *deliver != "" {
+			err = delivery.deliver(ctx, getHostname(ctx), sender, sub.recipients, mailreader)
+		} else {
+			err = sendmail.Run()
+		}
+		logForwarded(ctx, sub, err)
+		if err != nil && *fallbackMaildir != "" && exitCode(err) == ExTempFail {
+			content := io.MultiReader(composeHeader(sub), spool)
+			if *shadow {
+				content = bytes.NewReader(shadowed)
+			}
+			if _, serr := spool.Seek(0, io.SeekStart); serr != nil {
+				warnf(ctx, "unable to store the message in %s: %s", *fallbackMaildir, serr)
+			} else if serr = storeFallback(ctx, sub, content, err); serr != nil {
+				warnf(ctx, "unable to store the message in %s: %s", *fallbackMaildir, serr)
+			} else {
+				recordDelivery(ctx, sub, deliveryStored, err)
+				continue
+			}
+		}
+		if err != nil {
+			recordDelivery(ctx, sub, deliveryFailed, err)
+			if *deliver == "" {
+				err = temporaryError("Error delivering message to sendmail: %w", ctxErr(ctx, err))
+			}
+			// Temporary failures take precedence, so the message is retried.
+			if failed == nil || exitCode(err) == ExTempFail {
+				failed = err
+			}
+			if ctx.Err() != nil {
+				return failed
+			}
+			continue
+		}
+		recordDelivery(ctx, sub, deliveryForwarded, nil)
+		if key != "" {
+			if err := recordSubmission(key); err != nil {
+				warnf(ctx, "unable to record submission to %s: %s", strings.Join(sub.recipients, ", "), err)
+			}
+		}
+		logDigests(delivered)
+	}
+	if failed != nil {
+		return failed
+	}
+	recordStats(ctx, statsForwarded)
+	writeSidecars(ctx, statsForwarded, "")
+	if *vacationMessage != "" && *shadow {
+		infof(ctx, "shadow: not sending auto-replies")
+	} else if *vacationMessage != "" {
+		autoReply(ctx, env.header, origTo, strings.Trim(msg.returnPath, "<>"))
+	}
+	return nil
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testMessage = "Return-Path: <sender@example.org>\n" +
+	"From: Sender <sender@example.org>\n" +
+	"Subject: test\n" +
+	"\n" +
+	"body\n"
+
+// TestReadEnvelopeTruncated checks that input ending before the header
+// section is complete is rejected, while a complete header section is
+// accepted with or without a body.
+func TestReadEnvelopeTruncated(t *testing.T) {
+	headerEnd := strings.Index(testMessage, "\n\n") + 2
+	tests := []struct {
+		name  string
+		input string
+		ok    bool
+	}{
+		{"empty", "", false},
+		{"partial first line", testMessage[:10], false},
+		{"partial field name", testMessage[:strings.Index(testMessage, "From")+2], false},
+		{"partial field value", testMessage[:strings.Index(testMessage, "Subject")+10], false},
+		{"header without empty line", testMessage[:headerEnd-1], true},
+		{"header only", testMessage[:headerEnd], true},
+		{"partial body", testMessage[:headerEnd+2], true},
+		{"complete", testMessage, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, message, err := readEnvelope(strings.NewReader(test.input), "Return-Path")
+			if !test.ok {
+				if err == nil {
+					t.Fatalf("readEnvelope(%q) succeeded, expected an error", test.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readEnvelope(%q) failed: %s", test.input, err)
+			}
+			data, err := io.ReadAll(message)
+			if err != nil || string(data) != test.input {
+				t.Errorf("readEnvelope(%q) yields %q, %v", test.input, data, err)
+			}
+		})
+	}
+}
+
+// TestReadEnvelopeReturnPath checks that the return-path header must hold an
+// address in angle brackets, as Postfix adds it.
+func TestReadEnvelopeReturnPath(t *testing.T) {
+	tests := []struct {
+		returnPath string
+		ok         bool
+	}{
+		{"<sender@example.org>", true},
+		{"<>", true},
+		{"  <sender@example.org>  ", true},
+		{"", false},
+		{"x", false},
+		{"<", false},
+		{">", false},
+		{"ab@c", false},
+		{"<sender@example.org", false},
+		{"sender@example.org>", false},
+	}
+	for _, test := range tests {
+		t.Run(test.returnPath, func(t *testing.T) {
+			input := "Return-Path: " + test.returnPath + "\nSubject: test\n\nbody\n"
+			env, _, err := readEnvelope(strings.NewReader(input), "Return-Path")
+			if test.ok != (err == nil) {
+				t.Fatalf("readEnvelope with return-path %q returned %v", test.returnPath, err)
+			}
+			if err == nil && env.returnPath != strings.TrimSpace(test.returnPath) {
+				t.Errorf("readEnvelope with return-path %q yields %q", test.returnPath, env.returnPath)
+			}
+		})
+	}
+}
+
+// FuzzReadEnvelope checks that readEnvelope doesn't panic on arbitrary
+// input, and that the envelopes it accepts can be forwarded: the return-path
+// is in angle brackets and the message reads back as the input.
+func FuzzReadEnvelope(f *testing.F) {
+	f.Add(testMessage)
+	f.Add("Return-Path: <>\n\n")
+	f.Add("Return-Path: x\n\n")
+	f.Add("Return-Path: ab@c\r\nSubject: test\r\n\r\nbody")
+	f.Fuzz(func(t *testing.T, input string) {
+		env, message, err := readEnvelope(strings.NewReader(input), "Return-Path")
+		if err != nil {
+			return
+		}
+		if rp := env.returnPath; len(rp) < 2 || rp[0] != '<' || rp[len(rp)-1] != '>' {
+			t.Fatalf("readEnvelope(%q) accepted return-path %q", input, rp)
+		}
+		data, err := io.ReadAll(message)
+		if err != nil || string(data) != input {
+			t.Errorf("readEnvelope(%q) yields %q, %v", input, data, err)
+		}
+	})
+}
+
+// TestForwardTruncated checks that forward exits with EX_DATAERR for empty
+// and truncated input, or an invalid return-path, so Postfix bounces it
+// instead of retrying, and forwards messages whose header section is
+// complete.
+func TestForwardTruncated(t *testing.T) {
+	defer func(dry bool, policy string, stdout *os.File) {
+		*dryRun, *srsPolicy, hostname, os.Stdout = dry, policy, "", stdout
+	}(*dryRun, *srsPolicy, os.Stdout)
+	*dryRun, *srsPolicy, hostname = true, srsNever, deterministicHostname
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	// The dry run prints the forwarded message.
+	os.Stdout = devNull
+
+	headerEnd := strings.Index(testMessage, "\n\n") + 2
+	tests := []struct {
+		name   string
+		input  string
+		status int
+	}{
+		{"empty", "", ExDataErr},
+		{"partial first line", testMessage[:1], ExDataErr},
+		{"partial return-path", testMessage[:20], ExDataErr},
+		{"partial subject", testMessage[:headerEnd-3], ExDataErr},
+		{"return-path without brackets", "Return-Path: x\n\nbody\n", ExDataErr},
+		{"return-path missing a bracket", "Return-Path: <ab@c\n\nbody\n", ExDataErr},
+		{"missing return-path", "Subject: test\n\nbody\n", ExDataErr},
+		{"header only", testMessage[:headerEnd], 0},
+		{"partial body", testMessage[:headerEnd+2], 0},
+		{"complete", testMessage, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := withMessage(context.Background(), newMessageInfo())
+			err := forward(ctx, strings.NewReader(test.input), "", []string{"rcpt@example.net"})
+			switch {
+			case test.status == 0 && err != nil:
+				t.Errorf("forward(%q) failed: %s", test.input, err)
+			case test.status != 0 && exitCode(err) != test.status:
+				t.Errorf("forward(%q) returned %v, exit status %d, expected %d", test.input, err, exitCode(err), test.status)
+			}
+		})
+	}
+}
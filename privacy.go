@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// privateDomain is the domain of the addresses recorded in trace header
+// fields with --private-destination. The .invalid TLD (RFC 2606) never
+// resolves, so they can't be mistaken for deliverable addresses.
+const privateDomain = "private.invalid"
+
+// privateAddress returns the form of addr recorded in the header fields
+// added by postforward with --private-destination: a hash of the address,
+// keyed with the SRS secret when --srs-secret-file is given, so it can't be
+// reversed by hashing guessed addresses. Like the address itself, it's the
+// same for every message, so loops are still detected.
+func privateAddress(addr string) (string, error) {
+	var key []byte
+	if *srsSecretFile != "" {
+		secret, err := readSRSSecret(*srsSecretFile)
+		if err != nil {
+			return "", temporaryError("Unable to read SRS secret: %w", err)
+		}
+		key = secret
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.ToLower(addr)))
+	return "h" + hex.EncodeToString(mac.Sum(nil)[:16]) + "@" + privateDomain, nil
+}
+
+// traceHeaders are the header fields recording the addresses a message was
+// delivered or forwarded to.
+var traceHeaders = []string{"Delivered-To", "X-Original-To", loopHeader}
+
+// privateTrace returns a header filter replacing addr in trace header
+// fields, such as the Delivered-To header Postfix adds when delivering to
+// postforward, with its recorded form.
+func privateTrace(addr, recorded string) headerFilter {
+	return func(field []byte) []byte {
+		if !isHeader(field, traceHeaders) {
+			return field
+		}
+		i := bytes.IndexByte(field, ':') + 1
+		value := strings.Trim(strings.TrimSpace(string(field[i:])), "<>")
+		if ascii, err := addressToASCII(value); err != nil || !strings.EqualFold(ascii, addr) {
+			return field
+		}
+		eol := field[len(bytes.TrimRight(field, "\r\n")):]
+		rewritten := append(field[:i:i], ' ')
+		rewritten = append(rewritten, recorded...)
+		return append(rewritten, eol...)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// probeAddress implements the "probe" subcommand, which checks whether the
+// mail servers of forwarding destinations accept mail for them, without
+// sending any. For every address, the MX hosts of its domain are tried in
+// order of preference until one of them answers the RCPT command. It
+// returns the exit status of the subcommand: 0 when all addresses were
+// accepted, 1 when one was rejected and EX_TEMPFAIL when one couldn't be
+// checked.
+func probeAddress(args []string) int {
+	set := flag.NewFlagSet("probe", flag.ContinueOnError)
+	sender := set.String("from", "", "envelope sender of the probe (default: the null sender, as used for address verification)")
+	helo := set.String("helo", "", "HELO name of the probe (default: the Postfix hostname)")
+	port := set.String("port", "25", "port of the mail servers")
+	tlsPolicy := set.String("tls", tlsMay, "TLS policy: none, may or verify")
+	probeTimeout := set.Duration("timeout", 30*time.Second, "time limit of probing a single address")
+	if err := set.Parse(args); err != nil {
+		return 2
+	}
+	if set.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "probe: no addresses given")
+		return 2
+	}
+	switch *tlsPolicy {
+	case tlsNone, tlsMay, tlsVerify:
+	default:
+		fmt.Fprintf(os.Stderr, "probe: invalid --tls %q, expected none, may or verify\n", *tlsPolicy)
+		return 2
+	}
+
+	ctx := context.Background()
+	if *helo == "" {
+		*helo = getHostname(ctx)
+	}
+	status := 0
+	for _, addr := range set.Args() {
+		ctx, cancel := context.WithTimeout(ctx, *probeTimeout)
+		host, err := probeRecipient(ctx, addr, *sender, *helo, *port, *tlsPolicy)
+		cancel()
+		switch code := exitCode(err); {
+		case err == nil:
+			fmt.Printf("%s: accepted by %s\n", addr, host)
+		case code == ExTempFail:
+			fmt.Printf("%s: unknown: %s\n", addr, err)
+			if status == 0 {
+				status = ExTempFail
+			}
+		default:
+			fmt.Printf("%s: rejected: %s\n", addr, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// probeRecipient probes the MX hosts of the domain of addr in order,
+// until one of them accepts or permanently rejects it. It returns the host
+// which answered.
+func probeRecipient(ctx context.Context, addr, sender, helo, port, tlsPolicy string) (string, error) {
+	addr, err := addressToASCII(addr)
+	if err != nil {
+		return "", permanentError("invalid address: %w", err)
+	}
+	_, domain := splitAddress(addr)
+	if domain == "" {
+		return "", permanentError("address has no domain")
+	}
+	hosts, err := mxHosts(ctx, domain)
+	if err != nil {
+		return "", err
+	}
+	for _, host := range hosts {
+		d := smtpDelivery{addr: net.JoinHostPort(host, port), host: host, tls: tlsPolicy}
+		err = d.probe(ctx, helo, sender, addr)
+		if err == nil || exitCode(err) != ExTempFail || ctx.Err() != nil {
+			return host, err
+		}
+		debugf(ctx, "probing %s at %s failed: %s", addr, host, err)
+	}
+	return "", err
+}
+
+// mxHosts returns the mail servers of domain in order of preference. Like
+// mail servers do, the domain itself is used when it has no MX records, but
+// an address. Domains with a null MX (RFC 7505) don't accept mail.
+func mxHosts(ctx context.Context, domain string) ([]string, error) {
+	records, err := net.DefaultResolver.LookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		_, err := net.DefaultResolver.LookupHost(ctx, domain)
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, permanentError("%s has no mail servers", domain)
+		}
+		return []string{domain}, nil
+	case err != nil:
+		return nil, temporaryError("MX lookup for %s failed: %w", domain, err)
+	}
+	if len(records) == 1 && records[0].Host == "." {
+		return nil, permanentError("%s does not accept mail (null MX)", domain)
+	}
+	var hosts []string
+	for _, mx := range records {
+		hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+	}
+	if len(hosts) == 0 {
+		return []string{domain}, nil
+	}
+	return hosts, nil
+}
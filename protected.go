@@ -0,0 +1,42 @@
+package main
+
+import (
+	"mime"
+	"net/mail"
+	"strings"
+)
+
+// protectedContent describes the cryptographic protection applied to the
+// content of a message with the given header, or returns an empty string
+// when it's neither signed nor encrypted.
+//
+// Signatures and encryption cover the message body, so postforward never
+// applies transformations to the body of protected messages. Changes to the
+// top-level header, such as added trace headers, don't affect them.
+func protectedContent(header mail.Header) string {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	switch mediaType {
+	case "multipart/signed":
+		switch strings.ToLower(params["protocol"]) {
+		case "application/pgp-signature":
+			return "PGP/MIME signed"
+		case "application/pkcs7-signature", "application/x-pkcs7-signature":
+			return "S/MIME signed"
+		}
+		return "signed"
+	case "multipart/encrypted":
+		if strings.ToLower(params["protocol"]) == "application/pgp-encrypted" {
+			return "PGP/MIME encrypted"
+		}
+		return "encrypted"
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		if strings.ToLower(params["smime-type"]) == "signed-data" {
+			return "S/MIME signed"
+		}
+		return "S/MIME encrypted"
+	}
+	return ""
+}
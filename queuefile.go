@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Record types used in Postfix queue files, see src/global/rec_type.h in the
+// Postfix sources. Only the records needed to reconstruct a message are
+// listed.
+const (
+	recSize = 'C' // first record, message size information
+	recFrom = 'S' // envelope sender
+	recRcpt = 'R' // envelope recipient
+	recOrcp = 'O' // original recipient
+	recMesg = 'M' // start of message content
+	recNorm = 'N' // content line, terminated by a newline
+	recCont = 'L' // content line, continued in the next record
+	recXtra = 'X' // end of message content
+	recPtr  = 'p' // pointer to the next record
+	recEnd  = 'E' // end of queue file
+)
+
+// maxQueueRecordSize bounds the length of queue file records. Postfix splits
+// content lines into records of at most line_length_limit bytes, 2048 by
+// default, and envelope records are shorter still.
+const maxQueueRecordSize = 1 << 20
+
+// errQueueFile is returned for malformed queue files.
+var errQueueFile = errors.New("malformed queue file")
+
+// queueFile holds the envelope of a Postfix queue file.
+type queueFile struct {
+	sender     string
+	recipients []string
+	// origRecipients holds the original recipients, before any address
+	// rewriting by Postfix.
+	origRecipients []string
+}
+
+// queueFileReader reads records from a Postfix queue file.
+type queueFileReader struct {
+	r   io.ReadSeeker
+	buf *bufio.Reader
+}
+
+// next returns the next record, following pointer records.
+func (q *queueFileReader) next() (byte, []byte, error) {
+	for {
+		typ, data, err := q.read()
+		if err != nil || typ != recPtr {
+			return typ, data, err
+		}
+		// Pointer records contain a (possibly zero) offset to continue
+		// reading from. Zero offsets are reserved space and are skipped.
+		offset, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return 0, nil, errQueueFile
+		}
+		if offset == 0 {
+			continue
+		}
+		if _, err := q.r.Seek(offset, io.SeekStart); err != nil {
+			return 0, nil, err
+		}
+		q.buf.Reset(q.r)
+	}
+}
+
+// read returns the next record without following pointers. A record is a
+// type byte, a length encoded in 7-bit groups (least significant first,
+// with the high bit set on all but the last byte) and the record data, of
+// at most maxQueueRecordSize bytes.
+func (q *queueFileReader) read() (byte, []byte, error) {
+	typ, err := q.buf.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	length := 0
+	for shift := uint(0); ; shift += 7 {
+		c, err := q.buf.ReadByte()
+		if err != nil || shift > 28 {
+			return 0, nil, errQueueFile
+		}
+		length |= int(c&0x7f) << shift
+		if c&0x80 == 0 {
+			break
+		}
+	}
+	if length > maxQueueRecordSize {
+		return 0, nil, fmt.Errorf("%s: record of %d bytes", errQueueFile, length)
+	}
+	// The data is read as it comes, so a length beyond the end of a
+	// truncated file isn't allocated up front.
+	data, err := io.ReadAll(io.LimitReader(q.buf, int64(length)))
+	if err != nil || len(data) != length {
+		return 0, nil, errQueueFile
+	}
+	return typ, data, nil
+}
+
+// readQueueFile parses a Postfix queue file as found in the deferred or hold
+// queues. It returns the envelope and a reader producing the message in the
+// same form it would be piped by Postfix: a Return-Path header holding the
+// envelope sender, followed by the message content.
+//
+// The envelope is read up front, the content is streamed from in as it is
+// read. Queue files contain pointer records, so in must be seekable; other
+// input is buffered in memory first.
+func readQueueFile(in io.Reader) (queueFile, io.Reader, error) {
+	rs, ok := in.(io.ReadSeeker)
+	if ok {
+		if _, err := rs.Seek(0, io.SeekCurrent); err != nil {
+			ok = false
+		}
+	}
+	if !ok {
+		data, err := io.ReadAll(in)
+		if err != nil {
+			return queueFile{}, nil, err
+		}
+		rs = bytes.NewReader(data)
+	}
+	q := &queueFileReader{r: rs, buf: bufio.NewReader(rs)}
+
+	var qf queueFile
+	typ, _, err := q.next()
+	if err != nil {
+		return qf, nil, err
+	}
+	if typ != recSize {
+		return qf, nil, fmt.Errorf("%s: not a queue file", errQueueFile)
+	}
+	for typ != recMesg {
+		var data []byte
+		typ, data, err = q.next()
+		if err != nil {
+			return qf, nil, err
+		}
+		switch typ {
+		case recFrom:
+			qf.sender = string(data)
+		case recRcpt:
+			qf.recipients = append(qf.recipients, string(data))
+		case recOrcp:
+			qf.origRecipients = append(qf.origRecipients, string(data))
+		case recEnd:
+			return qf, nil, fmt.Errorf("%s: no message content", errQueueFile)
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		w := bufio.NewWriter(pw)
+		fmt.Fprintf(w, "Return-Path: <%s>\n", qf.sender)
+		for {
+			typ, data, err := q.next()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			switch typ {
+			case recNorm:
+				w.Write(data)
+				w.WriteByte('\n')
+			case recCont:
+				w.Write(data)
+			case recXtra, recEnd:
+				if err := w.Flush(); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+				pw.Close()
+				return
+			}
+		}
+	}()
+	return qf, pr, nil
+}
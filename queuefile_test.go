@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// queueRecord encodes a queue file record of the given type.
+func queueRecord(typ byte, data string) string {
+	record := []byte{typ}
+	length := len(data)
+	for ; length >= 0x80; length >>= 7 {
+		record = append(record, byte(length&0x7f|0x80))
+	}
+	return string(append(append(record, byte(length)), data...))
+}
+
+// testQueueFile is a queue file holding testMessage.
+var testQueueFile = queueRecord(recSize, "123 45 1 1") +
+	queueRecord(recFrom, "sender@example.org") +
+	queueRecord(recOrcp, "orig@example.net") +
+	queueRecord(recRcpt, "rcpt@example.net") +
+	queueRecord(recMesg, "0") +
+	queueRecord(recNorm, "From: Sender <sender@example.org>") +
+	queueRecord(recCont, "Subject: ") +
+	queueRecord(recNorm, "test") +
+	queueRecord(recNorm, "") +
+	queueRecord(recPtr, "0") +
+	queueRecord(recNorm, "body") +
+	queueRecord(recXtra, "") +
+	queueRecord(recEnd, "")
+
+// TestReadQueueFile checks that the envelope and message are recovered
+// from a queue file.
+func TestReadQueueFile(t *testing.T) {
+	qf, message, err := readQueueFile(strings.NewReader(testQueueFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qf.sender != "sender@example.org" || strings.Join(qf.recipients, ",") != "rcpt@example.net" || strings.Join(qf.origRecipients, ",") != "orig@example.net" {
+		t.Errorf("readQueueFile yields envelope %+v", qf)
+	}
+	data, err := io.ReadAll(message)
+	if err != nil || string(data) != testMessage {
+		t.Errorf("readQueueFile yields message %q, %v", data, err)
+	}
+}
+
+// TestReadQueueFileMalformed checks that truncated queue files and records
+// with bogus lengths are rejected, without allocating the length they claim.
+func TestReadQueueFileMalformed(t *testing.T) {
+	envelope := queueRecord(recSize, "123 45 1 1") + queueRecord(recFrom, "sender@example.org")
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"empty", ""},
+		{"not a queue file", queueRecord(recFrom, "sender@example.org")},
+		{"missing length", envelope + string(recRcpt)},
+		{"truncated length", envelope + string(recRcpt) + "\x80"},
+		{"overlong length", envelope + string(recRcpt) + "\xff\xff\xff\xff\xff\x01"},
+		{"oversized record", envelope + string(recRcpt) + "\xff\xff\xff\xff\x0f" + "rcpt@example.net"},
+		{"length beyond end", envelope + string(recRcpt) + "\xff\xff\x3f" + "rcpt@example.net"},
+		{"truncated record", envelope + queueRecord(recRcpt, "rcpt@example.net")[:5]},
+		{"no message content", envelope + queueRecord(recEnd, "")},
+		{"invalid pointer", envelope + queueRecord(recPtr, "x")},
+		{"truncated content", testQueueFile[:strings.Index(testQueueFile, "body")]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, message, err := readQueueFile(strings.NewReader(test.input))
+			if err == nil {
+				_, err = io.ReadAll(message)
+			}
+			if err == nil {
+				t.Errorf("readQueueFile(%q) succeeded, expected an error", test.input)
+			}
+		})
+	}
+}
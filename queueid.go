@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+// crockford is the Crockford base32 alphabet used by ULIDs. It excludes the
+// letters I, L, O and U to avoid ambiguity when IDs are read by humans.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newQueueID returns a ULID-style identifier for a message accepted at time
+// t. The first 10 characters encode the millisecond timestamp and the
+// remaining 16 characters are random, so IDs sort by time of ingestion.
+func newQueueID(t time.Time) string {
+	var data [16]byte
+	binary.BigEndian.PutUint64(data[:8], uint64(t.UnixNano()/int64(time.Millisecond))<<16)
+	if _, err := rand.Read(data[6:]); err != nil {
+		// Fall back to the sub-millisecond part of the clock. Uniqueness
+		// is weaker but an ID is still better than none.
+		binary.BigEndian.PutUint64(data[8:], uint64(t.UnixNano()))
+	}
+
+	// Encode the 128 bits as 26 base32 characters, most significant first.
+	// The leading character only carries the top 3 bits.
+	id := make([]byte, 26)
+	hi := binary.BigEndian.Uint64(data[:8])
+	lo := binary.BigEndian.Uint64(data[8:])
+	for i := 25; i >= 0; i-- {
+		id[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(id)
+}
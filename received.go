@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// receivedClockSkew is the amount by which a Received header may claim a
+// later time than the header added after it before it's considered suspect.
+const receivedClockSkew = time.Hour
+
+var (
+	// receivedFromIP matches the client IP address in the from clause of a
+	// Received header, as written by Postfix and most other MTAs:
+	// "from helo (name [addr])".
+	receivedFromIP = regexp.MustCompile(`(?i)^\s*from\s[^;]*?\[(?:ipv6:)?([0-9a-f:.]+)\]`)
+	// receivedBy matches the by clause of a Received header.
+	receivedBy = regexp.MustCompile(`(?i)\bby\s+([^\s;()]+)`)
+)
+
+// receivedHop is the information parsed from a single Received header.
+type receivedHop struct {
+	// fromIP is the address of the client which connected, or nil when
+	// the header doesn't record one.
+	fromIP net.IP
+	// by is the name of the host which added the header.
+	by   string
+	date time.Time
+}
+
+// parseReceived parses the value of a Received header.
+func parseReceived(v string) receivedHop {
+	var hop receivedHop
+	if m := receivedFromIP.FindStringSubmatch(v); m != nil {
+		hop.fromIP = net.ParseIP(m[1])
+	}
+	if m := receivedBy.FindStringSubmatch(v); m != nil {
+		hop.by = strings.ToLower(strings.TrimSuffix(m[1], "."))
+	}
+	if i := strings.LastIndex(v, ";"); i >= 0 {
+		if date, err := mail.ParseDate(strings.TrimSpace(v[i+1:])); err == nil {
+			hop.date = date
+		}
+	}
+	return hop
+}
+
+// hostList lists hosts by network and by host name.
+type hostList struct {
+	nets  []*net.IPNet
+	names []string
+}
+
+// parseHostList parses a comma-separated list of IP addresses, networks
+// in CIDR notation and host names.
+func parseHostList(s string) (hostList, error) {
+	var t hostList
+	for _, entry := range splitAddressList(s) {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				t.nets = append(t.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+			t.names = append(t.names, strings.ToLower(entry))
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return t, err
+		}
+		t.nets = append(t.nets, n)
+	}
+	return t, nil
+}
+
+// containsIP reports whether ip belongs to one of the networks.
+func (t hostList) containsIP(ip net.IP) bool {
+	for _, n := range t.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsName reports whether name is one of the host names.
+func (t hostList) containsName(name string) bool {
+	for _, n := range t.names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// originatingIP walks the Received chain in header, newest first, and
+// returns the address of the first client which isn't a trusted host. The
+// headers added by trusted hosts are reliable, anything below the
+// originating hop may have been written by the sender.
+//
+// Any signs of a forged chain are returned as problems: hops claiming to be
+// received by a trusted host below the originating hop, and timestamps going
+// backwards by more than receivedClockSkew. Locally submitted messages have
+// no client address and yield a nil address.
+func originatingIP(header mail.Header, trusted hostList) (ip net.IP, problems []string) {
+	values := header["Received"]
+	hops := make([]receivedHop, len(values))
+	for i, v := range values {
+		hops[i] = parseReceived(v)
+	}
+
+	origin := -1
+	for i, hop := range hops {
+		if hop.fromIP == nil {
+			continue
+		}
+		if !trusted.containsIP(hop.fromIP) {
+			origin = i
+			break
+		}
+	}
+	if origin < 0 {
+		// All hops are trusted, the message originated locally.
+		for i := len(hops) - 1; i >= 0; i-- {
+			if hops[i].fromIP != nil {
+				return hops[i].fromIP, nil
+			}
+		}
+		return nil, nil
+	}
+
+	for i := origin + 1; i < len(hops); i++ {
+		if trusted.containsName(hops[i].by) {
+			problems = append(problems, fmt.Sprintf("untrusted Received header claims to be by trusted host %s", hops[i].by))
+		}
+	}
+	for i := 1; i < len(hops); i++ {
+		newer, older := hops[i-1].date, hops[i].date
+		if !newer.IsZero() && !older.IsZero() && older.Sub(newer) > receivedClockSkew {
+			problems = append(problems, fmt.Sprintf("Received header dated %s claims to be later than the newer header dated %s",
+				older.Format(time.RFC1123Z), newer.Format(time.RFC1123Z)))
+		}
+	}
+	return hops[origin].fromIP, problems
+}
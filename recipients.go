@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode/utf8"
+)
+
+// splitAddress splits addr into its local part and domain. The domain is
+// empty when addr has no @ sign.
+func splitAddress(addr string) (local, domain string) {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return addr, ""
+	}
+	return addr[:i], addr[i+1:]
+}
+
+// Address case policies, selecting how addresses are folded before they are
+// SRS encoded or used in map lookups.
+const (
+	// casePreserve uses addresses exactly as they were received.
+	casePreserve = "preserve"
+	// caseLower lowercases the entire address.
+	caseLower = "lower"
+	// caseNormalize lowercases the domain but preserves the local part,
+	// which RFC 5321 allows to be case-sensitive.
+	caseNormalize = "normalize"
+)
+
+// addressCase is the active address case policy.
+var addressCase = casePreserve
+
+// foldCase returns addr with the active address case policy applied.
+func foldCase(addr string) string {
+	switch addressCase {
+	case caseLower:
+		return strings.ToLower(addr)
+	case caseNormalize:
+		local, domain := splitAddress(addr)
+		if domain == "" {
+			return addr
+		}
+		return local + "@" + strings.ToLower(domain)
+	}
+	return addr
+}
+
+// userForwards returns the destinations listed in the forwarding file of the
+// local user that rcpt belongs to, ignoring its address extension as
+// separated by one of delimiters. The file is read from dir/<user> when dir
+// is set and from ~<user>/.postforward otherwise. A missing file is not an
+// error and yields no destinations.
+func userForwards(rcpt, dir, delimiters string) ([]string, error) {
+	name, _ := splitAddress(rcpt)
+	name, _, _ = splitExtension(strings.ToLower(name), delimiters)
+	if name == "" || strings.ContainsAny(name, "/\x00") || name == "." || name == ".." {
+		return nil, fmt.Errorf("invalid user name %q", name)
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid for user %s: %s", name, u.Uid)
+	}
+
+	file := filepath.Join(u.HomeDir, ".postforward")
+	if dir != "" {
+		file = filepath.Join(dir, name)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	if err := checkForwardFile(f, uid); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return parseForwardFile(f)
+}
+
+// checkForwardFile verifies that a forwarding file is safe to use. Like
+// .forward files, it must be a regular file owned by the user (or root) and
+// may not be writable by anyone else.
+func checkForwardFile(f *os.File, uid int) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file")
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("file is group or world writable")
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if int(st.Uid) != uid && st.Uid != 0 {
+			return fmt.Errorf("file is not owned by uid %d", uid)
+		}
+	}
+	return nil
+}
+
+// parseForwardFile reads forwarding destinations from f. Destinations are
+// separated by commas or newlines, blank lines and lines starting with # are
+// ignored.
+func parseForwardFile(f *os.File) ([]string, error) {
+	var dests []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, dest := range strings.Split(line, ",") {
+			if dest = strings.TrimSpace(dest); dest != "" {
+				dests = append(dests, dest)
+			}
+		}
+	}
+	return dests, scanner.Err()
+}
+
+// aliasRecursionLimit bounds the depth of nested alias expansion, mirroring
+// Postfix's virtual_alias_recursion_limit.
+const aliasRecursionLimit = 1000
+
+// aliasExpansionLimit bounds the number of addresses an address expands to,
+// mirroring Postfix's virtual_alias_expansion_limit.
+const aliasExpansionLimit = 1000
+
+// errAliasRecursion is returned when aliasRecursionLimit is exceeded, or an
+// alias expands to itself through others.
+var errAliasRecursion = errors.New("alias recursion limit exceeded")
+
+// errAliasExpansion is returned when aliasExpansionLimit is exceeded.
+var errAliasExpansion = errors.New("alias expansion limit exceeded")
+
+// addressMap resolves addresses using a Postfix style lookup table, such as a
+// virtual(5) alias table or a canonical(5) table.
+type addressMap struct {
+	table table
+	// remote is the TCP table queried instead of table, if given.
+	remote *tcpTable
+	// localDomains lists the domains for which bare "user" keys apply.
+	localDomains []string
+	// delimiters are the characters separating user names from address
+	// extensions.
+	delimiters string
+}
+
+// defaultRecipientDelimiter is used when the Postfix recipient_delimiter
+// setting can't be read.
+const defaultRecipientDelimiter = "+"
+
+// The characters separating user names from address extensions, as in
+// user+extension@domain, set up on first use.
+var (
+	recipientDelimiterChars string
+	recipientDelimiterOnce  sync.Once
+)
+
+// lookupRecipients returns the recipients mail to origTo is forwarded to
+// according to the per-user forwarding files and --virtual-map, in addition
+// to those given on the command line. domains are the local domains the
+// maps apply to.
+func lookupRecipients(ctx context.Context, origTo string, domains []string) ([]string, error) {
+	var recipients []string
+	if *userForwardsEnabled || *userForwardsDir != "" {
+		if origTo == "" {
+			return nil, temporaryError("--user-forwards requires --orig-to")
+		}
+		dests, err := userForwards(origTo, *userForwardsDir, recipientDelimiters(ctx))
+		if err != nil {
+			return nil, temporaryError("Unable to read forwarding file: %w", err)
+		}
+		explainf(ctx, "forwarding file of %s: %s", origTo, explainList(dests))
+		recipients = append(recipients, dests...)
+	}
+	if *virtualMap != "" {
+		if origTo == "" {
+			return nil, temporaryError("--virtual-map requires --orig-to")
+		}
+		m, err := loadAddressMap(ctx, *virtualMap, domains)
+		if err != nil {
+			return nil, temporaryError("Unable to read virtual map: %w", err)
+		}
+		_, ok, err := m.lookup(ctx, origTo)
+		if err != nil {
+			return nil, temporaryError("Virtual map lookup error: %w", err)
+		}
+		if !ok {
+			explainf(ctx, "virtual map %s: no entry for %s", *virtualMap, origTo)
+		}
+		if ok {
+			dests, err := m.expand(ctx, origTo)
+			switch {
+			case errors.Is(err, errAliasRecursion), errors.Is(err, errAliasExpansion):
+				return nil, permanentError("Unable to resolve recipient: %w", err)
+			case err != nil:
+				return nil, temporaryError("Unable to resolve recipient: %w", err)
+			}
+			explainf(ctx, "virtual map %s: %s resolves to %s", *virtualMap, origTo, strings.Join(dests, ", "))
+			recipients = append(recipients, dests...)
+		}
+	}
+	return recipients, nil
+}
+
+// recipientDelimiters returns the characters separating user names from
+// address extensions, any of which starts an extension. They're given by
+// --recipient-delimiter, or read from the Postfix recipient_delimiter
+// setting. Like in Postfix, there are no extensions when it's empty.
+func recipientDelimiters(ctx context.Context) string {
+	recipientDelimiterOnce.Do(func() {
+		if *recipientDelimiterFlag != "" {
+			recipientDelimiterChars = *recipientDelimiterFlag
+			return
+		}
+		out, err := exec.Command("postconf", "-h", "recipient_delimiter").Output()
+		if err != nil {
+			warnf(ctx, "unable to get recipient_delimiter from postfix (%v), using %q", err, defaultRecipientDelimiter)
+			recipientDelimiterChars = defaultRecipientDelimiter
+			return
+		}
+		recipientDelimiterChars = strings.TrimSpace(string(out))
+	})
+	return recipientDelimiterChars
+}
+
+// lookup returns the destinations addr maps to. Keys are tried from most to
+// least specific, following virtual(5): user+extension@domain, user@domain,
+// user+extension and user (the latter two only for local domains), and
+// finally the catch-all forms @domain and *@domain.
+//
+// When an entry is found only after stripping the address extension, the
+// extension is propagated to the destinations. A destination of the form
+// @otherdomain keeps the original local part and only replaces the domain.
+func (m addressMap) lookup(ctx context.Context, addr string) ([]string, bool, error) {
+	origLocal, _ := splitAddress(addr)
+	_, delim, ext := splitExtension(origLocal, m.delimiters)
+	if ascii, err := addressToASCII(addr); err == nil {
+		addr = ascii
+	}
+	local, domain := splitAddress(strings.ToLower(addr))
+	user, _, _ := splitExtension(local, m.delimiters)
+
+	type key struct {
+		key      string
+		stripped bool
+	}
+	var keys []key
+	if domain != "" {
+		keys = append(keys, key{local + "@" + domain, false})
+		if ext != "" {
+			keys = append(keys, key{user + "@" + domain, true})
+		}
+	}
+	if domain == "" || m.isLocal(domain) {
+		keys = append(keys, key{local, false})
+		if ext != "" {
+			keys = append(keys, key{user, true})
+		}
+	}
+	if domain != "" {
+		keys = append(keys, key{"@" + domain, false}, key{"*@" + domain, false})
+	}
+
+	for _, k := range keys {
+		value, ok := m.table[k.key]
+		if m.remote != nil {
+			var err error
+			if value, ok, err = m.remote.get(ctx, k.key); err != nil {
+				return nil, false, err
+			}
+		}
+		if !ok {
+			continue
+		}
+		dests := splitAddressList(value)
+		for i, dest := range dests {
+			dest = foldCase(dest)
+			switch {
+			case strings.HasPrefix(dest, "@"):
+				dests[i] = origLocal + dest
+			case k.stripped:
+				dests[i] = addExtension(dest, delim, ext, m.delimiters)
+			default:
+				dests[i] = dest
+			}
+		}
+		return dests, true, nil
+	}
+	return nil, false, nil
+}
+
+// splitExtension splits the local part of an address into the user name,
+// the delimiter and the address extension, if any. The extension starts
+// at the first of the delimiters characters.
+func splitExtension(local, delimiters string) (user, delim, ext string) {
+	i := strings.IndexAny(local, delimiters)
+	if i <= 0 || delimiters == "" {
+		return local, "", ""
+	}
+	_, n := utf8.DecodeRuneInString(local[i:])
+	return local[:i], local[i : i+n], local[i+n:]
+}
+
+// addExtension inserts the address extension ext into addr, separated by
+// delim, unless addr already carries an extension of its own.
+func addExtension(addr, delim, ext, delimiters string) string {
+	local, domain := splitAddress(addr)
+	if _, _, e := splitExtension(local, delimiters); e != "" || ext == "" {
+		return addr
+	}
+	local += delim + ext
+	if domain == "" {
+		return local
+	}
+	return local + "@" + domain
+}
+
+// isLocal reports whether domain is one of the map's local domains.
+func (m addressMap) isLocal(domain string) bool {
+	for _, d := range m.localDomains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Expansion states of addresses, see expandDepth.
+const (
+	aliasExpanding = iota + 1
+	aliasExpanded
+)
+
+// expand recursively resolves addr to its final destinations. Addresses
+// without a table entry, and addresses which map to themselves, are final.
+// Every address is expanded once, however many aliases list it, and at most
+// aliasExpansionLimit destinations are returned.
+func (m addressMap) expand(ctx context.Context, addr string) ([]string, error) {
+	var result []string
+	err := m.expandDepth(ctx, addr, 0, map[string]int{}, &result)
+	return result, err
+}
+
+// expandDepth appends the final destinations of addr, found depth aliases
+// deep, to result. state records the addresses being and already expanded.
+func (m addressMap) expandDepth(ctx context.Context, addr string, depth int, state map[string]int, result *[]string) error {
+	if depth > aliasRecursionLimit {
+		return fmt.Errorf("%w for %s", errAliasRecursion, addr)
+	}
+	key := strings.ToLower(addr)
+	switch state[key] {
+	case aliasExpanding:
+		return fmt.Errorf("%w for %s", errAliasRecursion, addr)
+	case aliasExpanded:
+		return nil
+	}
+	state[key] = aliasExpanding
+	defer func() { state[key] = aliasExpanded }()
+
+	dests, ok, err := m.lookup(ctx, addr)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		dests = []string{addr}
+	}
+	for _, dest := range dests {
+		if !ok || strings.EqualFold(dest, addr) {
+			if len(*result) >= aliasExpansionLimit {
+				return fmt.Errorf("%w for %s", errAliasExpansion, addr)
+			}
+			*result = append(*result, dest)
+			continue
+		}
+		if err := m.expandDepth(ctx, dest, depth+1, state, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canonicalize returns the canonical form of addr as listed in the map, or
+// addr itself when there is no entry for it. Unlike alias expansion this is
+// not recursive, matching cleanup(8).
+func (m addressMap) canonicalize(ctx context.Context, addr string) (string, error) {
+	dests, ok, err := m.lookup(ctx, addr)
+	if err != nil || !ok || len(dests) == 0 {
+		return addr, err
+	}
+	return dests[0], nil
+}
+
+// loadAddressMap reads the lookup table at path into an addressMap. Keys
+// with internationalized domains are converted to A-labels, so they match
+// regardless of the form used in the table. A path of the form
+// tcp:host:port refers to a TCP table, which is queried for every lookup.
+func loadAddressMap(ctx context.Context, path string, localDomains []string) (addressMap, error) {
+	for i, d := range localDomains {
+		if ascii, err := domainToASCII(d); err == nil {
+			localDomains[i] = ascii
+		}
+	}
+	delimiters := recipientDelimiters(ctx)
+	if addr, ok := strings.CutPrefix(path, "tcp:"); ok {
+		return addressMap{remote: newTCPTable(addr), localDomains: localDomains, delimiters: delimiters}, nil
+	}
+	t, err := readTable(ctx, path)
+	if err != nil {
+		return addressMap{}, err
+	}
+	for key, value := range t {
+		if isASCII(key) {
+			continue
+		}
+		ascii, err := addressToASCII(key)
+		if err != nil {
+			return addressMap{}, fmt.Errorf("%s: invalid key %q: %s", path, key, err)
+		}
+		delete(t, key)
+		t[ascii] = value
+	}
+	return addressMap{table: t, localDomains: localDomains, delimiters: delimiters}, nil
+}
+
+// splitAddressList splits a comma or whitespace separated list of addresses,
+// as used in the values of alias tables.
+func splitAddressList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+// localDomains returns the domains considered local for the purpose of
+// alias lookups. When none are given explicitly, the expanded value of the
+// Postfix mydestination setting is used.
+func localDomains(ctx context.Context, explicit string) []string {
+	if explicit == "" {
+		out, err := exec.Command("postconf", "-x", "-h", "mydestination").Output()
+		if err != nil {
+			warnf(ctx, "unable to get mydestination from postfix (%v)", err)
+			return nil
+		}
+		explicit = string(out)
+	}
+	return splitAddressList(explicit)
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timing of the Redis state backend.
+const (
+	// redisTimeout bounds every Redis command.
+	redisTimeout = 5 * time.Second
+	// redisLockTTL is how long a state lock is held at most, so the lock
+	// of a crashed process doesn't block the others for good.
+	redisLockTTL = 30 * time.Second
+	// redisLockPoll is the time waited before trying to take a lock held
+	// by another process again.
+	redisLockPoll = 20 * time.Millisecond
+	// redisSlotTTL is how long a concurrency slot is held at most. It
+	// exceeds the time deliveries usually take.
+	redisSlotTTL = time.Hour
+)
+
+// redisKeyPrefix is prepended to the names of the state kept in Redis.
+const redisKeyPrefix = "postforward:"
+
+// redisRelease deletes the lock in KEYS[1] if it's still held with the token
+// ARGV[1], first storing ARGV[2] in KEYS[2] if given, so state is only
+// written while the lock is held.
+const redisRelease = `if redis.call("GET", KEYS[1]) ~= ARGV[1] then return 0 end
+if #KEYS > 1 then redis.call("SET", KEYS[2], ARGV[2]) end
+return redis.call("DEL", KEYS[1])`
+
+// errRedisNil is returned for Redis nil replies.
+var errRedisNil = errors.New("redis: nil reply")
+
+// redisClient sends commands to the Redis server of --state-backend.
+type redisClient struct {
+	pool *connPool
+}
+
+// The Redis client of --state-backend, set up on first use.
+var (
+	redisState     *redisClient
+	redisStateErr  error
+	redisStateOnce sync.Once
+)
+
+// stateRedis returns the client of the --state-backend Redis server.
+func stateRedis() (*redisClient, error) {
+	redisStateOnce.Do(func() {
+		redisState, redisStateErr = newRedisClient(*stateBackend)
+	})
+	return redisState, redisStateErr
+}
+
+// newRedisClient returns a client for the Redis server at the URL spec, of
+// the form redis://[:password@]host[:port][/db].
+func newRedisClient(spec string) (*redisClient, error) {
+	u, err := parseServerURL(spec)
+	if err != nil || u.Scheme != "redis" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid Redis URL %q, expected redis://[:password@]host[:port][/db]", spec)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "6379"
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+	var setup []string
+	if password, ok := u.User.Password(); ok {
+		setup = append(setup, "AUTH", password)
+	} else if u.User != nil && u.User.Username() != "" {
+		setup = append(setup, "AUTH", u.User.Username())
+	}
+	db := strings.Trim(u.Path, "/")
+	if db != "" {
+		if _, err := strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid Redis database %q", db)
+		}
+	}
+
+	pool := newConnPool("tcp", addr)
+	pool.setup = func(c *textproto.Conn) error {
+		if len(setup) > 0 {
+			if _, err := redisCommand(c, setup...); err != nil {
+				return err
+			}
+		}
+		if db != "" {
+			if _, err := redisCommand(c, "SELECT", db); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return &redisClient{pool: pool}, nil
+}
+
+// do sends a command to the server, returning its reply, a string or an
+// int64. Error replies are returned as errors, nil replies as errRedisNil.
+func (r *redisClient) do(args ...string) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	var reply interface{}
+	err := r.pool.do(ctx, func(c *textproto.Conn) error {
+		var err error
+		reply, err = redisCommand(c, args...)
+		var re redisError
+		if errors.As(err, &re) || errors.Is(err, errRedisNil) {
+			// The connection is fine, only the command failed.
+			reply, err = err, nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	if err, ok := reply.(error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisCommand sends a command on c and reads its reply.
+func redisCommand(c *textproto.Conn, args ...string) (interface{}, error) {
+	fmt.Fprintf(c.W, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.W, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := c.W.Flush(); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.R)
+}
+
+// readRedisReply reads a reply in the Redis serialization protocol (RESP).
+// Arrays aren't used by postforward, and thus not supported.
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	if line == "" {
+		return nil, fmt.Errorf("invalid empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > maxStateSize {
+			return nil, fmt.Errorf("invalid bulk length %q", line[1:])
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	default:
+		return nil, fmt.Errorf("invalid reply %q", line)
+	}
+}
+
+// maxStateSize bounds the size of state read from Redis.
+const maxStateSize = 64 << 20
+
+// redisToken returns a random token identifying the holder of a lock.
+func redisToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// lock takes the lock with the given key, waiting for it up to
+// redisLockTTL, after which a lock held by another process expires anyway.
+// It returns the token the lock is held with.
+func (r *redisClient) lock(key string) (string, error) {
+	token, err := redisToken()
+	if err != nil {
+		return "", err
+	}
+	deadline := time.Now().Add(redisLockTTL)
+	for {
+		_, err := r.do("SET", key, token, "NX", "PX", strconv.FormatInt(redisLockTTL.Milliseconds(), 10))
+		if err == nil {
+			return token, nil
+		}
+		if !errors.Is(err, errRedisNil) {
+			return "", err
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("redis: timed out waiting for lock %s", key)
+		}
+		time.Sleep(redisLockPoll)
+	}
+}
+
+// redisStateFile is a state file kept in Redis, as returned by lockedFile
+// with --state-backend. Its content is read when it's opened and written
+// back when it's closed, while the lock is held.
+type redisStateFile struct {
+	client *redisClient
+	key    string
+	token  string
+	data   []byte
+	pos    int64
+	dirty  bool
+}
+
+// openRedisState locks the state with the given name and reads it.
+func openRedisState(name string) (*redisStateFile, error) {
+	client, err := stateRedis()
+	if err != nil {
+		return nil, err
+	}
+	key := redisKeyPrefix + name
+	token, err := client.lock(key + ":lock")
+	if err != nil {
+		return nil, err
+	}
+	f := &redisStateFile{client: client, key: key, token: token}
+	reply, err := client.do("GET", key)
+	switch {
+	case errors.Is(err, errRedisNil):
+	case err != nil:
+		f.unlock(nil)
+		return nil, err
+	default:
+		s, _ := reply.(string)
+		f.data = []byte(s)
+	}
+	return f, nil
+}
+
+func (f *redisStateFile) Read(p []byte) (int, error) {
+	if f.pos >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *redisStateFile) Write(p []byte) (int, error) {
+	if end := f.pos + int64(len(p)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	copy(f.data[f.pos:], p)
+	f.pos += int64(len(p))
+	f.dirty = true
+	return len(p), nil
+}
+
+func (f *redisStateFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.data))
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("invalid offset %d", offset)
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *redisStateFile) Truncate(size int64) error {
+	if size < int64(len(f.data)) {
+		f.data = f.data[:size]
+	} else {
+		f.data = append(f.data, make([]byte, size-int64(len(f.data)))...)
+	}
+	f.dirty = true
+	return nil
+}
+
+// Close writes the state back if it was changed, and releases the lock.
+func (f *redisStateFile) Close() error {
+	if !f.dirty {
+		return f.unlock(nil)
+	}
+	return f.unlock(f.data)
+}
+
+// unlock releases the lock, storing data first if non-nil. It fails when
+// the lock expired in the meantime, and data wasn't stored.
+func (f *redisStateFile) unlock(data []byte) error {
+	args := []string{"EVAL", redisRelease, "1", f.key + ":lock", f.token}
+	if data != nil {
+		args = []string{"EVAL", redisRelease, "2", f.key + ":lock", f.key, f.token, string(data)}
+	}
+	reply, err := f.client.do(args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n == 0 {
+		return fmt.Errorf("redis: lock %s expired before it was released", f.key)
+	}
+	return nil
+}
+
+// redisSlot is a concurrency slot held in Redis, as returned by acquireSlot
+// with --state-backend.
+type redisSlot struct {
+	client *redisClient
+	key    string
+	token  string
+}
+
+// acquireRedisSlot takes one of n slots for the named resource, without
+// waiting. It returns nil when no slot was available. Slots of crashed
+// processes are freed after redisSlotTTL.
+func acquireRedisSlot(name string, n int) (*redisSlot, error) {
+	client, err := stateRedis()
+	if err != nil {
+		return nil, err
+	}
+	token, err := redisToken()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("%s%s.slot%d", redisKeyPrefix, name, i)
+		_, err := client.do("SET", key, token, "NX", "PX", strconv.FormatInt(redisSlotTTL.Milliseconds(), 10))
+		if err == nil {
+			return &redisSlot{client: client, key: key, token: token}, nil
+		}
+		if !errors.Is(err, errRedisNil) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// Close releases the slot.
+func (s *redisSlot) Close() error {
+	_, err := s.client.do("EVAL", redisRelease, "1", s.key, s.token)
+	return err
+}
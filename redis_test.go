@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+// TestReadRedisReply checks the parsing of RESP replies.
+func TestReadRedisReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		reply interface{}
+		err   error
+	}{
+		{"status", "+OK\r\n", "OK", nil},
+		{"status without CR", "+OK\n", "OK", nil},
+		{"integer", ":42\r\n", int64(42), nil},
+		{"bulk", "$5\r\nhello\r\n", "hello", nil},
+		{"bulk with newlines", "$6\r\na\r\nb\nc\r\n", "a\r\nb\nc", nil},
+		{"empty bulk", "$0\r\n\r\n", "", nil},
+		{"nil", "$-1\r\n", nil, errRedisNil},
+		{"error", "-ERR unknown command\r\n", nil, redisError("ERR unknown command")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reply, err := readRedisReply(bufio.NewReader(strings.NewReader(test.input)))
+			if reply != test.reply || err != test.err {
+				t.Errorf("readRedisReply(%q) = %#v, %v, expected %#v, %v", test.input, reply, err, test.reply, test.err)
+			}
+		})
+	}
+
+	for _, input := range []string{"", "\r\n", "*1\r\n$2\r\nOK\r\n", ":x\r\n", "$x\r\n", "$67108865\r\n", "$5\r\nhel", "+OK"} {
+		if reply, err := readRedisReply(bufio.NewReader(strings.NewReader(input))); err == nil {
+			t.Errorf("readRedisReply(%q) = %#v, expected an error", input, reply)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+)
+
+// Values of --dsn-policy.
+const (
+	dsnForward = "forward"
+	dsnNoSRS   = "no-srs"
+	dsnReverse = "reverse"
+	dsnDiscard = "discard"
+)
+
+// Values of --mdn-policy.
+const (
+	mdnPass    = "pass"
+	mdnStrip   = "strip"
+	mdnRewrite = "rewrite"
+)
+
+// mdnRequestHeaders are the header fields requesting read receipts: the
+// standard ones of RFC 8098, and the older Return-Receipt-To some mail
+// clients still honor.
+var mdnRequestHeaders = []string{"Disposition-Notification-To", "Disposition-Notification-Options", "Return-Receipt-To"}
+
+// Report types of multipart/report messages (RFC 6522) postforward
+// classifies: delivery status notifications (RFC 3464) and message
+// disposition notifications (RFC 8098).
+const (
+	reportDeliveryStatus = "delivery-status"
+	reportDisposition    = "disposition-notification"
+)
+
+// maxReportSize bounds the size of the machine-readable part of a report
+// that is parsed.
+const maxReportSize = 64 << 10
+
+// deliveryReport is a DSN or MDN, as found by parseReport.
+type deliveryReport struct {
+	kind       string
+	recipients []reportRecipient
+}
+
+// reportRecipient is a recipient a report is about.
+type reportRecipient struct {
+	address string
+	action  string
+	status  string
+}
+
+// String describes the report for the log.
+func (r *deliveryReport) String() string {
+	kind := "delivery status notification"
+	if r.kind == reportDisposition {
+		kind = "disposition notification"
+	}
+	var about []string
+	for _, rcpt := range r.recipients {
+		s := rcpt.address
+		var details []string
+		for _, d := range []string{rcpt.action, rcpt.status} {
+			if d != "" {
+				details = append(details, d)
+			}
+		}
+		if len(details) > 0 {
+			s += " (" + strings.Join(details, ", ") + ")"
+		}
+		about = append(about, s)
+	}
+	if len(about) == 0 {
+		return kind
+	}
+	return kind + " for " + strings.Join(about, ", ")
+}
+
+// reportType returns the report type of a message with the given header,
+// if it's a DSN or an MDN.
+func reportType(header mail.Header) (string, bool) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" {
+		return "", false
+	}
+	switch kind := strings.ToLower(params["report-type"]); kind {
+	case reportDeliveryStatus, reportDisposition:
+		return kind, true
+	}
+	return "", false
+}
+
+// parseReport parses the report of the given kind in the complete message
+// read from r. The recipients are taken from its machine-readable part;
+// when that is missing or broken, the report is returned without them.
+func parseReport(kind string, r io.Reader) (*deliveryReport, error) {
+	report := &deliveryReport{kind: kind}
+	m, err := mail.ReadMessage(r)
+	if err != nil {
+		return report, err
+	}
+	_, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		return report, err
+	}
+	parts := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return report, fmt.Errorf("no message/%s part", kind)
+		}
+		if err != nil {
+			return report, err
+		}
+		mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if mediaType != "message/"+kind && mediaType != "message/global-"+kind {
+			continue
+		}
+		report.recipients, err = reportRecipients(kind, io.LimitReader(part, maxReportSize))
+		return report, err
+	}
+}
+
+// reportRecipients parses the machine-readable part of a report: groups of
+// header-like fields separated by blank lines. DSNs have a group for the
+// message, followed by one for every recipient; MDNs have a single group.
+func reportRecipients(kind string, r io.Reader) ([]reportRecipient, error) {
+	tp := textproto.NewReader(bufio.NewReader(r))
+	var recipients []reportRecipient
+	for {
+		fields, err := tp.ReadMIMEHeader()
+		if len(fields) > 0 {
+			rcpt := reportRecipient{
+				address: reportAddress(fields.Get("Final-Recipient")),
+				action:  strings.ToLower(strings.TrimSpace(fields.Get("Action"))),
+				status:  strings.TrimSpace(fields.Get("Status")),
+			}
+			if kind == reportDisposition {
+				rcpt.action = strings.TrimSpace(fields.Get("Disposition"))
+			}
+			if rcpt.address != "" {
+				recipients = append(recipients, rcpt)
+			}
+		}
+		if err == io.EOF {
+			return recipients, nil
+		}
+		if err != nil {
+			return recipients, err
+		}
+	}
+}
+
+// reportAddress returns the address of a Final-Recipient field, of the form
+// "rfc822; user@example.org".
+func reportAddress(field string) string {
+	if i := strings.IndexByte(field, ';'); i >= 0 {
+		field = field[i+1:]
+	}
+	return strings.Trim(strings.TrimSpace(field), "<>")
+}
+
+// classifyReport checks whether the message with the given header, read
+// from message, is a DSN or an MDN. If it is, it returns the report along
+// with the complete message spooled to a file, which the caller has to
+// close.
+func classifyReport(ctx context.Context, header mail.Header, message io.Reader) (*deliveryReport, *os.File, error) {
+	kind, ok := reportType(header)
+	if !ok {
+		return nil, nil, nil
+	}
+	spooled, err := spoolBody(message)
+	if err != nil {
+		return nil, nil, err
+	}
+	report, err := parseReport(kind, spooled)
+	if err != nil {
+		debugf(ctx, "unable to parse report: %s", err)
+	}
+	if _, err := spooled.Seek(0, io.SeekStart); err != nil {
+		spooled.Close()
+		return nil, nil, err
+	}
+	return report, spooled, nil
+}
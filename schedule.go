@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timeWindow is a recurring weekly period of time, such as weekdays from
+// 18:00 to 08:00.
+type timeWindow struct {
+	days [7]bool
+	// start and end are offsets from midnight. A window ending before it
+	// starts extends into the next day.
+	start, end time.Duration
+}
+
+// weekdays maps day abbreviations to time.Weekday values.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday,
+	"wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseSchedule parses a semicolon separated list of time windows. Each
+// window consists of the days it applies to and the time of day, e.g.
+// "Mon-Fri 18:00-08:00; Sat,Sun". Either part may be omitted, meaning every
+// day and the whole day respectively.
+func parseSchedule(spec string) ([]timeWindow, error) {
+	var windows []timeWindow
+	for _, s := range strings.Split(spec, ";") {
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			continue
+		}
+		w := timeWindow{end: 24 * time.Hour}
+		days := "*"
+		switch {
+		case len(fields) == 2:
+			days = fields[0]
+			if err := w.parseTimes(fields[1]); err != nil {
+				return nil, err
+			}
+		case len(fields) == 1 && strings.Contains(fields[0], ":"):
+			if err := w.parseTimes(fields[0]); err != nil {
+				return nil, err
+			}
+		case len(fields) == 1:
+			days = fields[0]
+		default:
+			return nil, fmt.Errorf("invalid time window %q", strings.TrimSpace(s))
+		}
+		if err := w.parseDays(days); err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	if len(windows) == 0 {
+		return nil, fmt.Errorf("no time windows given")
+	}
+	return windows, nil
+}
+
+// parseDays parses a comma separated list of days and day ranges, such as
+// Mon-Fri,Sun. A * stands for every day.
+func (w *timeWindow) parseDays(s string) error {
+	if s == "*" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	}
+	for _, r := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(r, "-")
+		first, ok := weekdays[strings.ToLower(from)]
+		if !ok {
+			return fmt.Errorf("invalid day %q", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = weekdays[strings.ToLower(to)]; !ok {
+				return fmt.Errorf("invalid day %q", to)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseTimes parses a range of times of day, such as 08:00-18:00.
+func (w *timeWindow) parseTimes(s string) error {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return fmt.Errorf("invalid time range %q", s)
+	}
+	var err error
+	if w.start, err = parseTimeOfDay(from); err != nil {
+		return err
+	}
+	if w.end, err = parseTimeOfDay(to); err != nil {
+		return err
+	}
+	if w.start == w.end {
+		return fmt.Errorf("empty time range %q", s)
+	}
+	return nil
+}
+
+// parseTimeOfDay parses a time of day in 24-hour HH:MM notation, returning
+// the offset from midnight. 24:00 denotes the end of the day.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// contains reports whether t, in its own time zone, falls within the window.
+func (w timeWindow) contains(t time.Time) bool {
+	// Use the wall clock time, which differs from the time elapsed since
+	// midnight on days daylight saving time starts or ends.
+	h, m, sec := t.Clock()
+	offset := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second
+	day := t.Weekday()
+	if w.start < w.end {
+		return w.days[day] && offset >= w.start && offset < w.end
+	}
+	// The window started either today or, extending past midnight, the day
+	// before.
+	yesterday := (day + 6) % 7
+	return (w.days[day] && offset >= w.start) || (w.days[yesterday] && offset < w.end)
+}
+
+// inSchedule reports whether t falls within any of the windows.
+func inSchedule(windows []timeWindow, t time.Time) bool {
+	for _, w := range windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
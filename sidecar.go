@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// metadataDir is the directory of a Maildir the records of messages stored
+// in it are written to with --metadata-sidecar. Mail readers ignore it, as
+// it's neither a folder nor one of tmp/, new/ and cur/.
+const metadataDir = "metadata"
+
+// Results of a submission in the processing record.
+const (
+	deliveryForwarded = "forwarded"
+	deliveryFailed    = "failed"
+	// deliveryStored submissions failed, but were stored in
+	// --fallback-maildir.
+	deliveryStored = "stored"
+)
+
+// messageRecord is the processing record of a message written with
+// --metadata-sidecar.
+type messageRecord struct {
+	QueueID           string            `json:"queue_id"`
+	Arrival           time.Time         `json:"arrival"`
+	ReturnPath        string            `json:"return_path"`
+	OriginalRecipient string            `json:"original_recipient,omitempty"`
+	Recipients        []string          `json:"recipients"`
+	MessageID         string            `json:"message_id,omitempty"`
+	Subject           string            `json:"subject,omitempty"`
+	Size              int64             `json:"size"`
+	ClientIP          string            `json:"client_ip,omitempty"`
+	Verdicts          map[string]string `json:"verdicts,omitempty"`
+	AddedHeaders      []string          `json:"added_headers"`
+	Deliveries        []deliveryRecord  `json:"deliveries"`
+	Result            string            `json:"result"`
+	Error             string            `json:"error,omitempty"`
+}
+
+// deliveryRecord is the outcome of a single submission of a message.
+type deliveryRecord struct {
+	ReturnPath string   `json:"return_path"`
+	Recipients []string `json:"recipients"`
+	Via        string   `json:"via"`
+	Result     string   `json:"result"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// recordDelivery adds the outcome of forwarding sub, which failed with err
+// if non-nil, to the processing record of the message in ctx.
+func recordDelivery(ctx context.Context, sub *submission, result string, err error) {
+	via := "sendmail"
+	if *deliver != "" {
+		via = *deliver
+	}
+	d := deliveryRecord{ReturnPath: sub.returnPath, Recipients: sub.recipients, Via: via, Result: result}
+	if err != nil {
+		d.Error = err.Error()
+	}
+	msg := messageFrom(ctx)
+	msg.deliveries = append(msg.deliveries, d)
+}
+
+// writeSidecars writes the processing record of the message in ctx next to
+// the copies stored in Maildirs, after processing finished with result.
+// reason is the error processing failed with, if any. Failures are logged,
+// but otherwise ignored.
+func writeSidecars(ctx context.Context, result, reason string) {
+	msg := messageFrom(ctx)
+	if len(msg.sidecars) == 0 {
+		return
+	}
+	rec := messageRecord{
+		QueueID:           msg.queueID,
+		Arrival:           msg.arrival,
+		ReturnPath:        strings.Trim(msg.returnPath, "<>"),
+		OriginalRecipient: msg.origTo,
+		Recipients:        msg.recipients,
+		MessageID:         strings.TrimSpace(msg.messageID),
+		Subject:           decodeHeader(msg.subject),
+		Size:              msg.size,
+		AddedHeaders:      msg.addedHeaders,
+		Deliveries:        msg.deliveries,
+		Result:            result,
+		Error:             reason,
+	}
+	if msg.clientIP != nil {
+		rec.ClientIP = msg.clientIP.String()
+	}
+	if len(msg.verdicts) > 0 {
+		rec.Verdicts = map[string]string{}
+		for _, r := range msg.verdicts {
+			rec.Verdicts[r.method] = r.result
+		}
+	}
+	if rec.Recipients == nil {
+		rec.Recipients = []string{}
+	}
+	if rec.AddedHeaders == nil {
+		rec.AddedHeaders = []string{}
+	}
+	if rec.Deliveries == nil {
+		rec.Deliveries = []deliveryRecord{}
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(rec); err != nil {
+		warnf(ctx, "unable to write metadata: %s", err)
+		return
+	}
+	for _, path := range msg.sidecars {
+		if err := writeFileAtomic(path, b.Bytes()); err != nil {
+			warnf(ctx, "unable to write metadata to %s: %s", path, err)
+		}
+	}
+	msg.sidecars = nil
+}
+
+// writeFileAtomic writes data to path, creating its directory when it
+// doesn't exist yet. The data is written to a temporary file first, so
+// readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// maxNetstring bounds the length of socketmap replies.
+const maxNetstring = 100000
+
+// lookupSocketmap performs a socketmap lookup of key in the named map using a
+// connection from pool, as described in Postfix' socketmap_table(5). The
+// lookup is aborted when ctx is done.
+func lookupSocketmap(ctx context.Context, pool *connPool, name, key string) (string, error) {
+	var reply string
+	err := pool.do(ctx, func(c *textproto.Conn) error {
+		if err := writeNetstring(c.W, name+" "+key); err != nil {
+			return err
+		}
+		if err := c.W.Flush(); err != nil {
+			return err
+		}
+		var err error
+		reply, err = readNetstring(c.R)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	status, value, _ := strings.Cut(reply, " ")
+	switch status {
+	case "OK":
+		return value, nil
+	case "NOTFOUND":
+		warnf(ctx, "srs: socketmap NOTFOUND (%v)", value)
+		return "", errSRSNotFound
+	case "TEMP", "TIMEOUT", "PERM":
+		return "", fmt.Errorf("srs: socketmap %s (%v)", status, value)
+	default:
+		return "", fmt.Errorf("srs: unexpected socketmap reply %q", reply)
+	}
+}
+
+// writeNetstring writes s to w encoded as a netstring.
+func writeNetstring(w io.Writer, s string) error {
+	_, err := fmt.Fprintf(w, "%d:%s,", len(s), s)
+	return err
+}
+
+// readNetstring reads a single netstring from r.
+func readNetstring(r *bufio.Reader) (string, error) {
+	prefix, err := r.ReadString(':')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(prefix, ":"))
+	if err != nil || n < 0 || n > maxNetstring {
+		return "", fmt.Errorf("invalid netstring length %q", strings.TrimSuffix(prefix, ":"))
+	}
+	data := make([]byte, n+1)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	if data[n] != ',' {
+		return "", errors.New("netstring not terminated by comma")
+	}
+	return string(data[:n]), nil
+}
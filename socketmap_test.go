@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestNetstring checks that netstrings read back as written, and that
+// malformed and oversized ones are rejected.
+func TestNetstring(t *testing.T) {
+	for _, s := range []string{"", "forward user@example.org", "OK SRS0=abcd=TT=example.org=user@fwd.example", strings.Repeat("x", maxNetstring)} {
+		var b bytes.Buffer
+		if err := writeNetstring(&b, s); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := readNetstring(bufio.NewReader(&b)); err != nil || got != s {
+			t.Errorf("netstring %.20q reads back as %.20q, %v", s, got, err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"empty", ""},
+		{"missing colon", "5"},
+		{"invalid length", "x:abc,"},
+		{"negative length", "-1:,"},
+		{"oversized", "100001:"},
+		{"truncated", "5:abc"},
+		{"missing comma", "3:abc;"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if s, err := readNetstring(bufio.NewReader(strings.NewReader(test.input))); err == nil {
+				t.Errorf("readNetstring(%q) yields %q, expected an error", test.input, s)
+			}
+		})
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SPF evaluation limits of RFC 7208, section 4.6.4.
+const (
+	spfLookupLimit = 10
+	spfVoidLimit   = 2
+	spfMXLimit     = 10
+)
+
+// errSPFPermanent and errSPFTemporary abort SPF evaluation with a
+// permerror or temperror result.
+var (
+	errSPFPermanent = errors.New("permerror")
+	errSPFTemporary = errors.New("temperror")
+)
+
+// spfCheck holds the state of a single SPF evaluation.
+type spfCheck struct {
+	ctx     context.Context
+	ip      net.IP
+	sender  string
+	helo    string
+	lookups int
+	voids   int
+}
+
+// checkSPF evaluates the SPF policy of the domain of sender for a message
+// received from ip, following RFC 7208. helo is the HELO name of the client,
+// if known.
+func checkSPF(ctx context.Context, ip net.IP, helo, sender string) authResult {
+	r := authResult{method: "spf", result: "none"}
+	_, domain := splitAddress(sender)
+	if sender == "" || domain == "" {
+		r.reason = "no envelope sender"
+		return r
+	}
+	r.props = []string{"smtp.mailfrom=" + sender}
+	r.domain = domain
+	if ip == nil {
+		r.reason = "no client address"
+		return r
+	}
+
+	c := &spfCheck{ctx: ctx, ip: ip, sender: sender, helo: helo}
+	result, err := c.checkHost(domain)
+	switch {
+	case errors.Is(err, errSPFTemporary):
+		r.result = "temperror"
+	case err != nil:
+		r.result = "permerror"
+	default:
+		r.result = result
+	}
+	switch {
+	case err != nil:
+		r.reason = err.Error()
+	case result == "none":
+		r.reason = "no SPF record for " + domain
+	default:
+		r.reason = fmt.Sprintf("%s: %s is %s", domain, ip, spfDesignation[r.result])
+	}
+	return r
+}
+
+// spfDesignation describes the meaning of a SPF result in comments.
+var spfDesignation = map[string]string{
+	"pass":     "designated",
+	"fail":     "not designated",
+	"softfail": "not designated",
+	"neutral":  "neither permitted nor denied",
+}
+
+// spfQualifiers maps the mechanism qualifiers to their results.
+var spfQualifiers = map[byte]string{
+	'+': "pass", '-': "fail", '~': "softfail", '?': "neutral",
+}
+
+// checkHost implements the check_host() function of RFC 7208, section 4.
+func (c *spfCheck) checkHost(domain string) (string, error) {
+	records, err := lookupTXT(c.ctx, domain)
+	if err != nil {
+		return "", fmt.Errorf("%w: looking up %s: %s", errSPFTemporary, domain, err)
+	}
+	var record string
+	found := 0
+	for _, r := range records {
+		if strings.EqualFold(r, "v=spf1") || strings.HasPrefix(strings.ToLower(r), "v=spf1 ") {
+			record = r
+			found++
+		}
+	}
+	switch found {
+	case 0:
+		return "none", nil
+	case 1:
+	default:
+		return "", fmt.Errorf("%w: multiple SPF records for %s", errSPFPermanent, domain)
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		if name, value, ok := spfModifier(term); ok {
+			if strings.EqualFold(name, "redirect") {
+				redirect = value
+			}
+			continue
+		}
+		result := "pass"
+		if q, ok := spfQualifiers[term[0]]; ok {
+			result = q
+			term = term[1:]
+		}
+		match, err := c.mechanism(domain, term)
+		if err != nil {
+			return "", err
+		}
+		if match {
+			return result, nil
+		}
+	}
+
+	if redirect == "" {
+		return "neutral", nil
+	}
+	target, err := c.expand(redirect, domain)
+	if err != nil {
+		return "", err
+	}
+	if err := c.countLookup(); err != nil {
+		return "", err
+	}
+	result, err := c.checkHost(target)
+	if err == nil && result == "none" {
+		return "", fmt.Errorf("%w: redirect to %s without SPF record", errSPFPermanent, target)
+	}
+	return result, err
+}
+
+// spfModifier splits a modifier term of the form name=value.
+func spfModifier(term string) (name, value string, ok bool) {
+	name, value, ok = strings.Cut(term, "=")
+	if !ok || name == "" || strings.ContainsAny(name, ":/") {
+		return "", "", false
+	}
+	return name, value, true
+}
+
+// mechanism reports whether the client matches the mechanism term, without
+// its qualifier, evaluated for domain.
+func (c *spfCheck) mechanism(domain, term string) (bool, error) {
+	name, arg, hasArg := strings.Cut(term, ":")
+	if !hasArg {
+		// Mechanisms with only a CIDR length, as in a/24.
+		if i := strings.IndexByte(term, '/'); i >= 0 {
+			name, arg = term[:i], term[i:]
+		}
+	}
+	name = strings.ToLower(name)
+	if arg == "" && (name == "include" || name == "exists") {
+		return false, fmt.Errorf("%w: %s without domain", errSPFPermanent, name)
+	}
+	switch name {
+	case "all":
+		return true, nil
+	case "include":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		result, err := c.checkHost(target)
+		switch {
+		case err != nil:
+			return false, err
+		case result == "pass":
+			return true, nil
+		case result == "none":
+			return false, fmt.Errorf("%w: include of %s without SPF record", errSPFPermanent, target)
+		}
+		return false, nil
+	case "a", "mx":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, v4, v6, err := c.domainSpec(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		hosts := []string{target}
+		if name == "mx" {
+			mxs, err := resolver.LookupMX(c.ctx, target)
+			if err != nil && !isNotFound(err) {
+				return false, fmt.Errorf("%w: looking up MX of %s: %s", errSPFTemporary, target, err)
+			}
+			if len(mxs) > spfMXLimit {
+				return false, fmt.Errorf("%w: too many MX records for %s", errSPFPermanent, target)
+			}
+			hosts = hosts[:0]
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+		for _, host := range hosts {
+			addrs, err := c.lookupIP(host)
+			if err != nil {
+				return false, err
+			}
+			for _, addr := range addrs {
+				if c.inNetwork(addr.IP, v4, v6) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "ip4", "ip6":
+		if !strings.Contains(arg, "/") {
+			if name == "ip4" {
+				arg += "/32"
+			} else {
+				arg += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(arg)
+		if err != nil {
+			return false, fmt.Errorf("%w: invalid network %s", errSPFPermanent, arg)
+		}
+		return network.Contains(c.ip), nil
+	case "exists":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		addrs, err := c.lookupIP(target)
+		return len(addrs) > 0, err
+	case "ptr":
+		// The ptr mechanism is deprecated and never matches here.
+		return false, c.countLookup()
+	}
+	return false, fmt.Errorf("%w: unknown mechanism %s", errSPFPermanent, term)
+}
+
+// domainSpec parses the argument of an a or mx mechanism, consisting of an
+// optional domain and optional IPv4 and IPv6 prefix lengths.
+func (c *spfCheck) domainSpec(arg, domain string) (target string, v4, v6 int, err error) {
+	v4, v6 = 32, 128
+	arg, cidr6, dual := strings.Cut(arg, "//")
+	if dual {
+		if v6, err = strconv.Atoi(cidr6); err != nil || v6 < 0 || v6 > 128 {
+			return "", 0, 0, fmt.Errorf("%w: invalid prefix length %s", errSPFPermanent, cidr6)
+		}
+	}
+	arg, cidr4, single := strings.Cut(arg, "/")
+	if single {
+		if v4, err = strconv.Atoi(cidr4); err != nil || v4 < 0 || v4 > 32 {
+			return "", 0, 0, fmt.Errorf("%w: invalid prefix length %s", errSPFPermanent, cidr4)
+		}
+	}
+	target = domain
+	if arg != "" {
+		if target, err = c.expand(arg, domain); err != nil {
+			return "", 0, 0, err
+		}
+	}
+	return target, v4, v6, nil
+}
+
+// inNetwork reports whether the client address is in the network of addr
+// with the prefix length for its address family.
+func (c *spfCheck) inNetwork(addr net.IP, v4, v6 int) bool {
+	if ip4 := addr.To4(); ip4 != nil {
+		return c.ip.To4() != nil && ip4.Mask(net.CIDRMask(v4, 32)).Equal(c.ip.To4().Mask(net.CIDRMask(v4, 32)))
+	}
+	return c.ip.To4() == nil && addr.Mask(net.CIDRMask(v6, 128)).Equal(c.ip.Mask(net.CIDRMask(v6, 128)))
+}
+
+// lookupIP looks up the addresses of host, counting lookups without result
+// against the void lookup limit.
+func (c *spfCheck) lookupIP(host string) ([]net.IPAddr, error) {
+	addrs, err := resolver.LookupIPAddr(c.ctx, host)
+	if err != nil && !isNotFound(err) {
+		return nil, fmt.Errorf("%w: looking up %s: %s", errSPFTemporary, host, err)
+	}
+	if len(addrs) == 0 {
+		if c.voids++; c.voids > spfVoidLimit {
+			return nil, fmt.Errorf("%w: too many void lookups", errSPFPermanent)
+		}
+	}
+	return addrs, nil
+}
+
+// countLookup counts a term causing DNS lookups against the lookup limit.
+func (c *spfCheck) countLookup() error {
+	if c.lookups++; c.lookups > spfLookupLimit {
+		return fmt.Errorf("%w: too many DNS lookups", errSPFPermanent)
+	}
+	return nil
+}
+
+// expand expands the macros in a domain-spec, as described in RFC 7208,
+// section 7.
+func (c *spfCheck) expand(spec, domain string) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out.WriteByte(spec[i])
+			continue
+		}
+		if i++; i == len(spec) {
+			return "", fmt.Errorf("%w: invalid macro in %s", errSPFPermanent, spec)
+		}
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+			continue
+		case '_':
+			out.WriteByte(' ')
+			continue
+		case '-':
+			out.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", fmt.Errorf("%w: invalid macro in %s", errSPFPermanent, spec)
+		}
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", fmt.Errorf("%w: invalid macro in %s", errSPFPermanent, spec)
+		}
+		value, err := c.macro(spec[i+1:i+end], domain)
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(value)
+		i += end
+	}
+	return strings.TrimSuffix(out.String(), "."), nil
+}
+
+// macro returns the value of a single macro, given as the letter followed by
+// the optional transformers and delimiters.
+func (c *spfCheck) macro(m, domain string) (string, error) {
+	local, senderDomain := splitAddress(c.sender)
+	var value string
+	switch m[0] | 0x20 {
+	case 's':
+		value = c.sender
+	case 'l':
+		value = local
+	case 'o':
+		value = senderDomain
+	case 'h':
+		// When the HELO name isn't known, the sender domain is used instead.
+		value = c.helo
+		if value == "" {
+			value = senderDomain
+		}
+	case 'd':
+		value = domain
+	case 'i':
+		value = spfIP(c.ip)
+	case 'p':
+		value = "unknown"
+	case 'v':
+		value = "in-addr"
+		if c.ip.To4() == nil {
+			value = "ip6"
+		}
+	default:
+		return "", fmt.Errorf("%w: unknown macro letter %c", errSPFPermanent, m[0])
+	}
+
+	m = m[1:]
+	digits := 0
+	for len(m) > 0 && m[0] >= '0' && m[0] <= '9' {
+		digits = digits*10 + int(m[0]-'0')
+		m = m[1:]
+	}
+	reverse := false
+	if len(m) > 0 && (m[0] == 'r' || m[0] == 'R') {
+		reverse = true
+		m = m[1:]
+	}
+	delims := "."
+	if m != "" {
+		if strings.Trim(m, ".-+,/_=") != "" {
+			return "", fmt.Errorf("%w: invalid macro delimiters %s", errSPFPermanent, m)
+		}
+		delims = m
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delims, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if digits > 0 && digits < len(parts) {
+		parts = parts[len(parts)-digits:]
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// spfIP formats ip for the i macro: dotted quads for IPv4 and dot-separated
+// nibbles for IPv6.
+func spfIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, strconv.FormatInt(int64(b>>4), 16), strconv.FormatInt(int64(b&0xf), 16))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// SRS rewriting policies of --srs-policy.
+const (
+	srsAlways    = "always"
+	srsSPFNeeded = "spf-needed"
+	srsNever     = "never"
+)
+
+// srsNeeded reports whether the envelope sender must be rewritten for the
+// message to pass SPF at the destination, following --srs-policy. With
+// spf-needed, the SPF policy of sender is evaluated for each of the
+// --srs-policy-ip addresses the forwarded message is sent from, and the
+// sender is rewritten unless none of them would fail. Senders without SPF
+// policy aren't rewritten.
+func srsNeeded(ctx context.Context, sender string) (bool, error) {
+	switch *srsPolicy {
+	case srsAlways:
+		return true, nil
+	case srsNever:
+		return false, nil
+	}
+	if *srsPolicyIP == "" {
+		return false, temporaryError("--srs-policy-ip is required with --srs-policy %s", srsSPFNeeded)
+	}
+	helo := *srsPolicyHELO
+	if helo == "" {
+		helo = getHostname(ctx)
+	}
+	for _, s := range strings.Split(*srsPolicyIP, ",") {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if ip == nil {
+			return false, temporaryError("Invalid --srs-policy-ip address: %s", s)
+		}
+		r := checkSPF(ctx, ip, helo, sender)
+		debugf(ctx, "spf: %s from %s: %s", sender, ip, r.result)
+		switch r.result {
+		case "pass", "none", "neutral":
+		default:
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"os"
+	"strings"
+	"time"
+)
+
+// SRS parameters, matching the defaults of libsrs2 and postsrsd. The hash
+// length and maximum age may be changed with --srs-hash-length and
+// --srs-max-age.
+const (
+	srsHashLength = 4
+	// Timestamps count days, modulo 2^10 so they fit in two base32
+	// characters.
+	srsTimePrecision = 24 * time.Hour
+	srsTimeSlots     = 1 << 10
+	srsBase32        = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	// srsMaxAge is the number of days rewritten addresses are accepted
+	// when reversing them, the postsrsd default.
+	srsMaxAge = 31
+)
+
+// Values of --srs-hash-algorithm.
+const (
+	srsSHA1   = "sha1"
+	srsSHA256 = "sha256"
+)
+
+// srsHashFunc returns the hash function of the given algorithm.
+func srsHashFunc(algorithm string) func() hash.Hash {
+	if algorithm == srsSHA256 {
+		return sha256.New
+	}
+	return sha1.New
+}
+
+// srsMaxHashLength returns the length of the base64 encoded HMAC of the
+// given algorithm, without padding, which bounds the hash length.
+func srsMaxHashLength(algorithm string) int {
+	return base64.RawStdEncoding.EncodedLen(srsHashFunc(algorithm)().Size())
+}
+
+// Modes of --reverse.
+const (
+	reverseNever  = "never"
+	reverseAuto   = "auto"
+	reverseAlways = "always"
+)
+
+// Reasons for rejecting SRS addresses when reversing them.
+var (
+	errSRSInvalid = errors.New("not an SRS address")
+	errSRSHash    = errors.New("invalid hash")
+	errSRSExpired = errors.New("address has expired")
+)
+
+// srsRewriter implements the Sender Rewriting Scheme, producing and
+// reversing the same addresses as postsrsd without needing a lookup daemon.
+type srsRewriter struct {
+	secret []byte
+	domain string
+	// hashLength is the number of characters of hashes, and maxAge the
+	// number of days addresses are accepted.
+	hashLength int
+	maxAge     int
+	// newHash is the hash function of the HMAC.
+	newHash func() hash.Hash
+}
+
+// readSRSSecret reads the secret used to sign rewritten addresses from path.
+// Like with postsrsd, the first line of the file holds the secret used for
+// signing. Further lines, which postsrsd uses to verify addresses signed
+// with older secrets, are ignored.
+func readSRSSecret(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			return []byte(line), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("no secret found")
+}
+
+// forward returns the SRS rewritten form of addr at time now. Addresses in
+// the SRS domain, and addresses without a domain (like the null sender), are
+// returned unchanged. Addresses which were already rewritten by another
+// forwarder are turned into SRS1 addresses, which point back at the first
+// forwarder instead of growing with every hop.
+func (s srsRewriter) forward(addr string, now time.Time) string {
+	local, domain := splitAddress(addr)
+	if local == "" || domain == "" || strings.EqualFold(domain, s.domain) {
+		return addr
+	}
+
+	switch {
+	case srsTagged(local, "SRS0"):
+		// SRS0=HHH=TT=orig-domain=orig-local@domain becomes
+		// SRS1=HHH=domain==HHH=TT=orig-domain=orig-local@our-domain
+		user := local[len("SRS0"):]
+		return "SRS1=" + s.hash(domain, user) + "=" + domain + "=" + user + "@" + s.domain
+	case srsTagged(local, "SRS1"):
+		// SRS1 addresses keep pointing at the first forwarder. Only the
+		// hash is replaced.
+		parts := strings.SplitN(local[len("SRS1="):], "=", 3)
+		if len(parts) == 3 {
+			host, user := parts[1], parts[2]
+			return "SRS1=" + s.hash(host, user) + "=" + host + "=" + user + "@" + s.domain
+		}
+	}
+
+	day := now.Unix() / int64(srsTimePrecision/time.Second) % srsTimeSlots
+	timestamp := string([]byte{srsBase32[day>>5&0x1f], srsBase32[day&0x1f]})
+	return "SRS0=" + s.hash(timestamp, domain, local) + "=" + timestamp + "=" + domain + "=" + local + "@" + s.domain
+}
+
+// reverse returns the address which addr, an address rewritten by forward,
+// stands for. The hash is verified, and SRS0 addresses are only accepted
+// up to maxAge days after they were rewritten at time now. SRS1
+// addresses are turned back into the SRS0 address of the first forwarder.
+func (s srsRewriter) reverse(addr string, now time.Time) (string, error) {
+	local, domain := splitAddress(addr)
+	if !strings.EqualFold(domain, s.domain) {
+		return "", errSRSInvalid
+	}
+	switch {
+	case srsTagged(local, "SRS0"):
+		parts := strings.SplitN(local[len("SRS0="):], "=", 4)
+		if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+			return "", errSRSInvalid
+		}
+		hash, timestamp, origDomain, origLocal := parts[0], parts[1], parts[2], parts[3]
+		if !s.validHash(hash, timestamp, origDomain, origLocal) {
+			return "", errSRSHash
+		}
+		if !s.fresh(timestamp, now) {
+			return "", errSRSExpired
+		}
+		return origLocal + "@" + origDomain, nil
+	case srsTagged(local, "SRS1"):
+		parts := strings.SplitN(local[len("SRS1="):], "=", 3)
+		if len(parts) != 3 || parts[1] == "" || !strings.HasPrefix(parts[2], "=") {
+			return "", errSRSInvalid
+		}
+		hash, host, user := parts[0], parts[1], parts[2]
+		if !s.validHash(hash, host, user) {
+			return "", errSRSHash
+		}
+		return "SRS0" + user + "@" + host, nil
+	}
+	return "", errSRSInvalid
+}
+
+// isSRSAddress reports whether addr has an SRS0 or SRS1 local part.
+func isSRSAddress(addr string) bool {
+	local, _ := splitAddress(addr)
+	return srsTagged(local, "SRS0") || srsTagged(local, "SRS1")
+}
+
+// validHash reports whether hash authenticates data. Like postsrsd, hashes
+// are compared case-insensitively, as some mail systems lowercase
+// addresses.
+func (s srsRewriter) validHash(hash string, data ...string) bool {
+	return subtle.ConstantTimeCompare([]byte(strings.ToLower(hash)), []byte(strings.ToLower(s.hash(data...)))) == 1
+}
+
+// fresh reports whether the SRS timestamp is at most maxAge days old at
+// time now.
+func (s srsRewriter) fresh(timestamp string, now time.Time) bool {
+	if len(timestamp) != 2 {
+		return false
+	}
+	// Like hashes, timestamps may have been lowercased on the way.
+	timestamp = strings.ToUpper(timestamp)
+	hi := strings.IndexByte(srsBase32, timestamp[0])
+	lo := strings.IndexByte(srsBase32, timestamp[1])
+	if hi < 0 || lo < 0 {
+		return false
+	}
+	today := now.Unix() / int64(srsTimePrecision/time.Second) % srsTimeSlots
+	age := (today - int64(hi<<5|lo) + srsTimeSlots) % srsTimeSlots
+	return age <= int64(s.maxAge)
+}
+
+// hash returns the truncated base64 HMAC of the case folded data, which
+// authenticates a rewritten address.
+func (s srsRewriter) hash(data ...string) string {
+	mac := hmac.New(s.newHash, s.secret)
+	for _, d := range data {
+		mac.Write([]byte(strings.ToLower(d)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:s.hashLength]
+}
+
+// srsTagged reports whether the local part starts with the given SRS tag,
+// followed by a separator.
+func srsTagged(local, tag string) bool {
+	return len(local) > len(tag) && strings.EqualFold(local[:len(tag)], tag) && local[len(tag)] == '='
+}
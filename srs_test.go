@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSRSRewriter() srsRewriter {
+	return srsRewriter{
+		secret:     []byte("test secret"),
+		domain:     "fwd.example",
+		hashLength: srsHashLength,
+		maxAge:     srsMaxAge,
+		newHash:    srsHashFunc(srsSHA1),
+	}
+}
+
+// TestSRSRoundTrip checks that addresses rewritten on every day of the
+// timestamp cycle, whose timestamps include the base32 digits 2-7, are
+// reversed to the original address, also when lowercased on the way.
+func TestSRSRoundTrip(t *testing.T) {
+	s := testSRSRewriter()
+	start := time.Date(2026, time.January, 1, 12, 0, 0, 0, time.UTC)
+	for day := 0; day < srsTimeSlots; day++ {
+		now := start.Add(time.Duration(day) * srsTimePrecision)
+		rewritten := s.forward("user@example.org", now)
+		for _, addr := range []string{rewritten, strings.ToLower(rewritten), strings.ToUpper(rewritten)} {
+			for _, age := range []int{0, 1, s.maxAge} {
+				later := now.Add(time.Duration(age) * srsTimePrecision)
+				orig, err := s.reverse(addr, later)
+				if err != nil || !strings.EqualFold(orig, "user@example.org") {
+					t.Fatalf("reverse(%q) after %d days yields %q, %v", addr, age, orig, err)
+				}
+			}
+		}
+	}
+}
+
+// TestSRSReverse checks that expired, forged and malformed addresses are
+// rejected.
+func TestSRSReverse(t *testing.T) {
+	s := testSRSRewriter()
+	now := time.Date(2026, time.March, 1, 12, 0, 0, 0, time.UTC)
+	rewritten := s.forward("user@example.org", now)
+	parts := strings.SplitN(rewritten, "=", 3)
+	first := testSRSRewriter()
+	first.domain = "first.example"
+	tests := []struct {
+		name string
+		addr string
+		age  int
+		err  error
+	}{
+		{"fresh", rewritten, 0, nil},
+		{"oldest", rewritten, s.maxAge, nil},
+		{"expired", rewritten, s.maxAge + 1, errSRSExpired},
+		{"forged hash", parts[0] + "=AAAA=" + parts[2], 0, errSRSHash},
+		{"other domain", strings.Replace(rewritten, "@fwd.example", "@other.example", 1), 0, errSRSInvalid},
+		{"not rewritten", "user@fwd.example", 0, errSRSInvalid},
+		{"missing parts", "SRS0=AAAA=BB@fwd.example", 0, errSRSInvalid},
+		{"SRS1", s.forward(first.forward("user@example.org", now), now), 0, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := s.reverse(test.addr, now.Add(time.Duration(test.age)*srsTimePrecision))
+			if err != test.err {
+				t.Errorf("reverse(%q) returned %v, expected %v", test.addr, err, test.err)
+			}
+		})
+	}
+}
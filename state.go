@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// stateFile is a state file opened by lockedFile.
+type stateFile interface {
+	io.ReadWriteSeeker
+	Truncate(size int64) error
+	Close() error
+}
+
+// stateConfigured reports whether state is kept across invocations, in
+// --state-dir or the --state-backend.
+func stateConfigured() bool {
+	return *stateDir != "" || *stateBackend != ""
+}
+
+// lockedFile opens (creating if needed) the state file with the given name
+// and takes an exclusive lock on it, so concurrent postforward processes
+// don't corrupt shared state. Closing the file releases the lock. With
+// --state-backend, the state is kept in Redis instead, shared with the
+// processes on other hosts using it.
+func lockedFile(name string) (stateFile, error) {
+	if *stateBackend != "" {
+		f, err := openRedisState(name)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	if *stateDir == "" {
+		return nil, fmt.Errorf("no --state-dir configured")
+	}
+	f, err := os.OpenFile(filepath.Join(*stateDir, name), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// countEvent records an event in the named state file and returns the number
+// of events recorded within the given window, including this one. Events
+// older than the window are discarded.
+func countEvent(name string, window time.Duration) (int, error) {
+	n, _, err := recordEvent(name, window, 0)
+	return n, err
+}
+
+// recordEvent records an event in the named state file, unless limit events
+// have been recorded within the window already. A limit of zero means no
+// limit. It returns the number of events within the window, including this
+// one if it was recorded, and whether it was recorded. Events older than the
+// window are discarded.
+func recordEvent(name string, window time.Duration, limit int) (int, bool, error) {
+	f, err := lockedFile(name)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	now := clk.Now()
+	cutoff := now.Add(-window).UnixNano()
+	var events []int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		t, err := strconv.ParseInt(scanner.Text(), 10, 64)
+		if err == nil && t > cutoff {
+			events = append(events, t)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, false, err
+	}
+	if limit > 0 && len(events) >= limit {
+		return len(events), false, nil
+	}
+	events = append(events, now.UnixNano())
+
+	if err := f.Truncate(0); err != nil {
+		return 0, false, err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return 0, false, err
+	}
+	w := bufio.NewWriter(f)
+	for _, t := range events {
+		fmt.Fprintln(w, t)
+	}
+	return len(events), true, w.Flush()
+}
+
+// acquireSlot takes one of n slot locks for the named resource, without
+// waiting. The slot is held until the returned slot is closed, which is nil
+// when no slot was available.
+func acquireSlot(name string, n int) (io.Closer, error) {
+	if *stateBackend != "" {
+		if slot, err := acquireRedisSlot(name, n); slot != nil || err != nil {
+			return slot, err
+		}
+		return nil, nil
+	}
+	if *stateDir == "" {
+		return nil, fmt.Errorf("no --state-dir configured")
+	}
+	for i := 0; i < n; i++ {
+		path := filepath.Join(*stateDir, fmt.Sprintf("%s.slot%d", name, i))
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return f, nil
+		}
+		f.Close()
+		if err != syscall.EWOULDBLOCK {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// once reports whether the action with the given name hasn't been performed
+// within the interval, recording that it is performed now if so.
+func once(name string, interval time.Duration) (bool, error) {
+	f, err := lockedFile(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return false, err
+	}
+	now := clk.Now()
+	if last, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil && now.Sub(time.Unix(last, 0)) < interval {
+		return false, nil
+	}
+	if err := f.Truncate(0); err != nil {
+		return false, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	_, err = f.Write([]byte(strconv.FormatInt(now.Unix(), 10) + "\n"))
+	return err == nil, err
+}
+
+// submissionLifetime is how long completed submissions are remembered by
+// recordSubmission. Like keepCopyLifetime, it exceeds the default Postfix
+// maximal_queue_lifetime.
+const submissionLifetime = 7 * 24 * time.Hour
+
+// submissionKey identifies the submission sub of the message with the given
+// raw header section, which is the same when the message is retried.
+func submissionKey(header []byte, sub *submission) string {
+	h := sha256.New()
+	h.Write(header)
+	h.Write([]byte{0})
+	h.Write([]byte(strings.Join(sub.recipients, ",")))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// submitted reports whether the submission with the given key was recorded
+// by recordSubmission within submissionLifetime.
+func submitted(key string) (bool, error) {
+	return recordedKey("submitted", key, submissionLifetime)
+}
+
+// recordSubmission records that the submission with the given key
+// succeeded, so it isn't repeated when the message is retried because
+// another of its submissions failed.
+func recordSubmission(key string) error {
+	return recordKey("submitted", key, submissionLifetime)
+}
+
+// recordedKey reports whether key was recorded by recordKey in the named
+// state file within lifetime.
+func recordedKey(name, key string, lifetime time.Duration) (bool, error) {
+	f, err := lockedFile(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	_, found, err := readKeys(f, key, lifetime)
+	return found, err
+}
+
+// recordKey records key in the named state file, unless it's there already.
+// Entries older than lifetime are forgotten.
+func recordKey(name, key string, lifetime time.Duration) error {
+	f, err := lockedFile(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	lines, found, err := readKeys(f, key, lifetime)
+	if err != nil || found {
+		return err
+	}
+	return writeLines(f, append(lines, fmt.Sprintf("%s %d", key, clk.Now().Unix())))
+}
+
+// readKeys reads the "key timestamp" lines of a state file, dropping those
+// older than lifetime. It returns the remaining lines, and whether one of
+// them records key.
+func readKeys(f io.Reader, key string, lifetime time.Duration) ([]string, bool, error) {
+	now := clk.Now()
+	var lines []string
+	found := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		t, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || now.Sub(time.Unix(t, 0)) >= lifetime {
+			continue
+		}
+		found = found || fields[0] == key
+		lines = append(lines, scanner.Text())
+	}
+	return lines, found, scanner.Err()
+}
+
+// writeLines replaces the content of the state file f with lines.
+func writeLines(f stateFile, lines []string) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+	return w.Flush()
+}
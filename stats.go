@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// statsFile is the state file the outcome of every message is appended to
+// with --stats, as one line of time, forwarding address, sender, size and
+// result.
+const statsFile = "stats"
+
+// Results recorded in the stats file.
+const (
+	statsForwarded = "forwarded"
+	statsFailed    = "failed"
+)
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+// recordStats appends the outcome of processing the message in ctx to the
+// stats file, when --stats is enabled. The forwarding address is the
+// original recipient, or the recipients when it isn't known. Failures to
+// record are logged, but otherwise ignored.
+func recordStats(ctx context.Context, result string) {
+	if !*statsEnabled {
+		return
+	}
+	msg := messageFrom(ctx)
+	address := msg.origTo
+	if address == "" {
+		address = strings.Join(msg.recipients, ",")
+	}
+	line := fmt.Sprintf("%d %s %s %d %s\n", clk.Now().Unix(), greylistField(address),
+		greylistField(strings.Trim(msg.returnPath, "<>")), msg.size, result)
+
+	err := func() error {
+		if *stateDir == "" {
+			return fmt.Errorf("no --state-dir configured")
+		}
+		f, err := os.OpenFile(filepath.Join(*stateDir, statsFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+			return err
+		}
+		_, err = f.WriteString(line)
+		return err
+	}()
+	if err != nil {
+		warnf(ctx, "unable to record statistics: %s", err)
+	}
+}
+
+// addressUsage holds the statistics of a forwarding address.
+type addressUsage struct {
+	Address    string        `json:"address"`
+	Forwarded  int           `json:"forwarded"`
+	Failed     int           `json:"failed"`
+	Bytes      int64         `json:"bytes"`
+	TopSenders []senderUsage `json:"top_senders"`
+	senders    map[string]int
+}
+
+// senderUsage is the number of messages from a sender.
+type senderUsage struct {
+	Sender   string `json:"sender"`
+	Messages int    `json:"messages"`
+}
+
+// parsePeriod parses a report period, either a number of days such as 30d
+// or a duration such as 12h.
+func parsePeriod(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid period %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid period %q", s)
+	}
+	return d, nil
+}
+
+// readUsage reads the statistics recorded since the given time from the
+// stats file in r, sorted by address. Only the top senders by message count
+// are kept.
+func readUsage(r io.Reader, since time.Time, top int) ([]*addressUsage, error) {
+	usage := map[string]*addressUsage{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 5 {
+			continue
+		}
+		t, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || time.Unix(t, 0).Before(since) {
+			continue
+		}
+		size, _ := strconv.ParseInt(fields[3], 10, 64)
+		u := usage[fields[1]]
+		if u == nil {
+			u = &addressUsage{Address: fields[1], senders: map[string]int{}}
+			usage[fields[1]] = u
+		}
+		if fields[4] == statsFailed {
+			u.Failed++
+		} else {
+			u.Forwarded++
+		}
+		u.Bytes += size
+		u.senders[fields[2]]++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var report []*addressUsage
+	for _, u := range usage {
+		for sender, n := range u.senders {
+			u.TopSenders = append(u.TopSenders, senderUsage{Sender: sender, Messages: n})
+		}
+		sort.Slice(u.TopSenders, func(i, j int) bool {
+			a, b := u.TopSenders[i], u.TopSenders[j]
+			return a.Messages > b.Messages || (a.Messages == b.Messages && a.Sender < b.Sender)
+		})
+		if len(u.TopSenders) > top {
+			u.TopSenders = u.TopSenders[:top]
+		}
+		report = append(report, u)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Address < report[j].Address
+	})
+	return report, nil
+}
+
+// usageReport implements the "report" subcommand, which summarizes the
+// statistics recorded with --stats in --state-dir per forwarding address.
+// It returns the exit status of the subcommand.
+func usageReport(args []string) int {
+	set := flag.NewFlagSet("report", flag.ContinueOnError)
+	periodFlag := set.String("period", "30d", "report on the messages of this period before now, e.g. 30d or 12h")
+	format := set.String("format", "text", "output format: text, csv or json")
+	top := set.Int("top", 5, "number of top senders listed per address")
+	if err := set.Parse(args); err != nil {
+		return 2
+	}
+	switch *format {
+	case "text", "csv", "json":
+	default:
+		fmt.Fprintf(os.Stderr, "report: invalid --format %q, expected text, csv or json\n", *format)
+		return 2
+	}
+	period, err := parsePeriod(*periodFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report: %s\n", err)
+		return 2
+	}
+	if *stateDir == "" {
+		fmt.Fprintln(os.Stderr, "report: --state-dir is required")
+		return 2
+	}
+
+	f, err := os.Open(filepath.Join(*stateDir, statsFile))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report: %s\n", err)
+		return 1
+	}
+	defer f.Close()
+	now := clk.Now()
+	report, err := readUsage(f, now.Add(-period), *top)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report: %s\n", err)
+		return 1
+	}
+
+	switch *format {
+	case "text":
+		fmt.Printf("Forwarding usage from %s to %s\n", now.Add(-period).Format(time.RFC3339), now.Format(time.RFC3339))
+		for _, u := range report {
+			fmt.Printf("\n%s\n", u.Address)
+			fmt.Printf("  Messages:     %d forwarded, %d failed\n", u.Forwarded, u.Failed)
+			fmt.Printf("  Bytes:        %d\n", u.Bytes)
+			var senders []string
+			for _, s := range u.TopSenders {
+				senders = append(senders, fmt.Sprintf("%s (%d)", s.Sender, s.Messages))
+			}
+			fmt.Printf("  Top senders:  %s\n", strings.Join(senders, ", "))
+		}
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"address", "forwarded", "failed", "bytes", "top_senders"})
+		for _, u := range report {
+			var senders []string
+			for _, s := range u.TopSenders {
+				senders = append(senders, fmt.Sprintf("%s:%d", s.Sender, s.Messages))
+			}
+			w.Write([]string{u.Address, strconv.Itoa(u.Forwarded), strconv.Itoa(u.Failed),
+				strconv.FormatInt(u.Bytes, 10), strings.Join(senders, " ")})
+		}
+		w.Flush()
+	case "json":
+		if report == nil {
+			report = []*addressUsage{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	}
+	return 0
+}
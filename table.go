@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// table is an in-memory lookup table using the format of Postfix table
+// source files as documented in postmap(1): a key, whitespace, and a value,
+// with lines starting with whitespace continuing the previous entry. Keys are
+// stored in lowercase since Postfix lookups are case-insensitive.
+type table map[string]string
+
+// readTable reads a Postfix lookup table from its source file. A map type
+// prefix such as "hash:" is accepted and ignored, so the same value used in
+// main.cf may be given.
+func readTable(ctx context.Context, path string) (table, error) {
+	if i := strings.Index(path, ":"); i >= 0 && !strings.Contains(path[:i], "/") {
+		path = path[i+1:]
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t := table{}
+	var key string
+	entries := 0
+	linenum := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		linenum++
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if entries == 0 {
+				return nil, fmt.Errorf("%s:%d: continuation line without preceding entry", path, linenum)
+			}
+			if key != "" {
+				t[key] += " " + trimmed
+			}
+			continue
+		}
+		i := strings.IndexAny(trimmed, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected format: key whitespace value", path, linenum)
+		}
+		entries++
+		key = strings.ToLower(trimmed[:i])
+		if _, ok := t[key]; ok {
+			// Like postmap(1), keep the first entry for a duplicate key.
+			warnf(ctx, "%s:%d: duplicate entry: %q", path, linenum, key)
+			key = ""
+			continue
+		}
+		t[key] = strings.TrimSpace(trimmed[i:])
+	}
+	return t, scanner.Err()
+}
+
+// tcpTable is a lookup table served via the Postfix tcp_table(5) protocol.
+type tcpTable struct {
+	pool *connPool
+}
+
+// tcpTablePools holds the connections to TCP table servers by address, so
+// they are reused across messages in daemon mode.
+var (
+	tcpTablePoolsMu sync.Mutex
+	tcpTablePools   = map[string]*connPool{}
+)
+
+// newTCPTable returns the TCP table served at addr.
+func newTCPTable(addr string) *tcpTable {
+	tcpTablePoolsMu.Lock()
+	defer tcpTablePoolsMu.Unlock()
+	pool := tcpTablePools[addr]
+	if pool == nil {
+		pool = newConnPool("tcp", addr)
+		tcpTablePools[addr] = pool
+	}
+	return &tcpTable{pool: pool}
+}
+
+// get looks up key, reporting whether the table has an entry for it. Keys
+// and values are encoded as described in tcp_table(5).
+func (t *tcpTable) get(ctx context.Context, key string) (string, bool, error) {
+	var code int
+	var msg string
+	err := t.pool.do(ctx, func(c *textproto.Conn) error {
+		id, err := c.Cmd("get %s", tcpEncode(key))
+		if err != nil {
+			return err
+		}
+		c.StartResponse(id)
+		defer c.EndResponse(id)
+		code, msg, err = c.ReadCodeLine(-1)
+		return err
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("lookup at %s: %w", t.pool.addr, err)
+	}
+	switch code {
+	case 200:
+		return tcpDecode(msg), true, nil
+	case 500:
+		return "", false, nil
+	default:
+		return "", false, fmt.Errorf("lookup at %s: returncode %d (%s)", t.pool.addr, code, tcpDecode(msg))
+	}
+}
+
+// tcpEncode encodes whitespace, control characters, non-ASCII characters
+// and percent signs as %XX, as required by tcp_table(5).
+func tcpEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c <= ' ' || c >= 0x7f || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// tcpDecode decodes the %XX escapes of tcp_table(5). Invalid escapes are
+// left as they are.
+func tcpDecode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestTCPEncoding checks the tcp_table(5) encoding of keys and values.
+func TestTCPEncoding(t *testing.T) {
+	tests := []struct {
+		plain, encoded string
+	}{
+		{"user@example.org", "user@example.org"},
+		{"a b", "a%20b"},
+		{"100%", "100%25"},
+		{"tab\tnewline\n", "tab%09newline%0A"},
+		{"caf\xc3\xa9", "caf%C3%A9"},
+	}
+	for _, test := range tests {
+		if encoded := tcpEncode(test.plain); encoded != test.encoded {
+			t.Errorf("tcpEncode(%q) = %q, expected %q", test.plain, encoded, test.encoded)
+		}
+		if plain := tcpDecode(test.encoded); plain != test.plain {
+			t.Errorf("tcpDecode(%q) = %q, expected %q", test.encoded, plain, test.plain)
+		}
+	}
+	// Invalid escapes are kept as they are.
+	for _, s := range []string{"%", "%4", "%zz", "50%"} {
+		if decoded := tcpDecode(s); decoded != s {
+			t.Errorf("tcpDecode(%q) = %q", s, decoded)
+		}
+	}
+}
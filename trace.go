@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// traceSignatureHeader is the header field signing the trace header fields
+// added by postforward with --trace-key.
+const traceSignatureHeader = "X-Postforward-Signature"
+
+// signTrace returns the trace signature field for the message with the
+// given header section, which starts with count trace header fields added
+// by postforward. The signature covers those fields, listed in its h= tag
+// in order, and the Message-ID of the message, so they can't be moved to
+// another message. The field uses the same line ending as the first line of
+// header.
+func (s dkimSigner) signTrace(header []byte, count int, now time.Time) ([]byte, error) {
+	fields := splitHeaderFields(header)
+	if len(fields) < count {
+		return nil, errors.New("trace header fields missing")
+	}
+	h := sha256.New()
+	var names []string
+	for _, field := range fields[:count] {
+		names = append(names, strings.ToLower(headerName(field)))
+		h.Write(relaxedHeader(field))
+		h.Write([]byte("\r\n"))
+	}
+	hashMessageID(h, fields)
+	value := fmt.Sprintf("v=1; a=%s; t=%d; h=%s; b=", s.algorithm(), now.Unix(), strings.Join(names, ":"))
+	return s.signField(traceSignatureHeader, value, h, lineEnding(fields))
+}
+
+// hashMessageID writes the Message-ID field of the header fields, if any,
+// to h in relaxed canonical form.
+func hashMessageID(h io.Writer, fields [][]byte) {
+	if field := lastHeaderField(fields, "Message-ID", 0); field != nil {
+		h.Write(relaxedHeader(field))
+		h.Write([]byte("\r\n"))
+	}
+}
+
+// verifyTrace verifies the trace signature field fields[i] with key. The
+// signed fields are those right below the signature. It returns the names
+// of the signed fields and the time of the signature.
+func verifyTrace(fields [][]byte, i int, key crypto.PublicKey) ([]string, time.Time, error) {
+	tags, err := parseTags(fieldValue(fields[i]))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if tags["v"] != "1" {
+		return nil, time.Time{}, fmt.Errorf("unsupported version %q", tags["v"])
+	}
+	for _, tag := range []string{"a", "b", "h", "t"} {
+		if tags[tag] == "" {
+			return nil, time.Time{}, fmt.Errorf("missing %s= tag", tag)
+		}
+	}
+	if tags["a"] != "rsa-sha256" && tags["a"] != "ed25519-sha256" {
+		return nil, time.Time{}, fmt.Errorf("unsupported algorithm %q", tags["a"])
+	}
+	t, err := strconv.ParseInt(tags["t"], 10, 64)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("invalid t= tag %q", tags["t"])
+	}
+
+	h := sha256.New()
+	names := strings.Split(tags["h"], ":")
+	for j, name := range names {
+		names[j] = strings.ToLower(strings.TrimSpace(name))
+		if i+1+j >= len(fields) || !strings.EqualFold(headerName(fields[i+1+j]), names[j]) {
+			return nil, time.Time{}, fmt.Errorf("signed %s header field missing", names[j])
+		}
+		h.Write(relaxedHeader(fields[i+1+j]))
+		h.Write([]byte("\r\n"))
+	}
+	hashMessageID(h, fields)
+	name, value, _ := bytes.Cut(fields[i], []byte(":"))
+	unsigned := append(append(append([]byte(nil), name...), ':'), signatureTag.ReplaceAll(value, []byte("$1"))...)
+	h.Write(relaxedHeader(unsigned))
+
+	b, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return nil, time.Time{}, errors.New("invalid signature encoding")
+	}
+	if !verifyHash(key, h.Sum(nil), b) {
+		return nil, time.Time{}, errors.New("signature verification failed")
+	}
+	return names, time.Unix(t, 0), nil
+}
+
+// loadPublicKey reads the PEM encoded RSA or Ed25519 public key at path, as
+// written by openssl pkey -pubout.
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s: no PEM encoded public key found", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported key algorithm", path)
+}
+
+// verifyTraceCommand implements the "verify-trace" subcommand, which checks
+// the trace signatures of the messages in the given files, or read from
+// standard input, against the public key of the forwarder. It returns the
+// exit status of the subcommand: 0 when every message has a valid
+// signature, 1 when one hasn't and 2 on errors.
+func verifyTraceCommand(args []string) int {
+	set := flag.NewFlagSet("verify-trace", flag.ContinueOnError)
+	keyPath := set.String("key", "", "PEM encoded public key of the --trace-key of the forwarder")
+	if err := set.Parse(args); err != nil {
+		return 2
+	}
+	if *keyPath == "" {
+		fmt.Fprintln(os.Stderr, "verify-trace: --key is required")
+		return 2
+	}
+	key, err := loadPublicKey(*keyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "verify-trace: %s\n", err)
+		return 2
+	}
+	paths := set.Args()
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+	status := 0
+	for _, path := range paths {
+		var data []byte
+		if path == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(path)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "verify-trace: %s\n", err)
+			return 2
+		}
+		if !verifyTraces(path, splitHeaderFields(data), key) && status == 0 {
+			status = 1
+		}
+	}
+	return status
+}
+
+// verifyTraces prints the results of verifying every trace signature in the
+// header fields of the message read from path, reporting whether one of them
+// is valid. Signatures of other forwarders the message passed through fail
+// to verify with the given key, so one valid signature is enough.
+func verifyTraces(path string, fields [][]byte, key crypto.PublicKey) bool {
+	valid, found := false, false
+	for i, field := range fields {
+		if !isHeader(field, []string{traceSignatureHeader}) {
+			continue
+		}
+		found = true
+		names, signed, err := verifyTrace(fields, i, key)
+		if err != nil {
+			fmt.Printf("%s: invalid signature: %s\n", path, err)
+			continue
+		}
+		valid = true
+		fmt.Printf("%s: valid signature of %s, made %s\n", path, strings.Join(names, ", "), signed.Format(time.RFC3339))
+	}
+	if !found {
+		fmt.Printf("%s: no %s header field\n", path, traceSignatureHeader)
+	}
+	return valid
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net/mail"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// automatedLocalParts lists local parts of senders which are never sent
+// auto-replies, as they belong to mail systems or mailing list software.
+var automatedLocalParts = []string{"mailer-daemon", "postmaster", "listserv", "majordomo", "noreply", "no-reply"}
+
+// autoReplySuppressed returns why the sender of a message with the given
+// header must not receive an auto-reply, following RFC 3834, or an empty
+// string if it may. suppress lists addresses and @domains never replied to.
+func autoReplySuppressed(header mail.Header, sender, recipient string, suppress []string) string {
+	if sender == "" {
+		return "message has a null sender"
+	}
+	if v := strings.TrimSpace(header.Get("Auto-Submitted")); v != "" && !strings.EqualFold(v, "no") {
+		return "message is auto-submitted"
+	}
+	switch strings.ToLower(strings.TrimSpace(header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return "message is bulk mail"
+	}
+	for name := range header {
+		if strings.HasPrefix(name, "List-") {
+			return "message is from a mailing list"
+		}
+	}
+
+	local, domain := splitAddress(strings.ToLower(sender))
+	for _, name := range automatedLocalParts {
+		if local == name {
+			return "sender is an automated address"
+		}
+	}
+	if strings.HasPrefix(local, "owner-") || strings.HasSuffix(local, "-request") {
+		return "sender is a mailing list address"
+	}
+	for _, s := range suppress {
+		if strings.EqualFold(s, sender) || strings.EqualFold(s, "@"+domain) {
+			return "sender is on the suppression list"
+		}
+	}
+
+	// Replying to mail which only reached the recipient via Bcc or an alias
+	// would tell the sender more than they should know.
+	if !addressedTo(header, []string{"To", "Cc"}, recipient) {
+		return "message is not addressed to " + recipient
+	}
+	return ""
+}
+
+// readSuppressionList reads the addresses and @domains listed in the file at
+// path, one per line. Blank lines and lines starting with # are ignored.
+func readSuppressionList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			entries = append(entries, line)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// vacationDue records that recipient replies to sender now, unless it
+// already did within the interval. It reports whether a reply is due. The
+// database is kept in --state-dir, entries older than the interval are
+// forgotten.
+func vacationDue(recipient, sender string, interval time.Duration) (bool, error) {
+	f, err := lockedFile("vacation")
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	now := clk.Now()
+	key := greylistField(recipient) + " " + greylistField(sender)
+	replied := map[string]int64{}
+	var keys []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		t, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || now.Sub(time.Unix(t, 0)) >= interval {
+			continue
+		}
+		k := fields[0] + " " + fields[1]
+		if _, ok := replied[k]; !ok {
+			keys = append(keys, k)
+		}
+		replied[k] = t
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+	if _, ok := replied[key]; ok {
+		return false, nil
+	}
+	replied[key] = now.Unix()
+	keys = append(keys, key)
+
+	if err := f.Truncate(0); err != nil {
+		return false, err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return false, err
+	}
+	w := bufio.NewWriter(f)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s %d\n", k, replied[k])
+	}
+	return true, w.Flush()
+}
+
+// autoReply sends the --vacation-message auto-reply from recipient to the
+// sender of the current message, unless it's suppressed or the sender was
+// sent one within --vacation-interval. Failures are logged, but don't affect
+// the forwarded message.
+func autoReply(ctx context.Context, header mail.Header, recipient, sender string) {
+	var suppress []string
+	if *vacationSuppress != "" {
+		var err error
+		if suppress, err = readSuppressionList(*vacationSuppress); err != nil {
+			warnf(ctx, "not sending auto-reply: unable to read suppression list: %s", err)
+			return
+		}
+	}
+	if reason := autoReplySuppressed(header, sender, recipient, suppress); reason != "" {
+		explainf(ctx, "not sending auto-reply: %s", reason)
+		if *dryRun && !messageFrom(ctx).explaining {
+			fmt.Printf("Would not send auto-reply: %s\n", reason)
+		}
+		return
+	}
+	text, err := os.ReadFile(*vacationMessage)
+	if err != nil {
+		warnf(ctx, "not sending auto-reply: %s", err)
+		return
+	}
+	reply := autoReplyMessage(ctx, header, recipient, sender, text)
+	if messageFrom(ctx).explaining {
+		explainf(ctx, "would send auto-reply to %s", sender)
+		return
+	}
+	if *dryRun {
+		fmt.Printf("Would send auto-reply to %s:\n\n", sender)
+		os.Stdout.Write(reply)
+		return
+	}
+
+	due, err := vacationDue(recipient, sender, *vacationInterval)
+	if err != nil {
+		warnf(ctx, "not sending auto-reply: %s", err)
+		return
+	}
+	if !due {
+		return
+	}
+	// Auto-replies use the null sender so they can never bounce back.
+	if *deliver != "" {
+		delivery, err := parseDelivery(*deliver, *deliverTLS, *deliverPasswordFile, *downgrade8bitFlag)
+		if err == nil {
+			err = delivery.deliver(ctx, getHostname(ctx), "", []string{sender}, bytes.NewReader(reply))
+		}
+		if err != nil {
+			warnf(ctx, "unable to send auto-reply to %s: %s", sender, err)
+		}
+		return
+	}
+	sendmail := exec.CommandContext(ctx, *sendmailPath, "-i", "-f", "", "--", sender)
+	sendmail.Stdin = bytes.NewReader(reply)
+	if out, err := sendmail.CombinedOutput(); err != nil {
+		warnf(ctx, "unable to send auto-reply to %s: %s (%s)", sender, err, bytes.TrimSpace(out))
+		return
+	}
+	infof(ctx, "sent auto-reply to %s", sender)
+}
+
+// autoReplyMessage returns the auto-reply to a message with the given
+// header, with text as its body.
+func autoReplyMessage(ctx context.Context, header mail.Header, recipient, sender string, text []byte) []byte {
+	msg := messageFrom(ctx)
+	subject := *vacationSubject
+	if subject == "" {
+		subject = "Auto: " + decodeHeader(header.Get("Subject"))
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\n", recipient)
+	fmt.Fprintf(&b, "To: %s\n", sender)
+	fmt.Fprintf(&b, "Subject: %s\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\n", clk.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s.auto-reply@%s>\n", msg.queueID, getHostname(ctx))
+	if id := strings.TrimSpace(header.Get("Message-ID")); id != "" {
+		fmt.Fprintf(&b, "In-Reply-To: %s\n", id)
+		fmt.Fprintf(&b, "References: %s\n", strings.TrimSpace(header.Get("References")+" "+id))
+	}
+	fmt.Fprintf(&b, "Auto-Submitted: auto-replied\n")
+	fmt.Fprintf(&b, "MIME-Version: 1.0\n")
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\n")
+	fmt.Fprintf(&b, "Content-Transfer-Encoding: 8bit\n")
+	fmt.Fprintf(&b, "\n")
+	b.Write(text)
+	return b.Bytes()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// verificationProvider describes the forwarding verification messages sent
+// by a mail provider when forwarding to it is set up.
+type verificationProvider struct {
+	name string
+	// sender is the From address of verification messages.
+	sender string
+	// subject matches the subject of verification messages. The first
+	// submatch is the confirmation code.
+	subject *regexp.Regexp
+}
+
+// verificationProviders lists the known provider verification messages.
+var verificationProviders = []verificationProvider{
+	{
+		name:    "Gmail",
+		sender:  "forwarding-noreply@google.com",
+		subject: regexp.MustCompile(`^\(#(\d+)\) Gmail Forwarding Confirmation`),
+	},
+}
+
+// detectVerification reports whether the message with the given header is a
+// forwarding verification message, returning the provider name and the
+// confirmation code.
+func detectVerification(header mail.Header) (provider, code string, ok bool) {
+	from, err := mail.ParseAddress(header.Get("From"))
+	if err != nil {
+		return "", "", false
+	}
+	subject := decodeHeader(header.Get("Subject"))
+	for _, p := range verificationProviders {
+		if !strings.EqualFold(from.Address, p.sender) {
+			continue
+		}
+		if m := p.subject.FindStringSubmatch(subject); m != nil {
+			return p.name, m[1], true
+		}
+	}
+	return "", "", false
+}
+
+// reportVerification surfaces a forwarding verification code on stderr, the
+// alert webhook and to the admin address, whichever are configured.
+func reportVerification(ctx context.Context, provider, code string, recipients []string) {
+	msg := fmt.Sprintf("%s forwarding confirmation code %s received for %s",
+		provider, code, strings.Join(recipients, ", "))
+	infof(ctx, "%s", msg)
+	if *alertWebhook != "" {
+		alert(ctx, fmt.Sprintf("Postforward on %s: %s", getHostname(ctx), msg))
+	}
+	if *notifyAdmin != "" {
+		notify(ctx, fmt.Sprintf("Postforward: %s forwarding confirmation", provider),
+			"Postforward received a forwarding verification message. The message\nis forwarded as usual.", msg)
+	}
+}